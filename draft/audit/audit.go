@@ -0,0 +1,287 @@
+// Package audit records plans, deployments, parameter changes and destructions of instances in an
+// append-only audit log. The log is a JSON Lines file of entries. Every entry contains the hash of
+// the entry before it so that changing, removing or reordering entries is detected by Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/teleivo/providers/deploy"
+	"github.com/teleivo/providers/stack"
+)
+
+// Action recorded in the log.
+type Action string
+
+const (
+	Plan    Action = "plan"
+	Deploy  Action = "deploy"
+	Update  Action = "update"
+	Destroy Action = "destroy"
+)
+
+// Outcome of an action.
+type Outcome string
+
+const (
+	Success Outcome = "success"
+	Failure Outcome = "failure"
+)
+
+// Entry of the audit log.
+type Entry struct {
+	// Seq is the position of the entry in the log starting at 1.
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   Action    `json:"action"`
+	Group    string    `json:"group"`
+	Instance string    `json:"instance"`
+	Stack    string    `json:"stack,omitempty"`
+	// Changes to the parameters of the instance sorted by parameter name.
+	Changes []Change `json:"changes,omitempty"`
+	Outcome Outcome  `json:"outcome"`
+	Error   string   `json:"error,omitempty"`
+	// PrevHash is the hash of the previous entry. It is empty for the first entry.
+	PrevHash string `json:"prevHash"`
+	// Hash of the entry computed over all other fields.
+	Hash string `json:"hash"`
+}
+
+func (e Entry) hash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ChangeKind is the kind of a parameter change.
+type ChangeKind string
+
+const (
+	Added   ChangeKind = "added"
+	Removed ChangeKind = "removed"
+	Changed ChangeKind = "changed"
+)
+
+// Change of a parameter. Sensitive values are redacted. See deploy.Sensitive.
+type Change struct {
+	Parameter string     `json:"parameter"`
+	Kind      ChangeKind `json:"kind"`
+	Old       string     `json:"old,omitempty"`
+	New       string     `json:"new,omitempty"`
+}
+
+// Diff returns the changes from the old to the new parameters sorted by parameter name. Values of
+// sensitive parameters are redacted so the log only shows that they changed.
+func Diff(old, new map[string]stack.Parameter) []Change {
+	names := make(map[string]struct{}, len(old)+len(new))
+	for k := range old {
+		names[k] = struct{}{}
+	}
+	for k := range new {
+		names[k] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var result []Change
+	for _, k := range sorted {
+		o, inOld := old[k]
+		n, inNew := new[k]
+		switch {
+		case !inOld:
+			result = append(result, Change{Parameter: k, Kind: Added, New: redact(k, n)})
+		case !inNew:
+			result = append(result, Change{Parameter: k, Kind: Removed, Old: redact(k, o)})
+		case o.Value != n.Value:
+			result = append(result, Change{Parameter: k, Kind: Changed, Old: redact(k, o), New: redact(k, n)})
+		}
+	}
+	return result
+}
+
+func redact(name string, p stack.Parameter) string {
+	if p.Value != "" && deploy.Sensitive(name, p) {
+		return deploy.Redacted
+	}
+	return p.Value
+}
+
+// ErrTampered is returned by Verify if the log was changed after entries were written.
+var ErrTampered = errors.New("audit log was tampered with")
+
+// Log appends entries to an audit log. A Log is safe for concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+	seq  int64
+	last string
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewLog creates a log writing a new chain of entries to w.
+func NewLog(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+// Open opens the audit log file for appending. The file is created if it does not exist. Entries
+// already in the file are verified so that new entries extend an intact chain. Close the log when
+// done.
+func Open(name string) (*Log, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	last, err := verify(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open audit log %q: %w", name, err)
+	}
+	return &Log{w: f, file: f, seq: last.Seq, last: last.Hash}, nil
+}
+
+// Close closes the file of a log opened using Open.
+func (l *Log) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Record appends the entry to the log. The sequence number, hashes and the time if it is not set
+// are filled in. Returns the recorded entry.
+func (l *Log) Record(e Entry) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e.Time.IsZero() {
+		if l.Now != nil {
+			e.Time = l.Now()
+		} else {
+			e.Time = time.Now()
+		}
+	}
+	e.Time = e.Time.UTC()
+	e.Seq = l.seq + 1
+	e.PrevHash = l.last
+	hash, err := e.hash()
+	if err != nil {
+		return Entry{}, err
+	}
+	e.Hash = hash
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return Entry{}, err
+	}
+	_, err = l.w.Write(append(b, '\n'))
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to write audit log entry: %v", err)
+	}
+	l.seq, l.last = e.Seq, e.Hash
+	return e, nil
+}
+
+// Verify verifies that the entries of the log form an intact hash chain. Returns the number of
+// verified entries. Returns an error wrapping ErrTampered pointing to the first invalid entry.
+func Verify(r io.Reader) (int64, error) {
+	last, err := verify(r)
+	return last.Seq, err
+}
+
+func verify(r io.Reader) (Entry, error) {
+	var last Entry
+	err := scan(r, func(line int, e Entry) error {
+		want, err := e.hash()
+		if err != nil {
+			return err
+		}
+		switch {
+		case e.Seq != last.Seq+1:
+			return fmt.Errorf("line %d: want entry %d, instead got %d: %w", line, last.Seq+1, e.Seq, ErrTampered)
+		case e.PrevHash != last.Hash:
+			return fmt.Errorf("line %d: entry %d does not follow entry %d: %w", line, e.Seq, last.Seq, ErrTampered)
+		case e.Hash != want:
+			return fmt.Errorf("line %d: entry %d does not match its hash: %w", line, e.Seq, ErrTampered)
+		}
+		last = e
+		return nil
+	})
+	return last, err
+}
+
+func scan(r io.Reader, fn func(line int, e Entry) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		var e Entry
+		dec := json.NewDecoder(bytes.NewReader(s.Bytes()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("line %d: invalid entry: %v: %w", line, err, ErrTampered)
+		}
+		if err := fn(line, e); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// Filter selects entries. Zero fields match any entry.
+type Filter struct {
+	Group    string
+	Instance string
+	// Since and Until select entries recorded in the interval [Since, Until).
+	Since time.Time
+	Until time.Time
+}
+
+// Match reports whether the entry is selected by the filter.
+func (f Filter) Match(e Entry) bool {
+	if f.Group != "" && e.Group != f.Group {
+		return false
+	}
+	if f.Instance != "" && e.Instance != f.Instance {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Read reads the entries of the log matching the filter in the order they were recorded. Entries
+// are not verified. Use Verify for that.
+func Read(r io.Reader, f Filter) ([]Entry, error) {
+	var result []Entry
+	err := scan(r, func(_ int, e Entry) error {
+		if f.Match(e) {
+			result = append(result, e)
+		}
+		return nil
+	})
+	return result, err
+}
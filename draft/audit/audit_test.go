@@ -0,0 +1,261 @@
+package audit_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/teleivo/providers/audit"
+	"github.com/teleivo/providers/deploy"
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/stack"
+)
+
+var start = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// clock returns times starting at start advancing by an hour on every call.
+func clock() func() time.Time {
+	now := start.Add(-time.Hour)
+	return func() time.Time {
+		now = now.Add(time.Hour)
+		return now
+	}
+}
+
+func openLog(t *testing.T, file string) *audit.Log {
+	t.Helper()
+
+	log, err := audit.Open(file)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Cleanup(func() { log.Close() })
+	log.Now = clock()
+	return log
+}
+
+func readFile(t *testing.T, file string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return string(b)
+}
+
+func db(params map[string]string) stack.Instance {
+	inst := stack.Instance{
+		Name:       "db",
+		Group:      "dev",
+		Stack:      stack.Stack{Name: "dhis2-db", Version: "16.0.0"},
+		Parameters: make(map[string]stack.Parameter, len(params)),
+	}
+	for k, v := range params {
+		inst.Parameters[k] = stack.Parameter{Value: v}
+	}
+	return inst
+}
+
+func TestLog(t *testing.T) {
+	t.Run("AppendToExistingLog", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "audit.jsonl")
+		log := openLog(t, file)
+		first, err := log.Record(audit.Entry{Actor: "ivo", Action: audit.Deploy, Group: "dev", Instance: "db", Outcome: audit.Success})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		log.Close()
+
+		log = openLog(t, file)
+		second, err := log.Record(audit.Entry{Actor: "ivo", Action: audit.Destroy, Group: "dev", Instance: "db", Outcome: audit.Success})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if second.Seq != 2 || second.PrevHash != first.Hash {
+			t.Errorf("want entry 2 to follow entry %s, instead got entry %d following %s", first.Hash, second.Seq, second.PrevHash)
+		}
+		n, err := audit.Verify(strings.NewReader(readFile(t, file)))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if n != 2 {
+			t.Errorf("want 2 verified entries, instead got %d", n)
+		}
+	})
+
+	t.Run("DetectTampering", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "audit.jsonl")
+		log := openLog(t, file)
+		for _, name := range []string{"db", "core", "pgadmin"} {
+			_, err := log.Record(audit.Entry{Actor: "ivo", Action: audit.Deploy, Group: "dev", Instance: name, Outcome: audit.Success})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+		lines := strings.SplitAfter(readFile(t, file), "\n")
+
+		tests := map[string]struct {
+			log  string
+			want string
+		}{
+			"ChangedEntry": {
+				log:  lines[0] + strings.Replace(lines[1], `"actor":"ivo"`, `"actor":"eve"`, 1) + lines[2],
+				want: "line 2: entry 2 does not match its hash",
+			},
+			"RemovedEntry": {
+				log:  lines[0] + lines[2],
+				want: "line 2: want entry 2, instead got 3",
+			},
+			"ReorderedEntries": {
+				log:  lines[1] + lines[0],
+				want: "line 1: want entry 1, instead got 2",
+			},
+			"AddedField": {
+				log:  lines[0] + strings.Replace(lines[1], `{`, `{"note":"x",`, 1),
+				want: "line 2: invalid entry",
+			},
+		}
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				_, err := audit.Verify(strings.NewReader(tc.log))
+
+				if !errors.Is(err, audit.ErrTampered) {
+					t.Fatalf("want error %v, instead got %v", audit.ErrTampered, err)
+				}
+				if !strings.Contains(err.Error(), tc.want) {
+					t.Errorf("want error to contain '%s', instead got '%s'", tc.want, err.Error())
+				}
+			})
+		}
+
+		err := os.WriteFile(file, []byte(tests["ChangedEntry"].log), 0o600)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		_, err = audit.Open(file)
+		if !errors.Is(err, audit.ErrTampered) {
+			t.Errorf("want opening a tampered log to fail with %v, instead got %v", audit.ErrTampered, err)
+		}
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "audit.jsonl")
+		log := openLog(t, file)
+		for _, e := range []audit.Entry{
+			{Group: "dev", Instance: "db"},
+			{Group: "dev", Instance: "core"},
+			{Group: "qa", Instance: "db"},
+			{Group: "dev", Instance: "db"},
+		} {
+			e.Actor, e.Action, e.Outcome = "ivo", audit.Deploy, audit.Success
+			if _, err := log.Record(e); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+
+		tests := map[string]struct {
+			filter audit.Filter
+			want   []int64
+		}{
+			"All":      {filter: audit.Filter{}, want: []int64{1, 2, 3, 4}},
+			"Group":    {filter: audit.Filter{Group: "dev"}, want: []int64{1, 2, 4}},
+			"Instance": {filter: audit.Filter{Group: "dev", Instance: "db"}, want: []int64{1, 4}},
+			"Time":     {filter: audit.Filter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, want: []int64{2, 3}},
+		}
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				entries, err := audit.Read(strings.NewReader(readFile(t, file)), tc.filter)
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+
+				var got []int64
+				for _, e := range entries {
+					got = append(got, e.Seq)
+				}
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Errorf("Read() mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+}
+
+func TestDiff(t *testing.T) {
+	old := map[string]stack.Parameter{
+		"DATABASE_NAME":     {Value: "mono"},
+		"DATABASE_PASSWORD": {Value: "faa", Sensitive: true},
+		"DATABASE_SIZE":     {Value: "20Gi"},
+		"API_TOKEN":         {Value: "t0k3n"},
+	}
+	new := map[string]stack.Parameter{
+		"DATABASE_NAME":     {Value: "mono"},
+		"DATABASE_PASSWORD": {Value: "foo", Sensitive: true},
+		"DATABASE_SIZE":     {Value: "30Gi"},
+		"DATABASE_ID":       {Value: "1"},
+	}
+
+	got := audit.Diff(old, new)
+
+	want := []audit.Change{
+		{Parameter: "API_TOKEN", Kind: audit.Removed, Old: deploy.Redacted},
+		{Parameter: "DATABASE_ID", Kind: audit.Added, New: "1"},
+		{Parameter: "DATABASE_PASSWORD", Kind: audit.Changed, Old: deploy.Redacted, New: deploy.Redacted},
+		{Parameter: "DATABASE_SIZE", Kind: audit.Changed, Old: "20Gi", New: "30Gi"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Diff() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	log := openLog(t, file)
+	r := audit.Recorder{Log: log, Actor: "ivo"}
+	store := instance.NewStore()
+	ctx := context.Background()
+
+	first := db(map[string]string{"DATABASE_SIZE": "20Gi"})
+	err := r.Plan(deploy.Plan{Group: "dev", Instances: []stack.Instance{first}}, store)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = deploy.Apply(ctx, r.Deployer(&deploy.Fake{}, store), store, deploy.Plan{Group: "dev", Instances: []stack.Instance{first}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	second := db(map[string]string{"DATABASE_SIZE": "30Gi"})
+	fake := &deploy.Fake{DeployErr: map[string]error{"db": errors.New("boom")}}
+	err = deploy.Apply(ctx, r.Deployer(fake, store), store, deploy.Plan{Group: "dev", Instances: []stack.Instance{second}})
+	if err == nil {
+		t.Fatal("expected error got none")
+	}
+	err = deploy.Destroy(ctx, r.Deployer(&deploy.Fake{}, store), store, "dev", "db")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	got, err := audit.Read(strings.NewReader(readFile(t, file)), audit.Filter{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	added := []audit.Change{{Parameter: "DATABASE_SIZE", Kind: audit.Added, New: "20Gi"}}
+	want := []audit.Entry{
+		{Seq: 1, Time: start, Actor: "ivo", Action: audit.Plan, Group: "dev", Instance: "db", Stack: "dhis2-db@16.0.0", Changes: added, Outcome: audit.Success},
+		{Seq: 2, Time: start.Add(time.Hour), Actor: "ivo", Action: audit.Deploy, Group: "dev", Instance: "db", Stack: "dhis2-db@16.0.0", Changes: added, Outcome: audit.Success},
+		{Seq: 3, Time: start.Add(2 * time.Hour), Actor: "ivo", Action: audit.Update, Group: "dev", Instance: "db", Stack: "dhis2-db@16.0.0", Changes: []audit.Change{{Parameter: "DATABASE_SIZE", Kind: audit.Changed, Old: "20Gi", New: "30Gi"}}, Outcome: audit.Failure, Error: "boom"},
+		{Seq: 4, Time: start.Add(3 * time.Hour), Actor: "ivo", Action: audit.Destroy, Group: "dev", Instance: "db", Stack: "dhis2-db@16.0.0", Outcome: audit.Success},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(audit.Entry{}, "PrevHash", "Hash")); diff != "" {
+		t.Errorf("entries mismatch (-want +got):\n%s", diff)
+	}
+}
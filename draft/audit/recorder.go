@@ -0,0 +1,92 @@
+package audit
+
+import (
+	"context"
+	"errors"
+
+	"github.com/teleivo/providers/deploy"
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/stack"
+)
+
+// Recorder records the actions of an actor in a log.
+type Recorder struct {
+	Log   *Log
+	Actor string
+}
+
+// Plan records a plan entry for every instance of the plan with the changes to the parameters of
+// the instance of the same name in the store.
+func (r Recorder) Plan(plan deploy.Plan, store *instance.Store) error {
+	var errs []error
+	for _, inst := range plan.Instances {
+		var old map[string]stack.Parameter
+		if rec, ok := store.Get(inst.Group, inst.Name); ok {
+			old = rec.Instance.Parameters
+		}
+		errs = append(errs, r.record(Plan, inst, Diff(old, inst.Parameters), nil))
+	}
+	return errors.Join(errs...)
+}
+
+func (r Recorder) record(action Action, inst stack.Instance, changes []Change, err error) error {
+	e := Entry{
+		Actor:    r.Actor,
+		Action:   action,
+		Group:    inst.Group,
+		Instance: inst.Name,
+		Stack:    inst.Stack.ID(),
+		Changes:  changes,
+		Outcome:  Success,
+	}
+	if err != nil {
+		e.Outcome = Failure
+		e.Error = err.Error()
+	}
+	_, logErr := r.Log.Record(e)
+	return logErr
+}
+
+// Deployer returns a deployer recording every deploy and destroy of d. Deploying an instance that
+// is in the store is recorded as an update. The parameters of the instances in the store are taken
+// when creating the deployer and deploys record the changes to them. Deploys and destroys fail if
+// they cannot be recorded.
+func (r Recorder) Deployer(d deploy.Deployer, store *instance.Store) deploy.Deployer {
+	previous := make(map[key]map[string]stack.Parameter)
+	for _, rec := range store.List() {
+		previous[keyOf(rec.Instance)] = rec.Instance.Parameters
+	}
+	return recordingDeployer{recorder: r, deployer: d, previous: previous}
+}
+
+type key struct {
+	group string
+	name  string
+}
+
+func keyOf(inst stack.Instance) key {
+	return key{group: inst.Group, name: inst.Name}
+}
+
+type recordingDeployer struct {
+	recorder Recorder
+	deployer deploy.Deployer
+	previous map[key]map[string]stack.Parameter
+}
+
+func (d recordingDeployer) Deploy(ctx context.Context, inst stack.Instance) error {
+	err := d.deployer.Deploy(ctx, inst)
+	action := Deploy
+	old, ok := d.previous[keyOf(inst)]
+	if ok {
+		action = Update
+	}
+	logErr := d.recorder.record(action, inst, Diff(old, inst.Parameters), err)
+	return errors.Join(err, logErr)
+}
+
+func (d recordingDeployer) Destroy(ctx context.Context, inst stack.Instance) error {
+	err := d.deployer.Destroy(ctx, inst)
+	logErr := d.recorder.record(Destroy, inst, nil, err)
+	return errors.Join(err, logErr)
+}
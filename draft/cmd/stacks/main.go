@@ -0,0 +1,1283 @@
+// Command stacks lists, validates, draws, plans, deploys and destroys stacks.
+//
+// Usage:
+//
+//	stacks <command> [flags] [args]
+//
+// Every command accepts -json to write its output and errors as JSON. The exit code is 0 on
+// success, 1 on failure, 2 on invalid usage and 3 if stacks, chains or parameters are invalid.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/teleivo/providers/audit"
+	"github.com/teleivo/providers/deploy"
+	"github.com/teleivo/providers/diagram"
+	"github.com/teleivo/providers/group"
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/server"
+	"github.com/teleivo/providers/stack"
+)
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	exitInvalid = 3
+)
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	cancel()
+	os.Exit(code)
+}
+
+// usageError signals that the command was used incorrectly.
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e usageError) Unwrap() error {
+	return e.err
+}
+
+// invalidError signals that stacks, chains or parameters given to the command are invalid.
+type invalidError struct {
+	err error
+}
+
+func (e invalidError) Error() string {
+	return e.err.Error()
+}
+
+func (e invalidError) Unwrap() error {
+	return e.err
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, e *env, args []string) error
+}
+
+var commands = []command{
+	{name: "list", usage: "list stacks", run: list},
+	{name: "show", usage: "show the parameters, providers and required stacks of a stack", run: show},
+	{name: "validate", usage: "validate the stack catalog", run: validate},
+	{name: "diff", usage: "compare the stack catalog to a new catalog", run: diff},
+	{name: "graph", usage: "draw a d2 diagram of stacks or instances", run: drawGraph},
+	{name: "plan", usage: "plan the deployment of a chain", run: plan},
+	{name: "deploy", usage: "deploy a chain", run: deployChain},
+	{name: "destroy", usage: "destroy instances", run: destroy},
+	{name: "reap", usage: "destroy expired instances", run: reap},
+	{name: "expiries", usage: "list instances expiring soon", run: expiries},
+	{name: "extend", usage: "extend the TTL of instances", run: extend},
+	{name: "audit", usage: "list or verify the audit log", run: auditLog},
+	{name: "serve", usage: "serve the HTTP API", run: serve},
+}
+
+// env is the environment commands run in.
+type env struct {
+	stdout io.Writer
+	stderr io.Writer
+	json   bool
+	// catalog is the path to a stack catalog. The IM stacks are used if empty.
+	catalog string
+	stacks  stack.Stacks
+	// groupsFile is the path to a JSON group registry. Groups are not restricted if empty.
+	groupsFile string
+	groups     *group.Registry
+	// deployer is used by commands deploying or destroying instances. Commands default to helmfile
+	// if nil.
+	deployer deploy.Deployer
+	// stateValues passes parameters to helmfile as a state values file as well.
+	stateValues bool
+	// envDir is the directory the environment of every helmfile run is written to if not empty.
+	envDir string
+	// allowEnv are host variables passed to helmfile in addition to deploy.DefaultAllowEnv.
+	allowEnv string
+	// readyTimeout is the time to wait for deployed instances to be ready unless their stack
+	// declares a timeout.
+	readyTimeout time.Duration
+	// auditFile is the path to the audit log. Nothing is audited if empty.
+	auditFile string
+	actor     string
+	// bus publishes the lifecycle events of deploys and destroys. A bus running the hooks declared
+	// by stacks is used if nil.
+	bus *deploy.Bus
+	// now returns the current time. Defaults to time.Now if nil.
+	now func() time.Time
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	return runWith(ctx, args, &env{stdout: stdout, stderr: stderr})
+}
+
+func runWith(ctx context.Context, args []string, e *env) int {
+	if len(args) == 0 {
+		printUsage(e.stderr)
+		return exitUsage
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(e.stderr, "unknown command %q\n", args[0])
+		printUsage(e.stderr)
+		return exitUsage
+	}
+
+	err := cmd.run(ctx, e, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	return e.fail(err)
+}
+
+// fail writes the error and returns the exit code matching it.
+func (e *env) fail(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	if e.json {
+		body := struct {
+			Error  string        `json:"error"`
+			Issues []stack.Issue `json:"issues,omitempty"`
+		}{Error: err.Error()}
+		var ierr invalidError
+		if errors.As(err, &ierr) {
+			body.Issues = stack.Issues(err)
+		}
+		_ = json.NewEncoder(e.stderr).Encode(body)
+	} else {
+		fmt.Fprintf(e.stderr, "error: %v\n", err)
+	}
+
+	var uerr usageError
+	if errors.As(err, &uerr) {
+		return exitUsage
+	}
+	var ierr invalidError
+	if errors.As(err, &ierr) {
+		return exitInvalid
+	}
+	return exitFailure
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: stacks <command> [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s%s\n", c.name, c.usage)
+	}
+}
+
+// flags creates a flag set with the flags shared by all commands.
+func (e *env) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.BoolVar(&e.json, "json", false, "write output and errors as JSON")
+	fs.StringVar(&e.catalog, "catalog", "", "path to a JSON stack catalog. Defaults to the IM stacks")
+	fs.StringVar(&e.groupsFile, "groups", "", "path to a JSON group registry restricting the groups instances are deployed in")
+	return fs
+}
+
+// parse parses the flags and loads the stacks.
+func (e *env) parse(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return usageError{err}
+	}
+
+	if e.groupsFile != "" {
+		f, err := os.Open(e.groupsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		groups, err := group.Read(f)
+		if err != nil {
+			return invalidError{fmt.Errorf("invalid groups %q: %w", e.groupsFile, err)}
+		}
+		e.groups = groups
+	}
+	if e.catalog != "" {
+		f, err := os.Open(e.catalog)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stacks, err := stack.Load(f, providers())
+		if err != nil {
+			return invalidError{fmt.Errorf("invalid catalog %q: %w", e.catalog, err)}
+		}
+		e.stacks = stacks
+		return nil
+	}
+	if e.stacks == nil {
+		stacks, err := stack.Default()
+		if err != nil {
+			return invalidError{fmt.Errorf("failed creating IM stacks: %w", err)}
+		}
+		e.stacks = stacks
+	}
+	return nil
+}
+
+func (e *env) writeJSON(v any) error {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (e *env) printf(format string, a ...any) {
+	fmt.Fprintf(e.stdout, format, a...)
+}
+
+func sortedNames(stacks stack.Stacks) []string {
+	names := make([]string, 0, len(stacks))
+	for k := range stacks {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func requiredNames(s stack.Stack) []string {
+	result := make([]string, 0, len(s.Requires))
+	for _, r := range s.Requires {
+		result = append(result, r.ID())
+	}
+	return result
+}
+
+type stackSummary struct {
+	Name     string   `json:"name"`
+	Requires []string `json:"requires"`
+}
+
+func list(_ context.Context, e *env, args []string) error {
+	fs := e.flags("list")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	result := make([]stackSummary, 0, len(e.stacks))
+	for _, name := range sortedNames(e.stacks) {
+		result = append(result, stackSummary{Name: name, Requires: requiredNames(e.stacks[name])})
+	}
+
+	if e.json {
+		return e.writeJSON(result)
+	}
+	for _, s := range result {
+		if len(s.Requires) == 0 {
+			e.printf("%s\n", s.Name)
+			continue
+		}
+		e.printf("%s\trequires: %s\n", s.Name, strings.Join(s.Requires, ", "))
+	}
+	return nil
+}
+
+type parameterDetail struct {
+	Name     string `json:"name"`
+	Default  string `json:"default,omitempty"`
+	Consumed bool   `json:"consumed"`
+	// Origin is the name of the stack originally providing a consumed parameter.
+	Origin string `json:"origin,omitempty"`
+	// OriginParameter is the name of a consumed parameter on its origin if it differs.
+	OriginParameter string     `json:"originParameter,omitempty"`
+	Required        bool       `json:"required"`
+	Type            stack.Type `json:"type,omitempty"`
+}
+
+type stackDetail struct {
+	Name        string            `json:"name"`
+	Version     string            `json:"version,omitempty"`
+	File        string            `json:"file,omitempty"`
+	Parameters  []parameterDetail `json:"parameters"`
+	Providers   []string          `json:"providers"`
+	Requires    []string          `json:"requires"`
+	Constraints map[string]string `json:"constraints,omitempty"`
+}
+
+func show(_ context.Context, e *env, args []string) error {
+	fs := e.flags("show")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError{errors.New("show requires exactly one stack name")}
+	}
+
+	s, err := e.stacks.Get(fs.Arg(0))
+	if err != nil {
+		return invalidError{err}
+	}
+
+	detail := stackDetail{
+		Name:        s.Name,
+		Version:     s.Version,
+		File:        s.File,
+		Parameters:  make([]parameterDetail, 0, len(s.Parameters)),
+		Providers:   make([]string, 0, len(s.Providers)),
+		Requires:    requiredNames(s),
+		Constraints: s.Constraints,
+	}
+	for k, p := range s.Parameters {
+		pd := parameterDetail{
+			Name:     k,
+			Default:  p.Value,
+			Consumed: p.Consumed,
+			Required: !p.Consumed && p.Value == "",
+			Type:     p.Type,
+		}
+		if p.Consumed {
+			if origin, name, err := s.Origin(k); err == nil {
+				pd.Origin = origin.Name
+				if name != k {
+					pd.OriginParameter = name
+				}
+			}
+		}
+		detail.Parameters = append(detail.Parameters, pd)
+	}
+	sort.Slice(detail.Parameters, func(i, j int) bool {
+		return detail.Parameters[i].Name < detail.Parameters[j].Name
+	})
+	for k := range s.Providers {
+		detail.Providers = append(detail.Providers, k)
+	}
+	sort.Strings(detail.Providers)
+
+	if e.json {
+		return e.writeJSON(detail)
+	}
+	e.printf("stack: %s\n", detail.Name)
+	if detail.Version != "" {
+		e.printf("version: %s\n", detail.Version)
+	}
+	if detail.File != "" {
+		e.printf("file: %s\n", detail.File)
+	}
+	e.printf("parameters:\n")
+	for _, p := range detail.Parameters {
+		switch {
+		case p.Consumed && p.OriginParameter != "":
+			e.printf("  %s (consumed from %s %s)\n", p.Name, p.Origin, p.OriginParameter)
+		case p.Consumed:
+			e.printf("  %s (consumed from %s)\n", p.Name, p.Origin)
+		case p.Required:
+			e.printf("  %s (required)\n", p.Name)
+		default:
+			e.printf("  %s=%s\n", p.Name, p.Default)
+		}
+	}
+	e.printf("providers: %s\n", strings.Join(detail.Providers, ", "))
+	e.printf("requires: %s\n", strings.Join(detail.Requires, ", "))
+	if len(detail.Constraints) > 0 {
+		constraints := make([]string, 0, len(detail.Constraints))
+		for k, v := range detail.Constraints {
+			constraints = append(constraints, fmt.Sprintf("%s %s", k, v))
+		}
+		sort.Strings(constraints)
+		e.printf("constraints: %s\n", strings.Join(constraints, ", "))
+	}
+	return nil
+}
+
+func validate(_ context.Context, e *env, args []string) error {
+	fs := e.flags("validate")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	stacks := make([]stack.Stack, 0, len(e.stacks))
+	for _, name := range sortedNames(e.stacks) {
+		stacks = append(stacks, e.stacks[name])
+	}
+	_, err := stack.New(stacks...)
+	if err != nil {
+		return invalidError{err}
+	}
+
+	if e.json {
+		return e.writeJSON(struct {
+			Valid  bool `json:"valid"`
+			Stacks int  `json:"stacks"`
+		}{Valid: true, Stacks: len(stacks)})
+	}
+	e.printf("catalog of %d stacks is valid\n", len(stacks))
+	return nil
+}
+
+func diff(_ context.Context, e *env, args []string) error {
+	fs := e.flags("diff")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError{errors.New("diff requires exactly one catalog to compare to")}
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stacks, err := stack.Load(f, providers())
+	if err != nil {
+		return invalidError{fmt.Errorf("invalid catalog %q: %w", fs.Arg(0), err)}
+	}
+
+	changes := stack.Diff(e.stacks, stacks)
+	if e.json {
+		if changes == nil {
+			changes = []stack.Change{}
+		}
+		err = e.writeJSON(struct {
+			Breaking bool           `json:"breaking"`
+			Changes  []stack.Change `json:"changes"`
+		}{Breaking: stack.Breaking(changes), Changes: changes})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, c := range changes {
+			e.printf("%s\n", c)
+		}
+	}
+
+	if stack.Breaking(changes) {
+		var n int
+		for _, c := range changes {
+			if c.Breaking {
+				n++
+			}
+		}
+		return invalidError{fmt.Errorf("catalog %q has %d breaking change(s)", fs.Arg(0), n)}
+	}
+	return nil
+}
+
+func drawGraph(_ context.Context, e *env, args []string) error {
+	fs := e.flags("graph")
+	instancesFile := fs.String("instances", "", "draw the instances stored in this file instead of the stacks")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	if *instancesFile == "" {
+		return diagram.Stacks(e.stdout, e.stacks)
+	}
+	store, err := e.readStore(*instancesFile)
+	if err != nil {
+		return err
+	}
+	return diagram.Instances(e.stdout, store.List())
+}
+
+// chainFlags are the flags of commands operating on a chain.
+type chainFlags struct {
+	group     string
+	name      string
+	stacks    string
+	chainFile string
+	params    paramsFlag
+}
+
+func (c *chainFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.group, "group", "", "group to deploy the instances in")
+	fs.StringVar(&c.name, "name", "", "name of the chain. Instances are named <name>-<stack>")
+	fs.StringVar(&c.stacks, "stacks", "", "comma separated names of the stacks to deploy")
+	fs.StringVar(&c.chainFile, "chain-file", "", "path to a JSON chain spec")
+	c.params = make(paramsFlag)
+	fs.Var(c.params, "param", "parameter as <stack>.<name>=<value>. Can be repeated")
+}
+
+// plan plans the chain. Resolving publishes the resolve events on the bus which can be nil.
+func (c *chainFlags) plan(ctx context.Context, e *env, bus *deploy.Bus) (deploy.Plan, error) {
+	if c.group == "" || c.name == "" {
+		return deploy.Plan{}, usageError{errors.New("flags -group and -name are required")}
+	}
+
+	var names []string
+	if c.stacks != "" {
+		names = append(names, strings.Split(c.stacks, ",")...)
+	}
+	if c.chainFile != "" {
+		f, err := os.Open(c.chainFile)
+		if err != nil {
+			return deploy.Plan{}, err
+		}
+		defer f.Close()
+		spec, err := stack.ReadChainSpec(f)
+		if err != nil {
+			return deploy.Plan{}, invalidError{err}
+		}
+		names = append(names, spec.Stacks...)
+	}
+	if len(names) == 0 {
+		return deploy.Plan{}, usageError{errors.New("flag -stacks or -chain-file is required")}
+	}
+
+	chain, err := e.stacks.Chain(names...)
+	if err != nil {
+		return deploy.Plan{}, invalidError{err}
+	}
+	// instances of a chain only link to instances of their group so checking the group before
+	// planning keeps hooks and providers from running for groups that are not allowed
+	if e.groups != nil {
+		if _, ok := e.groups.Get(c.group); !ok {
+			return deploy.Plan{}, invalidError{fmt.Errorf("group %q: %w", c.group, group.ErrUnknownGroup)}
+		}
+	}
+	p, err := deploy.NewPlan(ctx, bus, chain, c.group, c.name, c.params)
+	if errors.Is(err, deploy.ErrHookFailed) {
+		return deploy.Plan{}, err
+	}
+	if err != nil {
+		return deploy.Plan{}, invalidError{err}
+	}
+	return p, nil
+}
+
+// paramsFlag collects parameters keyed by stack name.
+type paramsFlag map[string]map[string]string
+
+func (p paramsFlag) String() string {
+	return ""
+}
+
+func (p paramsFlag) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("parameter %q must be of the form <stack>.<name>=<value>", v)
+	}
+	stackName, name, ok := strings.Cut(key, ".")
+	if !ok || stackName == "" || name == "" {
+		return fmt.Errorf("parameter %q must be of the form <stack>.<name>=<value>", v)
+	}
+	if _, ok := p[stackName]; !ok {
+		p[stackName] = make(map[string]string)
+	}
+	if _, ok := p[stackName][name]; ok {
+		return fmt.Errorf("parameter %q is given more than once", key)
+	}
+	p[stackName][name] = value
+	return nil
+}
+
+type planJSON struct {
+	Group     string         `json:"group"`
+	Instances []instanceJSON `json:"instances"`
+}
+
+type instanceJSON struct {
+	Name       string                     `json:"name"`
+	Group      string                     `json:"group"`
+	Stack      string                     `json:"stack"`
+	Parameters map[string]stack.Parameter `json:"parameters"`
+	Requires   []string                   `json:"requires,omitempty"`
+}
+
+func toInstanceJSON(inst stack.Instance) instanceJSON {
+	result := instanceJSON{
+		Name:       inst.Name,
+		Group:      inst.Group,
+		Stack:      inst.Stack.ID(),
+		Parameters: make(map[string]stack.Parameter, len(inst.Parameters)),
+	}
+	for k, p := range inst.Parameters {
+		p.Value = redact(k, p)
+		result.Parameters[k] = p
+	}
+	for _, r := range inst.Requires {
+		result.Requires = append(result.Requires, r.Name)
+	}
+	return result
+}
+
+// redact returns the value of the parameter or deploy.Redacted if it is sensitive.
+func redact(name string, p stack.Parameter) string {
+	if deploy.Sensitive(name, p) {
+		return deploy.Redacted
+	}
+	return p.Value
+}
+
+func (e *env) writePlan(p deploy.Plan) error {
+	if e.json {
+		result := planJSON{Group: p.Group, Instances: make([]instanceJSON, 0, len(p.Instances))}
+		for _, inst := range p.Instances {
+			result.Instances = append(result.Instances, toInstanceJSON(inst))
+		}
+		return e.writeJSON(result)
+	}
+
+	for i, inst := range p.Instances {
+		e.printf("%d. %s (%s) in group %s\n", i+1, inst.Name, inst.Stack.ID(), inst.Group)
+		for _, r := range inst.Requires {
+			e.printf("   requires %s\n", r.Name)
+		}
+		names := make([]string, 0, len(inst.Parameters))
+		for k := range inst.Parameters {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			p := inst.Parameters[k]
+			if p.Consumed {
+				e.printf("   %s=%s (consumed)\n", k, redact(k, p))
+				continue
+			}
+			e.printf("   %s=%s\n", k, redact(k, p))
+		}
+	}
+	return nil
+}
+
+func plan(ctx context.Context, e *env, args []string) error {
+	fs := e.flags("plan")
+	e.auditFlags(fs)
+	var cf chainFlags
+	cf.register(fs)
+	valuesDir := fs.String("values-dir", "", "write the state values of every instance to <name>.yaml in this directory")
+	instancesFile := fs.String("instances", "instances.json", "file the deployed instances are stored in. Parameter changes to them are recorded in the audit log")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	p, err := cf.plan(ctx, e, nil)
+	if err != nil {
+		return err
+	}
+	if e.auditFile != "" {
+		if err := e.auditPlan(p, *instancesFile); err != nil {
+			return err
+		}
+	}
+	if *valuesDir != "" {
+		if err := writeValuesFiles(*valuesDir, p); err != nil {
+			return err
+		}
+	}
+	return e.writePlan(p)
+}
+
+// auditPlan records the plan in the audit log with the parameter changes to the instances stored
+// in given file.
+func (e *env) auditPlan(p deploy.Plan, instancesFile string) error {
+	store, err := e.readStore(instancesFile)
+	if err != nil {
+		return err
+	}
+	log, err := e.openAudit()
+	if err != nil {
+		return err
+	}
+	err = audit.Recorder{Log: log, Actor: e.actor}.Plan(p, store)
+	return errors.Join(err, log.Close())
+}
+
+// writeValuesFiles writes the state values of every planned instance to <dir>/<name>.yaml.
+func writeValuesFiles(dir string, p deploy.Plan) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, inst := range p.Instances {
+		var b strings.Builder
+		if err := deploy.WriteValues(&b, inst); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, inst.Name+".yaml"), []byte(b.String()), 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deployChain(ctx context.Context, e *env, args []string) error {
+	fs := e.flags("deploy")
+	e.auditFlags(fs)
+	e.deployerFlags(fs)
+	var cf chainFlags
+	cf.register(fs)
+	instancesFile := fs.String("instances", "instances.json", "file the deployed instances are stored in")
+	dryRun := fs.Bool("dry-run", false, "plan and record the instances without deploying them")
+	checkpointFile := fs.String("checkpoint", "", "record the progress in this file and resume from it if it exists. Deployed instances whose outputs are unchanged are skipped")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	bus := e.events(*dryRun)
+	p, err := cf.plan(ctx, e, bus)
+	if err != nil {
+		return err
+	}
+	store, err := e.readStore(*instancesFile)
+	if err != nil {
+		return err
+	}
+	if e.groups != nil {
+		if err := e.groups.Admit(store, p.Instances...); err != nil {
+			return invalidError{err}
+		}
+	}
+
+	d, closeAudit, err := e.auditedDeployer(bus.Deployer(e.deployerFor(*dryRun)), store)
+	if err != nil {
+		return err
+	}
+	var skipped int
+	if *checkpointFile == "" {
+		err = deploy.Apply(ctx, d, store, p)
+	} else {
+		skipped, err = resume(ctx, d, store, p, *checkpointFile)
+	}
+	// record the state of the instances even if applying failed
+	writeErr := writeStore(*instancesFile, store)
+	if err := errors.Join(err, writeErr, closeAudit()); err != nil {
+		return err
+	}
+	if !e.json {
+		for _, inst := range p.Instances[:skipped] {
+			e.printf("skipped %s as it is deployed\n", inst.Name)
+		}
+	}
+	return e.writePlan(p)
+}
+
+// resume applies the plan continuing from the checkpoint in given file. The checkpoint is written
+// to the file after every step.
+func resume(ctx context.Context, d deploy.Deployer, store *instance.Store, p deploy.Plan, file string) (int, error) {
+	var cp deploy.Checkpoint
+	f, err := os.Open(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	if err == nil {
+		cp, err = deploy.ReadCheckpoint(f)
+		f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed reading checkpoint from %q: %v", file, err)
+		}
+	}
+
+	skipped, err := deploy.Resume(ctx, d, store, p, &cp, func(cp deploy.Checkpoint) error {
+		return writeCheckpoint(file, cp)
+	})
+	if errors.Is(err, deploy.ErrCheckpointMismatch) {
+		return 0, invalidError{fmt.Errorf("cannot resume from %q: %w", file, err)}
+	}
+	return skipped, err
+}
+
+func writeCheckpoint(file string, cp deploy.Checkpoint) error {
+	err := writeFile(file, cp.Write)
+	if err != nil {
+		return fmt.Errorf("failed writing checkpoint to %q: %v", file, err)
+	}
+	return nil
+}
+
+// writeFile writes to a temporary file only the user can read and renames it to file so a crash
+// never leaves a partially written file behind. The files hold parameters like passwords.
+func writeFile(file string, write func(io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+func destroy(ctx context.Context, e *env, args []string) error {
+	fs := e.flags("destroy")
+	e.auditFlags(fs)
+	e.deployerFlags(fs)
+	group := fs.String("group", "", "group of the instances")
+	instancesFile := fs.String("instances", "instances.json", "file the deployed instances are stored in")
+	dryRun := fs.Bool("dry-run", false, "remove the instances from the store without destroying them")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *group == "" || fs.NArg() == 0 {
+		return usageError{errors.New("flag -group and at least one instance name are required")}
+	}
+
+	store, err := e.readStore(*instancesFile)
+	if err != nil {
+		return err
+	}
+	d, closeAudit, err := e.auditedDeployer(e.events(*dryRun).Deployer(e.deployerFor(*dryRun)), store)
+	if err != nil {
+		return err
+	}
+	var destroyed []string
+	for _, name := range fs.Args() {
+		err = deploy.Destroy(ctx, d, store, *group, name)
+		if err != nil {
+			break
+		}
+		destroyed = append(destroyed, name)
+	}
+	writeErr := writeStore(*instancesFile, store)
+	if err := errors.Join(err, writeErr, closeAudit()); err != nil {
+		return err
+	}
+
+	if e.json {
+		return e.writeJSON(struct {
+			Destroyed []string `json:"destroyed"`
+		}{Destroyed: destroyed})
+	}
+	for _, name := range destroyed {
+		e.printf("destroyed %s\n", name)
+	}
+	return nil
+}
+
+func reap(ctx context.Context, e *env, args []string) error {
+	fs := e.flags("reap")
+	e.auditFlags(fs)
+	e.deployerFlags(fs)
+	instancesFile := fs.String("instances", "instances.json", "file the deployed instances are stored in")
+	dryRun := fs.Bool("dry-run", false, "remove the instances from the store without destroying them")
+	chain := fs.Bool("chain", false, "destroy all instances linked to an expired instance instead of only the ones requiring it")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	store, err := e.readStore(*instancesFile)
+	if err != nil {
+		return err
+	}
+	d, closeAudit, err := e.auditedDeployer(e.events(*dryRun).Deployer(e.deployerFor(*dryRun)), store)
+	if err != nil {
+		return err
+	}
+	r := deploy.Reaper{Deployer: d, Store: store, Now: e.now}
+	if *chain {
+		r.Strategy = deploy.WholeChain
+	}
+	reaped, err := r.Reap(ctx)
+	writeErr := writeStore(*instancesFile, store)
+	if err := errors.Join(err, writeErr, closeAudit()); err != nil {
+		return err
+	}
+
+	destroyed := make([]instanceJSON, 0, len(reaped))
+	for _, rec := range reaped {
+		destroyed = append(destroyed, toInstanceJSON(rec.Instance))
+	}
+	if e.json {
+		return e.writeJSON(struct {
+			Destroyed []instanceJSON `json:"destroyed"`
+		}{Destroyed: destroyed})
+	}
+	for _, inst := range destroyed {
+		e.printf("destroyed %s in group %s\n", inst.Name, inst.Group)
+	}
+	return nil
+}
+
+func expiries(_ context.Context, e *env, args []string) error {
+	fs := e.flags("expiries")
+	instancesFile := fs.String("instances", "instances.json", "file the deployed instances are stored in")
+	within := fs.Duration("within", 24*time.Hour, "list instances expiring within this duration")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	store, err := e.readStore(*instancesFile)
+	if err != nil {
+		return err
+	}
+	r := deploy.Reaper{Store: store, Now: e.now}
+	upcoming := r.Upcoming(*within)
+
+	if e.json {
+		if upcoming == nil {
+			upcoming = []deploy.Expiry{}
+		}
+		return e.writeJSON(upcoming)
+	}
+	for _, x := range upcoming {
+		if x.Remaining <= 0 {
+			e.printf("%s (%s) in group %s expired %s ago\n", x.Name, x.Stack, x.Group, -x.Remaining)
+			continue
+		}
+		e.printf("%s (%s) in group %s expires in %s\n", x.Name, x.Stack, x.Group, x.Remaining)
+	}
+	return nil
+}
+
+func extend(_ context.Context, e *env, args []string) error {
+	fs := e.flags("extend")
+	group := fs.String("group", "", "group of the instances")
+	by := fs.Duration("by", 24*time.Hour, "duration to extend the TTL by")
+	instancesFile := fs.String("instances", "instances.json", "file the deployed instances are stored in")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *group == "" || fs.NArg() == 0 {
+		return usageError{errors.New("flag -group and at least one instance name are required")}
+	}
+
+	store, err := e.readStore(*instancesFile)
+	if err != nil {
+		return err
+	}
+	var extended []deploy.Expiry
+	for _, name := range fs.Args() {
+		rec, err := store.Extend(*group, name, *by)
+		if err != nil {
+			return invalidError{err}
+		}
+		expires, _ := rec.Expires()
+		extended = append(extended, deploy.Expiry{
+			Group:   rec.Instance.Group,
+			Name:    rec.Instance.Name,
+			Stack:   rec.Instance.Stack.ID(),
+			Expires: expires,
+		})
+	}
+	if err := writeStore(*instancesFile, store); err != nil {
+		return err
+	}
+
+	if e.json {
+		return e.writeJSON(extended)
+	}
+	for _, x := range extended {
+		e.printf("%s in group %s expires at %s\n", x.Name, x.Group, x.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func serve(ctx context.Context, e *env, args []string) error {
+	fs := e.flags("serve")
+	e.auditFlags(fs)
+	e.deployerFlags(fs)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	dryRun := fs.Bool("dry-run", false, "record instances without deploying or destroying them")
+	reloadInterval := fs.Duration("reload-interval", 0, "reload the -catalog at this interval if it changed. It is reloaded on POST /reload in any case")
+	reapInterval := fs.Duration("reap-interval", 0, "destroy expired instances at this interval")
+	chain := fs.Bool("reap-chain", false, "destroy all instances linked to an expired instance instead of only the ones requiring it")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *reloadInterval > 0 && e.catalog == "" {
+		return usageError{errors.New("flag -reload-interval requires flag -catalog")}
+	}
+
+	store := instance.NewStore()
+	store.Now = e.now
+	handler := server.New(e.stacks, store, e.deployerFor(*dryRun))
+	var registry *stack.Registry
+	if e.catalog != "" {
+		var err error
+		registry, err = stack.LoadRegistry(e.catalog, providers())
+		if err != nil {
+			return invalidError{err}
+		}
+		handler.WithRegistry(registry)
+	}
+	if e.groups != nil {
+		handler.WithGroups(e.groups)
+	}
+	if bus := e.events(*dryRun); bus != nil {
+		handler.WithEvents(bus)
+	}
+	log, err := e.openAudit()
+	if err != nil {
+		return err
+	}
+	if log != nil {
+		defer log.Close()
+		handler.WithAudit(log)
+	}
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	fmt.Fprintf(e.stderr, "serving on %s\n", *addr)
+	if *reloadInterval > 0 {
+		go registry.Poll(ctx, *reloadInterval, func(err error) {
+			if err != nil {
+				fmt.Fprintf(e.stderr, "keeping the current stacks: %v\n", err)
+				return
+			}
+			fmt.Fprintf(e.stderr, "reloaded catalog %q\n", e.catalog)
+		})
+	}
+	if *reapInterval > 0 {
+		r := handler.Reaper(e.actor)
+		r.Now = e.now
+		if *chain {
+			r.Strategy = deploy.WholeChain
+		}
+		go r.Run(ctx, *reapInterval, func(destroyed []instance.Record, err error) {
+			for _, rec := range destroyed {
+				fmt.Fprintf(e.stderr, "destroyed expired %s in group %s\n", rec.Instance.Name, rec.Instance.Group)
+			}
+			if err != nil {
+				fmt.Fprintf(e.stderr, "failed to reap instances: %v\n", err)
+			}
+		})
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
+
+func auditLog(_ context.Context, e *env, args []string) error {
+	fs := e.flags("audit")
+	verify := fs.Bool("verify", false, "verify that the entries of the log form an intact hash chain instead of listing them")
+	var f audit.Filter
+	fs.StringVar(&f.Group, "group", "", "list entries of instances in this group")
+	fs.StringVar(&f.Instance, "instance", "", "list entries of instances of this name")
+	since := fs.String("since", "", "list entries recorded at or after this RFC 3339 time")
+	until := fs.String("until", "", "list entries recorded before this RFC 3339 time")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError{errors.New("audit requires exactly one audit log")}
+	}
+	for _, t := range []struct {
+		value string
+		dest  *time.Time
+	}{{*since, &f.Since}, {*until, &f.Until}} {
+		if t.value == "" {
+			continue
+		}
+		v, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return usageError{fmt.Errorf("invalid time %q: must be RFC 3339 like 2024-03-01T12:00:00Z", t.value)}
+		}
+		*t.dest = v
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if *verify {
+		n, err := audit.Verify(file)
+		if err != nil {
+			return invalidError{err}
+		}
+		if e.json {
+			return e.writeJSON(struct {
+				Valid   bool  `json:"valid"`
+				Entries int64 `json:"entries"`
+			}{Valid: true, Entries: n})
+		}
+		e.printf("audit log of %d entries is intact\n", n)
+		return nil
+	}
+
+	entries, err := audit.Read(file, f)
+	if err != nil {
+		return err
+	}
+	if e.json {
+		if entries == nil {
+			entries = []audit.Entry{}
+		}
+		return e.writeJSON(entries)
+	}
+	for _, x := range entries {
+		e.printf("%s %s %s %s in group %s (%s) %s", x.Time.Format(time.RFC3339), x.Actor, x.Action, x.Instance, x.Group, x.Stack, x.Outcome)
+		if x.Error != "" {
+			e.printf(": %s", x.Error)
+		}
+		e.printf("\n")
+		for _, c := range x.Changes {
+			switch c.Kind {
+			case audit.Added:
+				e.printf("   + %s=%s\n", c.Parameter, c.New)
+			case audit.Removed:
+				e.printf("   - %s=%s\n", c.Parameter, c.Old)
+			default:
+				e.printf("   ~ %s=%s -> %s\n", c.Parameter, c.Old, c.New)
+			}
+		}
+	}
+	return nil
+}
+
+// deployerFor returns the deployer retrying according to the retry policies of stacks and waiting
+// for deployed instances to be ready. Nothing is deployed on a dry run.
+func (e *env) deployerFor(dryRun bool) deploy.Deployer {
+	if dryRun {
+		return &deploy.Fake{}
+	}
+	d := e.deployer
+	if d == nil {
+		d = deploy.Helmfile{StateValues: e.stateValues, EnvDir: e.envDir, AllowEnv: e.allowedEnv(), Stdout: e.stderr, Stderr: e.stderr}
+	}
+	gate := deploy.Gate{
+		Command: deploy.Command{AllowEnv: e.allowedEnv(), Stdout: e.stderr, Stderr: e.stderr},
+		Timeout: e.readyTimeout,
+	}
+	return gate.Deployer(deploy.Retry{}.Deployer(d))
+}
+
+// events returns the bus publishing lifecycle events. Returns nil on a dry run so no hooks run.
+func (e *env) events(dryRun bool) *deploy.Bus {
+	if dryRun {
+		return nil
+	}
+	if e.bus == nil {
+		e.bus = &deploy.Bus{Command: deploy.Command{AllowEnv: e.allowedEnv(), Stdout: e.stderr, Stderr: e.stderr}}
+	}
+	return e.bus
+}
+
+// allowedEnv returns the host variables passed to helmfile and hooks. Returns nil to use
+// deploy.DefaultAllowEnv.
+func (e *env) allowedEnv() []string {
+	if e.allowEnv == "" {
+		return nil
+	}
+	return append(append([]string{}, deploy.DefaultAllowEnv...), strings.Split(e.allowEnv, ",")...)
+}
+
+// auditFlags registers the flags configuring the audit log.
+func (e *env) auditFlags(fs *flag.FlagSet) {
+	actor := os.Getenv("USER")
+	if actor == "" {
+		actor = "unknown"
+	}
+	fs.StringVar(&e.auditFile, "audit", "", "path to the JSON Lines audit log to record plans, deploys and destroys in")
+	fs.StringVar(&e.actor, "actor", actor, "actor recorded in the audit log")
+}
+
+// openAudit opens the audit log. Returns a nil log if nothing is audited.
+func (e *env) openAudit() (*audit.Log, error) {
+	if e.auditFile == "" {
+		return nil, nil
+	}
+	log, err := audit.Open(e.auditFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Now = e.now
+	return log, nil
+}
+
+// auditedDeployer returns a deployer recording in the audit log if one is configured. Call close
+// when done.
+func (e *env) auditedDeployer(d deploy.Deployer, store *instance.Store) (deploy.Deployer, func() error, error) {
+	log, err := e.openAudit()
+	if err != nil || log == nil {
+		return d, func() error { return nil }, err
+	}
+	return audit.Recorder{Log: log, Actor: e.actor}.Deployer(d, store), log.Close, nil
+}
+
+// deployerFlags registers the flags configuring the helmfile deployer.
+func (e *env) deployerFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&e.stateValues, "state-values", false, "pass parameters to helmfile as a state values file as well")
+	fs.StringVar(&e.envDir, "env-dir", "", "write the environment of every helmfile run to <instance>.env in this directory with sensitive values redacted")
+	fs.DurationVar(&e.readyTimeout, "ready-timeout", deploy.DefaultReadyTimeout, "time to wait for deployed instances to pass the readiness check of their stack unless the stack declares a timeout")
+	fs.StringVar(&e.allowEnv, "allow-env", "", "comma separated host environment variables passed to helmfile and hooks in addition to "+strings.Join(deploy.DefaultAllowEnv, ", "))
+}
+
+// secretKeyEnv is the host variable holding the key secret providers derive secrets from.
+const secretKeyEnv = "STACKS_SECRET_KEY"
+
+// providers returns the provider registry of catalogs. Secret providers derive their secrets from
+// the key in secretKeyEnv.
+func providers() *stack.ProviderRegistry {
+	r := stack.NewProviderRegistry()
+	if key := os.Getenv(secretKeyEnv); key != "" {
+		_ = r.SetSecretKey([]byte(key))
+	}
+	return r
+}
+
+// readStore reads the instance store from file. A store that does not exist yet is empty. Records
+// are created at the time of the env.
+func (e *env) readStore(file string) (*instance.Store, error) {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		store := instance.NewStore()
+		store.Now = e.now
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	store, err := instance.Read(f, e.stacks)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading instances from %q: %v", file, err)
+	}
+	store.Now = e.now
+	return store, nil
+}
+
+func writeStore(file string, store *instance.Store) error {
+	err := writeFile(file, store.Write)
+	if err != nil {
+		return fmt.Errorf("failed writing instances to %q: %v", file, err)
+	}
+	return nil
+}
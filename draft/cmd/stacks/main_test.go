@@ -0,0 +1,610 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/teleivo/providers/deploy"
+	"github.com/teleivo/providers/stack"
+)
+
+func TestRun(t *testing.T) {
+	t.Run("List", func(t *testing.T) {
+		code, stdout, stderr := runTest(t, &deploy.Fake{}, "list", "-json")
+
+		if code != exitOK {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+		}
+		var got []stackSummary
+		if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+			t.Fatalf("failed to decode output %q: %v", stdout, err)
+		}
+		want := []stackSummary{
+			{Name: "dhis2", Requires: []string{}},
+			{Name: "dhis2-core", Requires: []string{"dhis2-db"}},
+			{Name: "dhis2-db", Requires: []string{}},
+			{Name: "pgadmin", Requires: []string{"dhis2-db"}},
+			{Name: "whoami-go", Requires: []string{}},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("list mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ShowFailsGivenUnknownStack", func(t *testing.T) {
+		code, _, stderr := runTest(t, &deploy.Fake{}, "show", "-json", "pgadmn")
+
+		if code != exitInvalid {
+			t.Fatalf("want exit code %d, instead got %d", exitInvalid, code)
+		}
+		var got struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(stderr), &got); err != nil {
+			t.Fatalf("failed to decode error %q: %v", stderr, err)
+		}
+		if want := `did you mean "pgadmin"`; !strings.Contains(got.Error, want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, got.Error)
+		}
+	})
+
+	t.Run("FailGivenUnknownCommand", func(t *testing.T) {
+		code, _, _ := runTest(t, &deploy.Fake{}, "nope")
+
+		if code != exitUsage {
+			t.Fatalf("want exit code %d, instead got %d", exitUsage, code)
+		}
+	})
+
+	t.Run("PlanFailsGivenMissingParameter", func(t *testing.T) {
+		code, _, stderr := runTest(t, &deploy.Fake{}, "plan", "-group", "whoami", "-name", "my", "-stacks", "pgadmin")
+
+		if code != exitInvalid {
+			t.Fatalf("want exit code %d, instead got %d", exitInvalid, code)
+		}
+		if want := `stack "dhis2-db" parameter "DATABASE_ID" is required`; !strings.Contains(stderr, want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, stderr)
+		}
+	})
+
+	t.Run("PlanWritesStateValues", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "values")
+
+		code, _, stderr := runTest(t, &deploy.Fake{}, "plan", "-values-dir", dir, "-group", "whoami", "-name", "my", "-stacks", "dhis2-db",
+			"-param", "dhis2-db.DATABASE_ID=1",
+			"-param", "dhis2-db.DATABASE_USERNAME=foo",
+			"-param", "dhis2-db.DATABASE_PASSWORD=faa",
+			"-param", "dhis2-db.DATABASE_NAME=mono",
+		)
+		if code != exitOK {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, "my-dhis2-db.yaml"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		for _, want := range []string{"DATABASE_ID: 1\n", "DATABASE_NAME: \"mono\"\n", "INSTANCE_NAMESPACE: \"whoami\"\n"} {
+			if !strings.Contains(string(b), want) {
+				t.Errorf("want state values to contain '%s', instead got '%s'", want, b)
+			}
+		}
+	})
+
+	t.Run("DeployAndDestroy", func(t *testing.T) {
+		instances := filepath.Join(t.TempDir(), "instances.json")
+		deployer := &deploy.Fake{}
+
+		code, stdout, stderr := runTest(t, deployer, "deploy", "-json", "-instances", instances,
+			"-group", "whoami", "-name", "my", "-stacks", "pgadmin",
+			"-param", "dhis2-db.DATABASE_ID=1",
+			"-param", "dhis2-db.DATABASE_USERNAME=foo",
+			"-param", "dhis2-db.DATABASE_PASSWORD=faa",
+			"-param", "dhis2-db.DATABASE_NAME=mono",
+			"-param", "pgadmin.PGADMIN_USERNAME=admin",
+			"-param", "pgadmin.PGADMIN_PASSWORD=secret",
+		)
+
+		if code != exitOK {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+		}
+		var got planJSON
+		if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+			t.Fatalf("failed to decode output %q: %v", stdout, err)
+		}
+		if len(got.Instances) != 2 {
+			t.Fatalf("want 2 instances, instead got %v", got.Instances)
+		}
+		if want, got := "my-dhis2-db-database-postgresql.whoami.svc", got.Instances[1].Parameters["DATABASE_HOSTNAME"].Value; want != got {
+			t.Errorf("want consumed hostname %q, instead got %q", want, got)
+		}
+		if len(deployer.Deployed) != 2 {
+			t.Fatalf("want 2 deployed instances, instead got %v", deployer.Deployed)
+		}
+
+		code, _, stderr = runTest(t, deployer, "destroy", "-instances", instances, "-group", "whoami", "my-dhis2-db")
+		if code != exitFailure {
+			t.Fatalf("want exit code %d, instead got %d", exitFailure, code)
+		}
+		if want := `instance "my-dhis2-db" is required by instances [my-pgadmin]`; !strings.Contains(stderr, want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, stderr)
+		}
+
+		code, _, stderr = runTest(t, deployer, "destroy", "-instances", instances, "-group", "whoami", "my-pgadmin", "my-dhis2-db")
+		if code != exitOK {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+		}
+		if len(deployer.Destroyed) != 2 {
+			t.Fatalf("want 2 destroyed instances, instead got %v", deployer.Destroyed)
+		}
+	})
+
+	t.Run("DeployFails", func(t *testing.T) {
+		instances := filepath.Join(t.TempDir(), "instances.json")
+		deployer := &deploy.Fake{DeployErr: map[string]error{"my-whoami-go": errors.New("boom")}}
+
+		code, _, stderr := runTest(t, deployer, "deploy", "-instances", instances, "-group", "whoami", "-name", "my", "-stacks", "whoami-go")
+
+		if code != exitFailure {
+			t.Fatalf("want exit code %d, instead got %d", exitFailure, code)
+		}
+		if want := `failed to deploy instance "my-whoami-go": boom`; !strings.Contains(stderr, want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, stderr)
+		}
+
+		code, stdout, stderr := runTest(t, deployer, "graph", "-instances", instances)
+		if code != exitOK {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+		}
+		if want := `"my-whoami-go": "my-whoami-go (whoami-go)\nfailed"`; !strings.Contains(stdout, want) {
+			t.Errorf("want graph to contain '%s', instead got '%s'", want, stdout)
+		}
+	})
+	t.Run("DeployRestrictedToGroups", func(t *testing.T) {
+		dir := t.TempDir()
+		instances := filepath.Join(dir, "instances.json")
+		groups := filepath.Join(dir, "groups.json")
+		err := os.WriteFile(groups, []byte(`{"groups": [{"name": "whoami", "maxInstances": 1}]}`), 0o600)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		code, _, stderr := runTest(t, &deploy.Fake{}, "plan", "-groups", groups, "-group", "prod", "-name", "my", "-stacks", "whoami-go")
+		if code != exitInvalid {
+			t.Fatalf("want exit code %d, instead got %d", exitInvalid, code)
+		}
+		if want := `group "prod": unknown group`; !strings.Contains(stderr, want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, stderr)
+		}
+
+		code, _, stderr = runTest(t, &deploy.Fake{}, "deploy", "-groups", groups, "-instances", instances, "-group", "whoami", "-name", "my", "-stacks", "whoami-go")
+		if code != exitOK {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+		}
+
+		code, _, stderr = runTest(t, &deploy.Fake{}, "deploy", "-groups", groups, "-instances", instances, "-group", "whoami", "-name", "other", "-stacks", "whoami-go")
+		if code != exitInvalid {
+			t.Fatalf("want exit code %d, instead got %d", exitInvalid, code)
+		}
+		if want := `group "whoami" would have 2 instances exceeding its limit of 1`; !strings.Contains(stderr, want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, stderr)
+		}
+	})
+}
+
+func runTest(t *testing.T, d deploy.Deployer, args ...string) (int, string, string) {
+	t.Helper()
+
+	var stdout, stderr strings.Builder
+	code := runWith(context.Background(), args, &env{stdout: &stdout, stderr: &stderr, deployer: d})
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunWithCatalog(t *testing.T) {
+	code, stdout, stderr := runTest(t, &deploy.Fake{}, "validate", "-catalog", "../../stacks.json")
+	if code != exitOK {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+	}
+	if want := "catalog of 4 stacks is valid"; !strings.Contains(stdout, want) {
+		t.Errorf("want output to contain '%s', instead got '%s'", want, stdout)
+	}
+
+	catalog := filepath.Join(t.TempDir(), "stacks.json")
+	err := os.WriteFile(catalog, []byte(`{"stacks": [{"name": "a", "parameters": {"P": {"consumed": true}}}]}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	code, _, stderr = runTest(t, &deploy.Fake{}, "validate", "-catalog", catalog)
+	if code != exitInvalid {
+		t.Fatalf("want exit code %d, instead got %d", exitInvalid, code)
+	}
+	if want := `stack "a" consumes parameter "P" but does not require any stack`; !strings.Contains(stderr, want) {
+		t.Errorf("want error to contain '%s', instead got '%s'", want, stderr)
+	}
+
+	code, _, stderr = runTest(t, &deploy.Fake{}, "validate", "-json", "-catalog", catalog)
+	if code != exitInvalid {
+		t.Fatalf("want exit code %d, instead got %d", exitInvalid, code)
+	}
+	var got struct {
+		Issues []struct {
+			Type    string `json:"type"`
+			Details struct {
+				Stack     string `json:"stack"`
+				Parameter string `json:"parameter"`
+			} `json:"details"`
+		} `json:"issues"`
+	}
+	if err := json.Unmarshal([]byte(stderr), &got); err != nil {
+		t.Fatalf("failed to decode error %q: %v", stderr, err)
+	}
+	if len(got.Issues) != 1 {
+		t.Fatalf("want 1 issue, instead got %d: %s", len(got.Issues), stderr)
+	}
+	if issue := got.Issues[0]; issue.Type != "unmet_parameter" || issue.Details.Stack != "a" || issue.Details.Parameter != "P" {
+		t.Errorf("want unmet_parameter issue for stack \"a\" parameter \"P\", instead got %+v", issue)
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	catalog := filepath.Join(t.TempDir(), "stacks.json")
+	err := os.WriteFile(catalog, []byte(`{"stacks": [
+		{"name": "a", "parameters": {"P": {"value": "1"}}},
+		{"name": "b", "parameters": {"P": {"consumed": true}}, "requires": ["a"]}
+	]}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	t.Run("NonBreaking", func(t *testing.T) {
+		changed := filepath.Join(t.TempDir(), "stacks.json")
+		err := os.WriteFile(changed, []byte(`{"stacks": [
+			{"name": "a", "parameters": {"P": {"value": "2"}}},
+			{"name": "b", "parameters": {"P": {"consumed": true}}, "requires": ["a"]}
+		]}`), 0o600)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		code, stdout, stderr := runTest(t, &deploy.Fake{}, "diff", "-catalog", catalog, changed)
+		if code != exitOK {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+		}
+		if want := `non-breaking: default changed stack "a" "P" from "1" to "2"`; !strings.Contains(stdout, want) {
+			t.Errorf("want output to contain '%s', instead got '%s'", want, stdout)
+		}
+	})
+
+	t.Run("Breaking", func(t *testing.T) {
+		changed := filepath.Join(t.TempDir(), "stacks.json")
+		err := os.WriteFile(changed, []byte(`{"stacks": [
+			{"name": "a", "parameters": {"Q": {"value": "1"}}},
+			{"name": "b", "parameters": {"Q": {"consumed": true}}, "requires": ["a"]}
+		]}`), 0o600)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		code, stdout, stderr := runTest(t, &deploy.Fake{}, "diff", "-json", "-catalog", catalog, changed)
+		if code != exitInvalid {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitInvalid, code, stderr)
+		}
+		var got struct {
+			Breaking bool `json:"breaking"`
+			Changes  []struct {
+				Kind      string   `json:"kind"`
+				Stack     string   `json:"stack"`
+				Name      string   `json:"name"`
+				Consumers []string `json:"consumers"`
+			} `json:"changes"`
+		}
+		if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+			t.Fatalf("failed to decode output %q: %v", stdout, err)
+		}
+		if !got.Breaking {
+			t.Errorf("want breaking changes in %s", stdout)
+		}
+		var found bool
+		for _, c := range got.Changes {
+			if c.Kind == "parameter_removed" && c.Stack == "a" && c.Name == "P" && len(c.Consumers) == 1 && c.Consumers[0] == "b" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("want removal of parameter \"P\" of stack \"a\" consumed by \"b\", instead got %s", stdout)
+		}
+	})
+}
+
+func TestRunHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	dir := t.TempDir()
+	instances := filepath.Join(dir, "instances.json")
+	catalog := filepath.Join(dir, "stacks.json")
+	err := os.WriteFile(catalog, []byte(`{"stacks": [{
+		"name": "db",
+		"parameters": {"DATABASE_NAME": {"value": "mono"}},
+		"hooks": [{"phase": "post-deploy", "command": ["sh", "-c", "echo seeding $DATABASE_NAME >&2"]}]
+	}]}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	code, _, stderr := runTest(t, &deploy.Fake{}, "deploy", "-dry-run", "-catalog", catalog, "-instances", instances, "-group", "whoami", "-name", "my", "-stacks", "db")
+	if code != exitOK {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+	}
+	if strings.Contains(stderr, "seeding") {
+		t.Errorf("want no hooks to run on a dry run, instead got '%s'", stderr)
+	}
+
+	code, _, stderr = runTest(t, &deploy.Fake{}, "deploy", "-catalog", catalog, "-instances", filepath.Join(dir, "other.json"), "-group", "whoami", "-name", "my", "-stacks", "db")
+	if code != exitOK {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+	}
+	if want := "seeding mono\n"; !strings.Contains(stderr, want) {
+		t.Errorf("want output to contain '%s', instead got '%s'", want, stderr)
+	}
+
+	t.Run("NotGivenUnknownGroup", func(t *testing.T) {
+		groups := filepath.Join(dir, "groups.json")
+		err := os.WriteFile(groups, []byte(`{"groups": [{"name": "whoami"}]}`), 0o600)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		err = os.WriteFile(catalog, []byte(`{"stacks": [{
+			"name": "db",
+			"hooks": [{"phase": "pre-resolve", "command": ["sh", "-c", "echo resolving >&2"]}]
+		}]}`), 0o600)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		code, _, stderr := runTest(t, &deploy.Fake{}, "deploy", "-catalog", catalog, "-groups", groups, "-instances", filepath.Join(dir, "prod.json"), "-group", "prod", "-name", "my", "-stacks", "db")
+
+		if code != exitInvalid {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitInvalid, code, stderr)
+		}
+		if strings.Contains(stderr, "resolving") {
+			t.Errorf("want no hooks to run for an unknown group, instead got '%s'", stderr)
+		}
+	})
+}
+
+func TestRunReadiness(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	dir := t.TempDir()
+	catalog := filepath.Join(dir, "stacks.json")
+	err := os.WriteFile(catalog, []byte(`{"stacks": [
+		{"name": "db", "readiness": {"command": ["sh", "-c", "echo refused >&2; exit 1"]}},
+		{"name": "app", "requires": ["db"]}
+	]}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	deployer := &deploy.Fake{}
+
+	code, _, stderr := runTest(t, deployer, "deploy", "-catalog", catalog, "-instances", filepath.Join(dir, "instances.json"), "-ready-timeout", "10ms", "-group", "whoami", "-name", "my", "-stacks", "app")
+
+	if code != exitFailure {
+		t.Fatalf("want exit code %d, instead got %d", exitFailure, code)
+	}
+	if want := `failed to deploy instance "my-db": instance "my-db" in group "whoami" is not ready after 10ms`; !strings.Contains(stderr, want) {
+		t.Errorf("want error to contain '%s', instead got '%s'", want, stderr)
+	}
+	if len(deployer.Deployed) != 1 {
+		t.Errorf("want only the database to be deployed, instead got %v", deployer.Deployed)
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	dir := t.TempDir()
+	catalog := filepath.Join(dir, "stacks.json")
+	err := os.WriteFile(catalog, []byte(`{"stacks": [
+		{"name": "db", "parameters": {"DATABASE_NAME": {"value": "mono"}}},
+		{"name": "app", "parameters": {"DATABASE_NAME": {"consumed": true}}, "requires": ["db"]}
+	]}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	args := []string{"deploy", "-catalog", catalog, "-instances", filepath.Join(dir, "instances.json"), "-checkpoint", filepath.Join(dir, "checkpoint.json"), "-group", "whoami", "-stacks", "app"}
+
+	failing := &deploy.Fake{DeployErr: map[string]error{"my-app": errors.New("helmfile failed")}}
+	code, _, stderr := runTest(t, failing, append(args, "-name", "my")...)
+	if code != exitFailure {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitFailure, code, stderr)
+	}
+
+	deployer := &deploy.Fake{}
+	code, stdout, stderr := runTest(t, deployer, append(args, "-name", "my")...)
+	if code != exitOK {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+	}
+	if want := "skipped my-db as it is deployed"; !strings.Contains(stdout, want) {
+		t.Errorf("want output to contain '%s', instead got '%s'", want, stdout)
+	}
+	if len(deployer.Deployed) != 1 || deployer.Deployed[0].Name != "my-app" {
+		t.Errorf("want only the app to be deployed, instead got %v", deployer.Deployed)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(filepath.Join(dir, "checkpoint.json"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if got := fi.Mode().Perm(); got != 0o600 {
+			t.Errorf("want checkpoint to only be accessible by the user, instead got mode %v", got)
+		}
+	}
+
+	code, _, stderr = runTest(t, &deploy.Fake{}, append(args, "-name", "other")...)
+	if code != exitInvalid {
+		t.Fatalf("want exit code %d, instead got %d", exitInvalid, code)
+	}
+	if want := "checkpoint does not match plan"; !strings.Contains(stderr, want) {
+		t.Errorf("want error to contain '%s', instead got '%s'", want, stderr)
+	}
+}
+
+func TestRunSecrets(t *testing.T) {
+	catalog := filepath.Join(t.TempDir(), "stacks.json")
+	err := os.WriteFile(catalog, []byte(`{"stacks": [
+		{"name": "db", "providers": {"DATABASE_PASSWORD": {"type": "secret"}}},
+		{"name": "app", "parameters": {"DATABASE_PASSWORD": {"consumed": true}}, "requires": ["db"]}
+	]}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Setenv(secretKeyEnv, "key")
+	deployed := func() []stack.Instance {
+		t.Helper()
+
+		deployer := &deploy.Fake{}
+		instances := filepath.Join(t.TempDir(), "instances.json")
+		code, stdout, stderr := runTest(t, deployer, "deploy", "-catalog", catalog, "-instances", instances, "-group", "whoami", "-name", "my", "-stacks", "app")
+		if code != exitOK {
+			t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+		}
+		if len(deployer.Deployed) != 2 {
+			t.Fatalf("want 2 deployed instances, instead got %v", deployer.Deployed)
+		}
+		password := deployer.Deployed[0].Parameters["DATABASE_PASSWORD"].Value
+		if password == "" || strings.Contains(stdout, password) {
+			t.Errorf("want output not to contain the password, instead got '%s'", stdout)
+		}
+		if want := "DATABASE_PASSWORD=" + deploy.Redacted; !strings.Contains(stdout, want) {
+			t.Errorf("want output to contain '%s', instead got '%s'", want, stdout)
+		}
+		if runtime.GOOS != "windows" {
+			fi, err := os.Stat(instances)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got := fi.Mode().Perm(); got != 0o600 {
+				t.Errorf("want instances to only be accessible by the user, instead got mode %v", got)
+			}
+		}
+		return deployer.Deployed
+	}
+
+	first, second := deployed(), deployed()
+
+	password := first[0].Parameters["DATABASE_PASSWORD"].Value
+	if password != first[1].Parameters["DATABASE_PASSWORD"].Value {
+		t.Errorf("want database and app to get the same password, instead got %v", first)
+	}
+	if password != second[0].Parameters["DATABASE_PASSWORD"].Value {
+		t.Errorf("want the same password across runs, instead got %v", second)
+	}
+}
+
+func TestRunReap(t *testing.T) {
+	instances := filepath.Join(t.TempDir(), "instances.json")
+	deployer := &deploy.Fake{}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	runAt := func(now time.Time, args ...string) (int, string, string) {
+		var stdout, stderr strings.Builder
+		code := runWith(context.Background(), args, &env{stdout: &stdout, stderr: &stderr, deployer: deployer, now: func() time.Time { return now }})
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, _, stderr := runAt(start, "deploy", "-instances", instances, "-group", "whoami", "-name", "my", "-stacks", "whoami-go", "-param", "whoami-go.INSTANCE_TTL=3600")
+	if code != exitOK {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+	}
+
+	later := start.Add(2 * time.Hour)
+	code, stdout, stderr := runAt(later, "expiries", "-instances", instances)
+	if code != exitOK {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+	}
+	if want := "my-whoami-go (whoami-go) in group whoami expired"; !strings.Contains(stdout, want) {
+		t.Errorf("want output to contain '%s', instead got '%s'", want, stdout)
+	}
+
+	code, stdout, stderr = runAt(later, "reap", "-instances", instances)
+	if code != exitOK {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+	}
+	if want := "destroyed my-whoami-go in group whoami"; !strings.Contains(stdout, want) {
+		t.Errorf("want output to contain '%s', instead got '%s'", want, stdout)
+	}
+	if len(deployer.Destroyed) != 1 {
+		t.Errorf("want 1 destroyed instance, instead got %d", len(deployer.Destroyed))
+	}
+}
+
+func TestRunAudit(t *testing.T) {
+	dir := t.TempDir()
+	instances := filepath.Join(dir, "instances.json")
+	log := filepath.Join(dir, "audit.jsonl")
+	deployArgs := []string{"-audit", log, "-actor", "ivo", "-instances", instances, "-group", "whoami", "-name", "my", "-stacks", "dhis2-db",
+		"-param", "dhis2-db.DATABASE_ID=1",
+		"-param", "dhis2-db.DATABASE_USERNAME=foo",
+		"-param", "dhis2-db.DATABASE_NAME=mono",
+	}
+
+	for _, args := range [][]string{
+		append([]string{"plan"}, append(deployArgs, "-param", "dhis2-db.DATABASE_PASSWORD=faa")...),
+		append([]string{"deploy"}, append(deployArgs, "-param", "dhis2-db.DATABASE_PASSWORD=faa")...),
+		append([]string{"deploy"}, append(deployArgs, "-param", "dhis2-db.DATABASE_PASSWORD=new")...),
+		{"destroy", "-audit", log, "-actor", "ivo", "-instances", instances, "-group", "whoami", "my-dhis2-db"},
+	} {
+		code, _, stderr := runTest(t, &deploy.Fake{}, args...)
+		if code != exitOK {
+			t.Fatalf("want exit code %d for %s, instead got %d: %s", exitOK, args[0], code, stderr)
+		}
+	}
+
+	code, stdout, stderr := runTest(t, &deploy.Fake{}, "audit", "-verify", log)
+	if code != exitOK {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+	}
+	if want := "audit log of 4 entries is intact"; !strings.Contains(stdout, want) {
+		t.Errorf("want output to contain '%s', instead got '%s'", want, stdout)
+	}
+
+	code, stdout, stderr = runTest(t, &deploy.Fake{}, "audit", "-group", "whoami", "-instance", "my-dhis2-db", log)
+	if code != exitOK {
+		t.Fatalf("want exit code %d, instead got %d: %s", exitOK, code, stderr)
+	}
+	for _, want := range []string{
+		"ivo plan my-dhis2-db in group whoami (dhis2-db) success",
+		"ivo update my-dhis2-db in group whoami (dhis2-db) success\n   ~ DATABASE_PASSWORD=<redacted> -> <redacted>\n",
+		"ivo destroy my-dhis2-db",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("want output to contain '%s', instead got '%s'", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, "faa") {
+		t.Errorf("want sensitive values to be redacted, instead got '%s'", stdout)
+	}
+
+	b, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = os.WriteFile(log, []byte(strings.Replace(string(b), `"actor":"ivo"`, `"actor":"eve"`, 1)), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	code, _, stderr = runTest(t, &deploy.Fake{}, "audit", "-verify", log)
+	if code != exitInvalid {
+		t.Fatalf("want exit code %d, instead got %d", exitInvalid, code)
+	}
+	if want := "line 1: entry 1 does not match its hash: audit log was tampered with"; !strings.Contains(stderr, want) {
+		t.Errorf("want error to contain '%s', instead got '%s'", want, stderr)
+	}
+}
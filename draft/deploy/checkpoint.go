@@ -0,0 +1,184 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/stack"
+)
+
+// ErrCheckpointMismatch is returned when resuming a plan from the checkpoint of a different plan.
+var ErrCheckpointMismatch = errors.New("checkpoint does not match plan")
+
+// Checkpoint records the progress of applying a plan so a chain that failed part way can be resumed
+// without redeploying the instances that were deployed. Every instance of the plan is deployed in
+// a step.
+type Checkpoint struct {
+	Group string `json:"group"`
+	Steps []Step `json:"steps"`
+}
+
+// Step of a checkpoint.
+type Step struct {
+	Instance string `json:"instance"`
+	Stack    string `json:"stack"`
+	// State is pending until the instance is deployed or failed to deploy.
+	State instance.State `json:"state"`
+	// Outputs are the resolved parameters the instance was deployed with. Instances requiring it
+	// consume them. Sensitive values are left out so they are not persisted. See Sensitive.
+	Outputs map[string]stack.Parameter `json:"outputs,omitempty"`
+	// Error is the reason the instance failed to deploy.
+	Error string `json:"error,omitempty"`
+}
+
+// NewCheckpoint returns the checkpoint of the plan with all steps pending.
+func NewCheckpoint(plan Plan) Checkpoint {
+	cp := Checkpoint{Group: plan.Group, Steps: make([]Step, 0, len(plan.Instances))}
+	for _, inst := range plan.Instances {
+		cp.Steps = append(cp.Steps, Step{Instance: inst.Name, Stack: inst.Stack.ID(), State: instance.Pending})
+	}
+	return cp
+}
+
+// Next returns the index of the first step that is not deployed. Returns the number of steps if
+// all are deployed.
+func (c Checkpoint) Next() int {
+	for i, s := range c.Steps {
+		if s.State != instance.Deployed {
+			return i
+		}
+	}
+	return len(c.Steps)
+}
+
+// match returns an error wrapping ErrCheckpointMismatch if the checkpoint is not of the plan.
+func (c Checkpoint) match(plan Plan) error {
+	if c.Group != plan.Group {
+		return fmt.Errorf("checkpoint is of group %q instead of %q: %w", c.Group, plan.Group, ErrCheckpointMismatch)
+	}
+	if len(c.Steps) != len(plan.Instances) {
+		return fmt.Errorf("checkpoint has %d steps instead of %d: %w", len(c.Steps), len(plan.Instances), ErrCheckpointMismatch)
+	}
+	for i, inst := range plan.Instances {
+		s := c.Steps[i]
+		if s.Instance != inst.Name || s.Stack != inst.Stack.ID() {
+			return fmt.Errorf("step %d deploys instance %q of stack %q instead of %q of stack %q: %w", i+1, s.Instance, s.Stack, inst.Name, inst.Stack.ID(), ErrCheckpointMismatch)
+		}
+	}
+	return nil
+}
+
+// Write writes the checkpoint as JSON.
+func (c Checkpoint) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
+
+// ReadCheckpoint reads a checkpoint written by Checkpoint.Write.
+func ReadCheckpoint(r io.Reader) (Checkpoint, error) {
+	var c Checkpoint
+	err := json.NewDecoder(r).Decode(&c)
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("failed to decode checkpoint: %v", err)
+	}
+	return c, nil
+}
+
+// Resume applies the plan like Apply continuing from the checkpoint of an earlier apply. A step the
+// checkpoint records as deployed is skipped if its instance is still deployed according to the
+// store and resolving it again yields the same outputs, as providers are evaluated again. The
+// first step that is incomplete or no longer valid and all steps following it are deployed. The
+// empty checkpoint starts at the first step. The checkpoint is updated as steps complete and passed to
+// save after every step so the progress is kept if applying fails. Returns the number of skipped
+// steps.
+func Resume(ctx context.Context, d Deployer, store *instance.Store, plan Plan, cp *Checkpoint, save func(Checkpoint) error) (int, error) {
+	if len(cp.Steps) == 0 {
+		*cp = NewCheckpoint(plan)
+	}
+	if err := cp.match(plan); err != nil {
+		return 0, err
+	}
+
+	var skipped int
+	deployed := make(map[string]stack.Instance, len(plan.Instances))
+	for i, planned := range plan.Instances {
+		inst, err := resolve(ctx, planned, deployed)
+		if err == nil && skipped == i && valid(cp.Steps[i], store, inst) {
+			skipped++
+			deployed[inst.Name] = inst
+			continue
+		}
+
+		cp.Steps[i] = Step{Instance: planned.Name, Stack: planned.Stack.ID(), State: instance.Pending}
+		// later steps might consume outputs that are about to change
+		for j := i + 1; j < len(cp.Steps); j++ {
+			cp.Steps[j].State = instance.Pending
+		}
+		if err == nil {
+			if err := save(*cp); err != nil {
+				return skipped, err
+			}
+			err = deployInstance(ctx, d, store, inst)
+		}
+		if err != nil {
+			cp.Steps[i].State = instance.Failed
+			cp.Steps[i].Error = err.Error()
+			return skipped, errors.Join(err, save(*cp))
+		}
+		cp.Steps[i].State = instance.Deployed
+		cp.Steps[i].Outputs = outputs(inst.Parameters)
+		if err := save(*cp); err != nil {
+			return skipped, err
+		}
+		deployed[inst.Name] = inst
+	}
+
+	return skipped, nil
+}
+
+// valid reports whether the step deployed the planned instance which is still deployed with the
+// same outputs. Sensitive outputs are compared to the ones the store recorded for the instance as
+// the checkpoint does not hold them.
+func valid(s Step, store *instance.Store, inst stack.Instance) bool {
+	if s.State != instance.Deployed {
+		return false
+	}
+	r, ok := store.Get(inst.Group, inst.Name)
+	if !ok || r.State != instance.Deployed {
+		return false
+	}
+	if len(s.Outputs) != len(inst.Parameters) {
+		return false
+	}
+	for k, p := range inst.Parameters {
+		out, ok := s.Outputs[k]
+		if !ok || Sensitive(k, p) != out.Sensitive {
+			return false
+		}
+		if out.Sensitive {
+			out, ok = r.Instance.Parameters[k]
+		}
+		if !ok || out.Value != p.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// outputs returns the parameters as recorded in a step leaving out the values of sensitive ones.
+func outputs(params map[string]stack.Parameter) map[string]stack.Parameter {
+	result := make(map[string]stack.Parameter, len(params))
+	for k, p := range params {
+		if Sensitive(k, p) {
+			p.Value = ""
+			p.Sensitive = true
+		}
+		result[k] = p
+	}
+	return result
+}
@@ -0,0 +1,207 @@
+// Package deploy deploys and destroys stack instances. Chains of stacks are deployed by first
+// planning an instance for every stack in the chain. Every instance is linked to the instances of
+// its required stacks so it can consume their parameters. The plan is then applied in chain order
+// resolving every instance again once the instances it requires are deployed.
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/stack"
+)
+
+var (
+	// ErrNotFound is returned if an instance does not exist.
+	ErrNotFound = errors.New("instance not found")
+	// ErrInUse is returned when destroying an instance other instances still require.
+	ErrInUse = errors.New("instance in use")
+)
+
+// Deployer deploys and destroys instances. Instances passed to a Deployer have all their
+// parameters resolved.
+type Deployer interface {
+	Deploy(ctx context.Context, instance stack.Instance) error
+	Destroy(ctx context.Context, instance stack.Instance) error
+}
+
+// Plan of instances to deploy in order.
+type Plan struct {
+	Group     string
+	Instances []stack.Instance
+}
+
+// NewPlan plans the deployment of a chain. Every stack in the chain is deployed as an instance
+// named after the given name and the stacks name in given group. Parameters are keyed by stack
+// name and set on the instance of that stack. All parameters are resolved so the plan can be
+// reviewed before it is applied. Applying resolves them again. See Apply. Resolving publishes the resolve events on the bus which can be nil.
+func NewPlan(ctx context.Context, bus *Bus, chain *stack.Chain, group, name string, params map[string]map[string]string) (Plan, error) {
+	for k := range params {
+		if !chainContains(chain, k) {
+			return Plan{}, fmt.Errorf("parameters given for stack %q which is not part of the chain %v", k, chain.Names())
+		}
+	}
+
+	plan := Plan{
+		Group:     group,
+		Instances: make([]stack.Instance, 0, len(chain.Chain)),
+	}
+	planned := make(map[string]stack.Instance, len(chain.Chain))
+	resolve := func(inst stack.Instance) (map[string]stack.Parameter, error) {
+		return stack.ResolveContext(ctx, inst)
+	}
+	var errs []error
+	for _, s := range chain.Chain {
+		inst := stack.Instance{
+			Name:       InstanceName(name, s),
+			Group:      group,
+			Stack:      s,
+			Parameters: make(map[string]stack.Parameter, len(params[s.Name])),
+		}
+		for k, v := range params[s.Name] {
+			inst.Parameters[k] = stack.Parameter{Value: v}
+		}
+		for _, dest := range s.Requires {
+			inst.Requires = append(inst.Requires, planned[dest.Name])
+		}
+
+		resolved, err := bus.Resolve(ctx, inst, resolve)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to plan instance %q: %w", inst.Name, err))
+			continue
+		}
+		if _, err := instance.ParseTTL(resolved[instance.TTLParameter].Value); err != nil {
+			errs = append(errs, fmt.Errorf("failed to plan instance %q: %w", inst.Name, err))
+			continue
+		}
+		inst.Parameters = resolved
+		planned[s.Name] = inst
+		plan.Instances = append(plan.Instances, inst)
+	}
+	if len(errs) > 0 {
+		return Plan{}, errors.Join(errs...)
+	}
+
+	return plan, nil
+}
+
+// InstanceName returns the name of the instance of given stack in a chain deployed under name.
+func InstanceName(name string, s stack.Stack) string {
+	return name + "-" + s.Name
+}
+
+func chainContains(chain *stack.Chain, name string) bool {
+	for _, s := range chain.Chain {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply deploys the instances of the plan in order and records their state in the store. Every
+// instance requiring other instances is resolved again right before it is deployed linking it to
+// them as deployed so their providers are only evaluated once they are deployed and ready if d
+// waits for readiness. See Gate. Applying stops at the first instance that fails to resolve or deploy.
+// Instances deployed before are not destroyed. Instances expire after the TTL set by their
+// instance.TTLParameter. See Resume for continuing a plan that failed part way.
+func Apply(ctx context.Context, d Deployer, store *instance.Store, plan Plan) error {
+	deployed := make(map[string]stack.Instance, len(plan.Instances))
+	for _, inst := range plan.Instances {
+		inst, err := resolve(ctx, inst, deployed)
+		if err != nil {
+			return err
+		}
+		if err := deployInstance(ctx, d, store, inst); err != nil {
+			return err
+		}
+		deployed[inst.Name] = inst
+	}
+
+	return nil
+}
+
+// resolve resolves the planned instance again linking it to the deployed instances it requires.
+// The parameters the user set are kept while consumed and provided ones are resolved again.
+// Instances requiring no other instance are deployed as planned.
+func resolve(ctx context.Context, inst stack.Instance, deployed map[string]stack.Instance) (stack.Instance, error) {
+	if len(inst.Requires) == 0 {
+		return inst, nil
+	}
+	params := make(map[string]stack.Parameter, len(inst.Parameters))
+	for k, p := range inst.Parameters {
+		if sp, ok := inst.Stack.Parameters[k]; ok && !sp.Consumed {
+			params[k] = stack.Parameter{Value: p.Value}
+		}
+	}
+	requires := make([]stack.Instance, 0, len(inst.Requires))
+	for _, dest := range inst.Requires {
+		if d, ok := deployed[dest.Name]; ok {
+			dest = d
+		}
+		requires = append(requires, dest)
+	}
+
+	result := inst
+	result.Parameters = params
+	result.Requires = requires
+	resolved, err := stack.ResolveContext(ctx, result)
+	if err != nil {
+		return stack.Instance{}, fmt.Errorf("failed to resolve instance %q: %w", inst.Name, err)
+	}
+	result.Parameters = resolved
+	return result, nil
+}
+
+// deployInstance deploys the instance recording its state in the store.
+func deployInstance(ctx context.Context, d Deployer, store *instance.Store, inst stack.Instance) error {
+	ttl, err := instance.InstanceTTL(inst)
+	if err != nil {
+		return fmt.Errorf("failed to deploy instance %q: %w", inst.Name, err)
+	}
+	err = store.Save(instance.Record{Instance: inst, State: instance.Pending, TTL: ttl})
+	if err != nil {
+		return err
+	}
+
+	err = d.Deploy(ctx, inst)
+	if err != nil {
+		saveErr := store.Save(instance.Record{Instance: inst, State: instance.Failed, TTL: ttl})
+		return errors.Join(fmt.Errorf("failed to deploy instance %q: %w", inst.Name, err), saveErr)
+	}
+
+	return store.Save(instance.Record{Instance: inst, State: instance.Deployed, TTL: ttl})
+}
+
+// Destroy destroys the instance with given name in given group and removes it from the store.
+// Returns an error if other instances in the store still require it.
+func Destroy(ctx context.Context, d Deployer, store *instance.Store, group, name string) error {
+	r, ok := store.Get(group, name)
+	if !ok {
+		return fmt.Errorf("instance %q does not exist in group %q: %w", name, group, ErrNotFound)
+	}
+
+	var dependents []string
+	for _, other := range store.List() {
+		for _, dest := range other.Instance.Requires {
+			if dest.Group == group && dest.Name == name {
+				dependents = append(dependents, other.Instance.Name)
+			}
+		}
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf("instance %q is required by instances %v: %w", name, dependents, ErrInUse)
+	}
+
+	err := d.Destroy(ctx, r.Instance)
+	if err != nil {
+		r.State = instance.Failed
+		saveErr := store.Save(r)
+		return errors.Join(fmt.Errorf("failed to destroy instance %q: %w", name, err), saveErr)
+	}
+	store.Delete(group, name)
+
+	return nil
+}
@@ -0,0 +1,1029 @@
+package deploy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/teleivo/providers/deploy"
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/retry"
+	"github.com/teleivo/providers/stack"
+)
+
+var start = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// newStore creates a store with a database, a core and a pgadmin instance both requiring the
+// database and a whoami instance. Instances are created at start with given TTLs keyed by name.
+func newStore(t *testing.T, ttls map[string]time.Duration) *instance.Store {
+	t.Helper()
+
+	db := stack.Instance{Name: "db", Group: "g", Stack: stack.Stack{Name: "dhis2-db"}}
+	core := stack.Instance{Name: "core", Group: "g", Stack: stack.Stack{Name: "dhis2-core"}, Requires: []stack.Instance{db}}
+	pgadmin := stack.Instance{Name: "pgadmin", Group: "g", Stack: stack.Stack{Name: "pgadmin"}, Requires: []stack.Instance{db}}
+	whoami := stack.Instance{Name: "whoami", Group: "g", Stack: stack.Stack{Name: "whoami-go"}}
+
+	store := instance.NewStore()
+	store.Now = func() time.Time { return start }
+	for _, inst := range []stack.Instance{db, core, pgadmin, whoami} {
+		err := store.Save(instance.Record{Instance: inst, State: instance.Deployed, TTL: ttls[inst.Name]})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	return store
+}
+
+func names(records []instance.Record) []string {
+	var result []string
+	for _, r := range records {
+		result = append(result, r.Instance.Name)
+	}
+	return result
+}
+
+func storedNames(store *instance.Store) []string {
+	return names(store.List())
+}
+
+func TestReaper(t *testing.T) {
+	now := func() time.Time { return start.Add(2 * time.Hour) }
+
+	t.Run("DestroyExpiredInstances", func(t *testing.T) {
+		store := newStore(t, map[string]time.Duration{"whoami": time.Hour, "pgadmin": 3 * time.Hour})
+		r := deploy.Reaper{Deployer: &deploy.Fake{}, Store: store, Now: now}
+
+		destroyed, err := r.Reap(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if diff := cmp.Diff([]string{"whoami"}, names(destroyed)); diff != "" {
+			t.Errorf("Reap() mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"core", "db", "pgadmin"}, storedNames(store)); diff != "" {
+			t.Errorf("store mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("DestroyDependentsFirst", func(t *testing.T) {
+		store := newStore(t, map[string]time.Duration{"db": time.Hour})
+		fake := &deploy.Fake{}
+		r := deploy.Reaper{Deployer: fake, Store: store, Now: now}
+
+		destroyed, err := r.Reap(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if diff := cmp.Diff([]string{"core", "pgadmin", "db"}, names(destroyed)); diff != "" {
+			t.Errorf("Reap() mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"whoami"}, storedNames(store)); diff != "" {
+			t.Errorf("store mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("DestroyWholeChain", func(t *testing.T) {
+		store := newStore(t, map[string]time.Duration{"core": time.Hour})
+		r := deploy.Reaper{Deployer: &deploy.Fake{}, Store: store, Strategy: deploy.WholeChain, Now: now}
+
+		destroyed, err := r.Reap(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if diff := cmp.Diff([]string{"core", "pgadmin", "db"}, names(destroyed)); diff != "" {
+			t.Errorf("Reap() mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"whoami"}, storedNames(store)); diff != "" {
+			t.Errorf("store mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("KeepRequiredInstancesIfDependentFailsToBeDestroyed", func(t *testing.T) {
+		store := newStore(t, map[string]time.Duration{"db": time.Hour})
+		fake := &deploy.Fake{DestroyErr: map[string]error{"core": errors.New("helmfile failed")}}
+		r := deploy.Reaper{Deployer: fake, Store: store, Now: now}
+
+		destroyed, err := r.Reap(context.Background())
+		if err == nil {
+			t.Fatal("expected error got none")
+		}
+		for _, want := range []string{
+			`failed to destroy instance "core": helmfile failed`,
+			`kept expired instance "db" in group "g"`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+		if diff := cmp.Diff([]string{"pgadmin"}, names(destroyed)); diff != "" {
+			t.Errorf("Reap() mismatch (-want +got):\n%s", diff)
+		}
+		if r, _ := store.Get("g", "core"); r.State != instance.Failed {
+			t.Errorf("want instance %q to be %s, instead got %s", "core", instance.Failed, r.State)
+		}
+	})
+
+	t.Run("ExtendTTL", func(t *testing.T) {
+		store := newStore(t, map[string]time.Duration{"whoami": time.Hour})
+		r := deploy.Reaper{Deployer: &deploy.Fake{}, Store: store, Now: now}
+
+		_, err := store.Extend("g", "whoami", 2*time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		destroyed, err := r.Reap(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if len(destroyed) != 0 {
+			t.Errorf("want no instances destroyed, instead got %v", names(destroyed))
+		}
+
+		_, err = store.Extend("g", "db", time.Hour)
+		if !errors.Is(err, instance.ErrNoTTL) {
+			t.Errorf("want error %v, instead got %v", instance.ErrNoTTL, err)
+		}
+	})
+
+	t.Run("Upcoming", func(t *testing.T) {
+		store := newStore(t, map[string]time.Duration{"whoami": time.Hour, "pgadmin": 3 * time.Hour, "core": 48 * time.Hour})
+		r := deploy.Reaper{Store: store, Now: now}
+
+		got := r.Upcoming(24 * time.Hour)
+
+		want := []deploy.Expiry{
+			{Group: "g", Name: "whoami", Stack: "whoami-go", Expires: start.Add(time.Hour), Remaining: -time.Hour},
+			{Group: "g", Name: "pgadmin", Stack: "pgadmin", Expires: start.Add(3 * time.Hour), Remaining: time.Hour},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Upcoming() mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestApply(t *testing.T) {
+	t.Run("RecordTTL", func(t *testing.T) {
+		store := instance.NewStore()
+		plan := deploy.Plan{Group: "g", Instances: []stack.Instance{{
+			Name:       "whoami",
+			Group:      "g",
+			Stack:      stack.Stack{Name: "whoami-go"},
+			Parameters: map[string]stack.Parameter{instance.TTLParameter: {Value: "3600"}},
+		}}}
+
+		err := deploy.Apply(context.Background(), &deploy.Fake{}, store, plan)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		r, ok := store.Get("g", "whoami")
+		if !ok {
+			t.Fatal("want instance to be stored")
+		}
+		if r.TTL != time.Hour {
+			t.Errorf("want TTL %s, instead got %s", time.Hour, r.TTL)
+		}
+		if r.Created.IsZero() {
+			t.Error("want creation time to be recorded")
+		}
+	})
+
+	t.Run("FailGivenInvalidTTL", func(t *testing.T) {
+		plan := deploy.Plan{Group: "g", Instances: []stack.Instance{{
+			Name:       "whoami",
+			Group:      "g",
+			Stack:      stack.Stack{Name: "whoami-go"},
+			Parameters: map[string]stack.Parameter{instance.TTLParameter: {Value: "soon"}},
+		}}}
+
+		err := deploy.Apply(context.Background(), &deploy.Fake{}, instance.NewStore(), plan)
+		if err == nil {
+			t.Fatal("expected error got none")
+		}
+		if want := `invalid TTL "soon"`; !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+}
+
+func TestResume(t *testing.T) {
+	ctx := context.Background()
+	plan := func(t *testing.T, params map[string]map[string]string) deploy.Plan {
+		t.Helper()
+
+		p, err := deploy.NewPlan(ctx, nil, chain(t), "g", "my", params)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return p
+	}
+	// saved keeps the checkpoint as it would be persisted
+	saved := func(b *strings.Builder) func(deploy.Checkpoint) error {
+		return func(cp deploy.Checkpoint) error {
+			b.Reset()
+			return cp.Write(b)
+		}
+	}
+	deployedNames := func(fake *deploy.Fake) []string {
+		var result []string
+		for _, inst := range fake.Deployed {
+			result = append(result, inst.Name)
+		}
+		return result
+	}
+
+	t.Run("ContinueFromFirstIncompleteStep", func(t *testing.T) {
+		store := instance.NewStore()
+		var b strings.Builder
+		var cp deploy.Checkpoint
+		failing := &deploy.Fake{DeployErr: map[string]error{"my-dhis2-core": errors.New("helmfile failed")}}
+
+		_, err := deploy.Resume(ctx, failing, store, plan(t, nil), &cp, saved(&b))
+
+		if err == nil {
+			t.Fatal("expected error got none")
+		}
+		got, err := deploy.ReadCheckpoint(strings.NewReader(b.String()))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if got.Next() != 1 {
+			t.Fatalf("want step 2 to be next, instead got step %d", got.Next()+1)
+		}
+		if want := "helmfile failed"; !strings.Contains(got.Steps[1].Error, want) {
+			t.Errorf("want step error to contain '%s', instead got '%s'", want, got.Steps[1].Error)
+		}
+		if got.Steps[0].Outputs["DATABASE_NAME"].Value != "mono" {
+			t.Errorf("want outputs of step 1 to be recorded, instead got %v", got.Steps[0].Outputs)
+		}
+
+		fake := &deploy.Fake{}
+		skipped, err := deploy.Resume(ctx, fake, store, plan(t, nil), &got, saved(&b))
+
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if skipped != 1 {
+			t.Errorf("want 1 skipped step, instead got %d", skipped)
+		}
+		if diff := cmp.Diff([]string{"my-dhis2-core"}, deployedNames(fake)); diff != "" {
+			t.Errorf("deployed mismatch (-want +got):\n%s", diff)
+		}
+		if got.Next() != 2 {
+			t.Errorf("want all steps to be deployed, instead got step %d next", got.Next()+1)
+		}
+	})
+
+	t.Run("RedeployGivenInvalidOutputs", func(t *testing.T) {
+		tests := map[string]struct {
+			params map[string]map[string]string
+			modify func(*instance.Store)
+		}{
+			"ChangedOutputs": {
+				params: map[string]map[string]string{"dhis2-db": {"DATABASE_NAME": "other"}},
+				modify: func(*instance.Store) {},
+			},
+			"InstanceNoLongerDeployed": {
+				modify: func(store *instance.Store) { store.Delete("g", "my-dhis2-db") },
+			},
+		}
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				store := instance.NewStore()
+				var b strings.Builder
+				var cp deploy.Checkpoint
+				_, err := deploy.Resume(ctx, &deploy.Fake{}, store, plan(t, nil), &cp, saved(&b))
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				tc.modify(store)
+
+				fake := &deploy.Fake{}
+				skipped, err := deploy.Resume(ctx, fake, store, plan(t, tc.params), &cp, saved(&b))
+
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if skipped != 0 {
+					t.Errorf("want no skipped step, instead got %d", skipped)
+				}
+				if diff := cmp.Diff([]string{"my-dhis2-db", "my-dhis2-core"}, deployedNames(fake)); diff != "" {
+					t.Errorf("deployed mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+
+	t.Run("NeverPersistSensitiveOutputs", func(t *testing.T) {
+		plan := func(password string) deploy.Plan {
+			return deploy.Plan{Group: "g", Instances: []stack.Instance{{
+				Name:  "my-db",
+				Group: "g",
+				Stack: stack.Stack{Name: "db"},
+				Parameters: map[string]stack.Parameter{
+					"DATABASE_NAME":     {Value: "mono"},
+					"DATABASE_PASSWORD": {Value: password},
+					"KEY":               {Value: "declared-sensitive", Sensitive: true},
+				},
+			}}}
+		}
+		store := instance.NewStore()
+		var b strings.Builder
+		var cp deploy.Checkpoint
+
+		_, err := deploy.Resume(ctx, &deploy.Fake{}, store, plan("s3cret"), &cp, saved(&b))
+
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		for _, v := range []string{"s3cret", "declared-sensitive"} {
+			if strings.Contains(b.String(), v) {
+				t.Errorf("want checkpoint not to contain %q, instead got '%s'", v, b.String())
+			}
+		}
+		if !strings.Contains(b.String(), "mono") {
+			t.Errorf("want checkpoint to contain non-sensitive outputs, instead got '%s'", b.String())
+		}
+
+		got, err := deploy.ReadCheckpoint(strings.NewReader(b.String()))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		skipped, err := deploy.Resume(ctx, &deploy.Fake{}, store, plan("s3cret"), &got, saved(&b))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if skipped != 1 {
+			t.Errorf("want step with the same sensitive outputs to be skipped, instead got %d skipped", skipped)
+		}
+		skipped, err = deploy.Resume(ctx, &deploy.Fake{}, store, plan("changed"), &got, saved(&b))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if skipped != 0 {
+			t.Errorf("want step with changed sensitive outputs to be redeployed, instead got %d skipped", skipped)
+		}
+	})
+
+	t.Run("FailGivenCheckpointOfOtherPlan", func(t *testing.T) {
+		cp := deploy.Checkpoint{Group: "g", Steps: []deploy.Step{{Instance: "other-dhis2-db", Stack: "dhis2-db", State: instance.Deployed}}}
+		var b strings.Builder
+
+		_, err := deploy.Resume(ctx, &deploy.Fake{}, instance.NewStore(), plan(t, nil), &cp, saved(&b))
+
+		if !errors.Is(err, deploy.ErrCheckpointMismatch) {
+			t.Errorf("want error %v, instead got %v", deploy.ErrCheckpointMismatch, err)
+		}
+	})
+}
+
+func TestWriteValues(t *testing.T) {
+	inst := stack.Instance{
+		Name:  "my-db",
+		Group: "whoami",
+		Stack: stack.Stack{Name: "dhis2-db", Version: "16.0.0"},
+		Parameters: map[string]stack.Parameter{
+			"DATABASE_ID":       {Value: "007", Type: stack.Int},
+			"DATABASE_NAME":     {Value: "true"},
+			"DATABASE_PASSWORD": {Value: "say \"hi\"\n"},
+			"ENABLED":           {Value: "t", Type: stack.Bool},
+			"RATIO":             {Value: "2", Type: stack.Number},
+			"SCALE":             {Value: "0.25", Type: stack.Number},
+			"DATABASE_HOSTNAME": {Value: "my-db.whoami.svc", Consumed: true},
+		},
+	}
+
+	var b strings.Builder
+	err := deploy.WriteValues(&b, inst)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	want := `# state values of instance "my-db" in group "whoami" of stack "dhis2-db@16.0.0"
+DATABASE_HOSTNAME: "my-db.whoami.svc"
+DATABASE_ID: 7
+DATABASE_NAME: "true"
+DATABASE_PASSWORD: "say \"hi\"\n"
+ENABLED: true
+INSTANCE_NAME: "my-db"
+INSTANCE_NAMESPACE: "whoami"
+RATIO: 2.0
+SCALE: 0.25
+`
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("WriteValues() mismatch (-want +got):\n%s", diff)
+	}
+
+	t.Run("FailGivenInvalidValues", func(t *testing.T) {
+		tests := map[string]stack.Parameter{
+			"DATABASE_ID": {Value: "one", Type: stack.Int},
+			"not-a-key":   {Value: "1"},
+		}
+		for k, p := range tests {
+			inst := stack.Instance{Name: "my-db", Parameters: map[string]stack.Parameter{k: p}}
+
+			err := deploy.WriteValues(io.Discard, inst)
+			if err == nil {
+				t.Errorf("expected error for parameter %q got none", k)
+			}
+		}
+	})
+
+	t.Run("FailGivenParameterSetByInstance", func(t *testing.T) {
+		for _, k := range []string{"INSTANCE_NAME", "INSTANCE_NAMESPACE"} {
+			inst := stack.Instance{Name: "my-db", Parameters: map[string]stack.Parameter{k: {Value: "other"}}}
+
+			err := deploy.WriteValues(io.Discard, inst)
+
+			if err == nil {
+				t.Fatalf("expected error for parameter %q got none", k)
+			}
+			if want := fmt.Sprintf("state value %q of instance \"my-db\" is set by the instance", k); !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+}
+
+func TestHelmfile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	dir := t.TempDir()
+	// fake helmfile printing its environment and state values file
+	bin := filepath.Join(dir, "helmfile")
+	script := "#!/bin/sh\nenv\nwhile [ $# -gt 0 ]; do\n  if [ \"$1\" = --state-values-file ]; then cat \"$2\"; fi\n  shift\ndone\n"
+	if err := os.WriteFile(bin, []byte(script), 0o700); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Setenv("STACKS_TEST_HOST_VAR", "leaked")
+	inst := stack.Instance{
+		Name:  "my-db",
+		Group: "whoami",
+		Stack: stack.Stack{
+			Name:       "dhis2-db",
+			File:       "helmfile.yaml",
+			Parameters: map[string]stack.Parameter{"DATABASE_ID": {Type: stack.Int}, "DATABASE_PASSWORD": {}},
+		},
+		Parameters: map[string]stack.Parameter{
+			"DATABASE_ID":       {Value: "1", Type: stack.Int},
+			"DATABASE_PASSWORD": {Value: "secret"},
+		},
+	}
+
+	var stdout strings.Builder
+	h := deploy.Helmfile{Bin: bin, StateValues: true, EnvDir: dir, Stdout: &stdout, Stderr: io.Discard}
+	err := h.Deploy(context.Background(), inst)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, want := range []string{"DATABASE_ID: 1\n", "DATABASE_PASSWORD=secret\n", "INSTANCE_NAMESPACE=whoami\n"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("want output to contain '%s', instead got '%s'", want, stdout.String())
+		}
+	}
+	if strings.Contains(stdout.String(), "STACKS_TEST_HOST_VAR") {
+		t.Errorf("want host variables not to be passed unless allowed, instead got '%s'", stdout.String())
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "my-db.env"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if want := `DATABASE_PASSWORD="<redacted>"`; !strings.Contains(string(b), want) {
+		t.Errorf("want .env file to contain '%s', instead got '%s'", want, b)
+	}
+}
+
+func TestEnvBuilder(t *testing.T) {
+	db := stack.Stack{
+		Name: "dhis2-db",
+		Parameters: map[string]stack.Parameter{
+			"DATABASE_NAME":     {},
+			"DATABASE_PASSWORD": {Sensitive: true},
+			"API_TOKEN":         {},
+		},
+	}
+	host := map[string]string{"PATH": "/bin", "KUBECONFIG": "/kube/config"}
+	lookup := func(k string) (string, bool) {
+		v, ok := host[k]
+		return v, ok
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		inst := stack.Instance{
+			Name:  "my-db",
+			Group: "whoami",
+			Stack: db,
+			Parameters: map[string]stack.Parameter{
+				"DATABASE_NAME":     {Value: "mono"},
+				"DATABASE_PASSWORD": {Value: "faa", Sensitive: true},
+				"API_TOKEN":         {Value: "t0k3n"},
+			},
+		}
+
+		env, err := deploy.EnvBuilder{Allow: []string{"PATH", "HOME"}, LookupEnv: lookup}.Build(inst)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := []string{
+			"API_TOKEN=t0k3n",
+			"DATABASE_NAME=mono",
+			"DATABASE_PASSWORD=faa",
+			"INSTANCE_NAME=my-db",
+			"INSTANCE_NAMESPACE=whoami",
+			"PATH=/bin",
+		}
+		if diff := cmp.Diff(want, env.Environ()); diff != "" {
+			t.Errorf("Environ() mismatch (-want +got):\n%s", diff)
+		}
+
+		var b strings.Builder
+		if err := env.WriteDotEnv(&b); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		wantDotEnv := `API_TOKEN="<redacted>"
+DATABASE_NAME="mono"
+DATABASE_PASSWORD="<redacted>"
+INSTANCE_NAME="my-db"
+INSTANCE_NAMESPACE="whoami"
+PATH="/bin"
+`
+		if diff := cmp.Diff(wantDotEnv, b.String()); diff != "" {
+			t.Errorf("WriteDotEnv() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenInvalidEnvironment", func(t *testing.T) {
+		inst := stack.Instance{
+			Name:  "my-db",
+			Group: "whoami",
+			Stack: stack.Stack{
+				Name: "dhis2-db",
+				Parameters: map[string]stack.Parameter{
+					"INSTANCE_NAME": {},
+					"DATABASE-NAME": {},
+					"PATH":          {},
+				},
+			},
+			Parameters: map[string]stack.Parameter{
+				"INSTANCE_NAME": {Value: "other"},
+				"DATABASE-NAME": {Value: "mono"},
+				"PATH":          {Value: "/usr/bin"},
+				"UNDECLARED":    {Value: "1"},
+			},
+		}
+
+		_, err := deploy.EnvBuilder{Allow: []string{"PATH"}, LookupEnv: lookup}.Build(inst)
+		if err == nil {
+			t.Fatal("expected error got none")
+		}
+		for _, want := range []string{
+			`environment variable "INSTANCE_NAME" is set by the instance and parameter "INSTANCE_NAME"`,
+			`invalid environment variable name "DATABASE-NAME" from parameter "DATABASE-NAME"`,
+			`environment variable "PATH" is set by parameter "PATH" and host variable "PATH"`,
+			`parameter "UNDECLARED" is not declared by stack "dhis2-db"`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+}
+
+// chain creates a chain of a database stack and an app stack requiring it.
+func chain(t *testing.T, hooks ...stack.Hook) *stack.Chain {
+	t.Helper()
+
+	db := stack.Stack{
+		Name:       "dhis2-db",
+		Parameters: map[string]stack.Parameter{"DATABASE_NAME": {Value: "mono"}},
+		Hooks:      hooks,
+	}
+	app := stack.Stack{
+		Name:       "dhis2-core",
+		Parameters: map[string]stack.Parameter{"DATABASE_NAME": {Consumed: true}},
+		Requires:   []stack.Stack{db},
+	}
+	stacks, err := stack.New(db, app)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c, err := stacks.Chain("dhis2-core")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return c
+}
+
+func TestBus(t *testing.T) {
+	ctx := context.Background()
+	// events records the phases of the events it observes as <phase> <instance>
+	observe := func(bus *deploy.Bus) *[]string {
+		var events []string
+		bus.Observe(deploy.ObserverFunc(func(_ context.Context, e deploy.Event) {
+			events = append(events, string(e.Phase)+" "+e.Instance.Name)
+		}))
+		return &events
+	}
+
+	t.Run("PublishLifecycleEvents", func(t *testing.T) {
+		var bus deploy.Bus
+		events := observe(&bus)
+		var seeded map[string]stack.Parameter
+		bus.Hook("dhis2-db", stack.PostDeploy, deploy.HookFunc(func(_ context.Context, e deploy.Event) error {
+			seeded = e.Parameters
+			return nil
+		}))
+		store := instance.NewStore()
+
+		plan, err := deploy.NewPlan(ctx, &bus, chain(t), "g", "my", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		err = deploy.Apply(ctx, bus.Deployer(&deploy.Fake{}), store, plan)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		err = deploy.Destroy(ctx, bus.Deployer(&deploy.Fake{}), store, "g", "my-dhis2-core")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := []string{
+			"pre-resolve my-dhis2-db",
+			"post-resolve my-dhis2-db",
+			"pre-resolve my-dhis2-core",
+			"post-resolve my-dhis2-core",
+			"pre-deploy my-dhis2-db",
+			"post-deploy my-dhis2-db",
+			"pre-deploy my-dhis2-core",
+			"post-deploy my-dhis2-core",
+			"pre-destroy my-dhis2-core",
+			"post-destroy my-dhis2-core",
+		}
+		if diff := cmp.Diff(want, *events); diff != "" {
+			t.Errorf("events mismatch (-want +got):\n%s", diff)
+		}
+		if got := seeded["DATABASE_NAME"].Value; got != "mono" {
+			t.Errorf("want post-deploy hook to get the resolved parameters, instead got %v", seeded)
+		}
+	})
+
+	t.Run("FailDeployGivenFailingHook", func(t *testing.T) {
+		tests := map[string]struct {
+			phase      stack.Phase
+			wantEvents []string
+			wantDeploy []string
+		}{
+			"PreDeploy": {
+				phase:      stack.PreDeploy,
+				wantEvents: []string{"deploy-failed my-dhis2-db"},
+			},
+			"PostDeploy": {
+				phase:      stack.PostDeploy,
+				wantEvents: []string{"pre-deploy my-dhis2-db", "deploy-failed my-dhis2-db"},
+				wantDeploy: []string{"my-dhis2-db"},
+			},
+		}
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				var bus deploy.Bus
+				bus.Hook("dhis2-db", tc.phase, deploy.HookFunc(func(context.Context, deploy.Event) error {
+					return errors.New("seeding failed")
+				}))
+				events := observe(&bus)
+				plan, err := deploy.NewPlan(ctx, nil, chain(t), "g", "my", nil)
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				store := instance.NewStore()
+				fake := &deploy.Fake{}
+
+				err = deploy.Apply(ctx, bus.Deployer(fake), store, plan)
+
+				if !errors.Is(err, deploy.ErrHookFailed) {
+					t.Fatalf("want error %v, instead got %v", deploy.ErrHookFailed, err)
+				}
+				if want := "seeding failed"; !strings.Contains(err.Error(), want) {
+					t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+				}
+				if diff := cmp.Diff(tc.wantEvents, *events); diff != "" {
+					t.Errorf("events mismatch (-want +got):\n%s", diff)
+				}
+				var deployed []string
+				for _, inst := range fake.Deployed {
+					deployed = append(deployed, inst.Name)
+				}
+				if diff := cmp.Diff(tc.wantDeploy, deployed); diff != "" {
+					t.Errorf("deployed mismatch (-want +got):\n%s", diff)
+				}
+				if r, _ := store.Get("g", "my-dhis2-db"); r.State != instance.Failed {
+					t.Errorf("want instance to be %s, instead got %s", instance.Failed, r.State)
+				}
+			})
+		}
+	})
+
+	t.Run("KeepInstanceGivenFailingPreDestroyHook", func(t *testing.T) {
+		var bus deploy.Bus
+		bus.Hook(deploy.AnyStack, stack.PreDestroy, deploy.HookFunc(func(context.Context, deploy.Event) error {
+			return errors.New("backup failed")
+		}))
+		store := newStore(t, nil)
+		fake := &deploy.Fake{}
+
+		err := deploy.Destroy(ctx, bus.Deployer(fake), store, "g", "whoami")
+
+		if !errors.Is(err, deploy.ErrHookFailed) {
+			t.Fatalf("want error %v, instead got %v", deploy.ErrHookFailed, err)
+		}
+		if len(fake.Destroyed) != 0 {
+			t.Errorf("want no instance to be destroyed, instead got %v", fake.Destroyed)
+		}
+	})
+
+	t.Run("RunStackHooks", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("needs a shell")
+		}
+		var stdout strings.Builder
+		bus := deploy.Bus{Command: deploy.Command{Stdout: &stdout, Stderr: io.Discard}}
+		hooks := []stack.Hook{
+			{Phase: stack.PostDeploy, Command: []string{"sh", "-c", `echo "seed $DATABASE_NAME in $INSTANCE_NAMESPACE"`}},
+			{Phase: stack.PreDestroy, Command: []string{"sh", "-c", "exit 3"}},
+		}
+		plan, err := deploy.NewPlan(ctx, &bus, chain(t, hooks...), "g", "my", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		store := instance.NewStore()
+		err = deploy.Apply(ctx, bus.Deployer(&deploy.Fake{}), store, plan)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if want := "seed mono in g\n"; stdout.String() != want {
+			t.Errorf("want hook output '%s', instead got '%s'", want, stdout.String())
+		}
+
+		store.Delete("g", "my-dhis2-core")
+		err = deploy.Destroy(ctx, bus.Deployer(&deploy.Fake{}), store, "g", "my-dhis2-db")
+
+		if !errors.Is(err, deploy.ErrHookFailed) {
+			t.Fatalf("want error %v, instead got %v", deploy.ErrHookFailed, err)
+		}
+		if want := `pre-destroy hook 1 of stack "dhis2-db" for instance "my-dhis2-db"`; !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+}
+
+func TestGate(t *testing.T) {
+	ctx := context.Background()
+	plan := func(t *testing.T, readiness *stack.Readiness) deploy.Plan {
+		t.Helper()
+
+		c := chain(t)
+		c.Chain[0].Readiness = readiness
+		p, err := deploy.NewPlan(ctx, nil, c, "g", "my", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return p
+	}
+
+	t.Run("DeployDependentsOnceReady", func(t *testing.T) {
+		fake := &deploy.Fake{}
+		var probes []string
+		probe := deploy.ProbeFunc(func(_ context.Context, inst stack.Instance) error {
+			probes = append(probes, fmt.Sprintf("%s after %d deploys", inst.Name, len(fake.Deployed)))
+			if inst.Name == "my-dhis2-db" && len(probes) < 3 {
+				return errors.New("connection refused")
+			}
+			return nil
+		})
+		gate := deploy.Gate{Probe: probe, Interval: time.Millisecond}
+
+		err := deploy.Apply(ctx, gate.Deployer(fake), instance.NewStore(), plan(t, nil))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := []string{
+			"my-dhis2-db after 1 deploys",
+			"my-dhis2-db after 1 deploys",
+			"my-dhis2-db after 1 deploys",
+			"my-dhis2-core after 2 deploys",
+		}
+		if diff := cmp.Diff(want, probes); diff != "" {
+			t.Errorf("probes mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ResolveDependentsOnceReady", func(t *testing.T) {
+		var ready bool
+		// evaluations records whether the database was ready whenever its hostname was provided
+		var evaluations []bool
+		db := stack.Stack{
+			Name: "dhis2-db",
+			Providers: map[string]stack.Provider{
+				"DATABASE_HOSTNAME": stack.ProviderFunc(func(inst stack.Instance) (string, error) {
+					evaluations = append(evaluations, ready)
+					return fmt.Sprintf("%s.svc ready=%t", inst.Name, ready), nil
+				}),
+			},
+		}
+		core := stack.Stack{
+			Name:       "dhis2-core",
+			Parameters: map[string]stack.Parameter{"DATABASE_HOSTNAME": {Consumed: true}},
+			Requires:   []stack.Stack{db},
+		}
+		stacks, err := stack.New(db, core)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		c, err := stacks.Chain("dhis2-core")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		p, err := deploy.NewPlan(ctx, nil, c, "g", "my", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var probes int
+		probe := deploy.ProbeFunc(func(context.Context, stack.Instance) error {
+			probes++
+			if probes < 3 {
+				return errors.New("connection refused")
+			}
+			ready = true
+			return nil
+		})
+		gate := deploy.Gate{Probe: probe, Interval: time.Millisecond}
+		fake := &deploy.Fake{}
+		evaluations = nil
+
+		err = deploy.Apply(ctx, gate.Deployer(fake), instance.NewStore(), p)
+
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if diff := cmp.Diff([]bool{true}, evaluations); diff != "" {
+			t.Errorf("want providers only evaluated once the database is ready (-want +got):\n%s", diff)
+		}
+		if len(fake.Deployed) != 2 {
+			t.Fatalf("want 2 deployed instances, instead got %v", fake.Deployed)
+		}
+		if want, got := "my-dhis2-db.svc ready=true", fake.Deployed[1].Parameters["DATABASE_HOSTNAME"].Value; want != got {
+			t.Errorf("want dependent deployed with %q, instead got %q", want, got)
+		}
+	})
+
+	t.Run("FailInstanceGivenTimeout", func(t *testing.T) {
+		fake := &deploy.Fake{}
+		probe := deploy.ProbeFunc(func(context.Context, stack.Instance) error {
+			return errors.New("connection refused")
+		})
+		gate := deploy.Gate{Probe: probe, Timeout: 20 * time.Millisecond, Interval: time.Millisecond}
+		store := instance.NewStore()
+
+		err := deploy.Apply(ctx, gate.Deployer(fake), store, plan(t, nil))
+
+		if !errors.Is(err, deploy.ErrNotReady) {
+			t.Fatalf("want error %v, instead got %v", deploy.ErrNotReady, err)
+		}
+		for _, want := range []string{
+			`failed to deploy instance "my-dhis2-db": instance "my-dhis2-db" in group "g" is not ready after 20ms`,
+			"connection refused",
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+		if r, _ := store.Get("g", "my-dhis2-db"); r.State != instance.Failed {
+			t.Errorf("want instance to be %s, instead got %s", instance.Failed, r.State)
+		}
+		if len(fake.Deployed) != 1 {
+			t.Errorf("want dependents not to be deployed, instead got %v", fake.Deployed)
+		}
+	})
+
+	t.Run("StopGivenCancelledContext", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		probe := deploy.ProbeFunc(func(context.Context, stack.Instance) error {
+			cancel()
+			return errors.New("connection refused")
+		})
+		gate := deploy.Gate{Probe: probe}
+
+		err := gate.Wait(ctx, stack.Instance{Name: "my-dhis2-db"})
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want error %v, instead got %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("RunStackReadinessCommand", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("needs a shell")
+		}
+		gate := deploy.Gate{Command: deploy.Command{Stdout: io.Discard, Stderr: io.Discard}}
+
+		ready := &stack.Readiness{Command: []string{"sh", "-c", `test "$DATABASE_NAME" = mono`}}
+		err := deploy.Apply(ctx, gate.Deployer(&deploy.Fake{}), instance.NewStore(), plan(t, ready))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		notReady := &stack.Readiness{Command: []string{"sh", "-c", "exit 1"}, Timeout: "10ms"}
+		err = deploy.Apply(ctx, gate.Deployer(&deploy.Fake{}), instance.NewStore(), plan(t, notReady))
+		if !errors.Is(err, deploy.ErrNotReady) {
+			t.Errorf("want error %v, instead got %v", deploy.ErrNotReady, err)
+		}
+	})
+}
+
+// flaky is a Deployer failing the first deploys of every instance.
+type flaky struct {
+	failures int
+	calls    map[string]int
+}
+
+func (f *flaky) Deploy(_ context.Context, inst stack.Instance) error {
+	f.calls[inst.Name]++
+	if f.calls[inst.Name] <= f.failures {
+		return fmt.Errorf("helmfile sync timeout %d", f.calls[inst.Name])
+	}
+	return nil
+}
+
+func (f *flaky) Destroy(context.Context, stack.Instance) error {
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	retried := stack.Stack{Name: "dhis2-db", Retry: &stack.Retry{MaxAttempts: 3, Backoff: "1ms", RetryOn: []string{"timeout"}}}
+	once := stack.Stack{Name: "whoami-go"}
+
+	t.Run("RetryPerStack", func(t *testing.T) {
+		d := &flaky{failures: 2, calls: make(map[string]int)}
+		r := deploy.Retry{}.Deployer(d)
+
+		err := r.Deploy(ctx, stack.Instance{Name: "db", Stack: retried})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		err = r.Deploy(ctx, stack.Instance{Name: "whoami", Stack: once})
+		if want := "helmfile sync timeout 1"; err == nil || err.Error() != want {
+			t.Errorf("want error '%s' of a single attempt, instead got %v", want, err)
+		}
+
+		if diff := cmp.Diff(map[string]int{"db": 3, "whoami": 1}, d.calls); diff != "" {
+			t.Errorf("calls mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("SurfaceAttemptHistory", func(t *testing.T) {
+		d := &flaky{failures: 5, calls: make(map[string]int)}
+		r := deploy.Retry{}.Deployer(d)
+		plan := deploy.Plan{Group: "g", Instances: []stack.Instance{{Name: "db", Group: "g", Stack: retried}}}
+
+		err := deploy.Apply(ctx, r, instance.NewStore(), plan)
+
+		var retryErr *retry.Error
+		if !errors.As(err, &retryErr) {
+			t.Fatalf("want error of type %T, instead got %v", retryErr, err)
+		}
+		if len(retryErr.Attempts) != 3 {
+			t.Errorf("want 3 attempts, instead got %d", len(retryErr.Attempts))
+		}
+		if want := `failed to deploy instance "db": failed after 3 attempts`; !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("UseDefaultPolicy", func(t *testing.T) {
+		d := &flaky{failures: 1, calls: make(map[string]int)}
+		r := deploy.Retry{Policy: retry.Policy{MaxAttempts: 2, Backoff: time.Millisecond}}.Deployer(d)
+
+		err := r.Deploy(ctx, stack.Instance{Name: "whoami", Stack: once})
+
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
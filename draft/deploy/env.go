@@ -0,0 +1,149 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/teleivo/providers/stack"
+)
+
+// DefaultAllowEnv are the host environment variables passed to helmfile by default. They are
+// needed to find binaries, the cluster and the helm caches.
+var DefaultAllowEnv = []string{"HOME", "KUBECONFIG", "PATH", "XDG_CACHE_HOME", "XDG_CONFIG_HOME", "XDG_DATA_HOME"}
+
+// EnvBuilder builds the environment of a helmfile process from the resolved parameters of an
+// instance. The environment is hermetic: it only contains the parameters declared by the instances
+// stack, the secrets its stack provides to itself (see stack.SelfProvider), the INSTANCE_NAME and
+// INSTANCE_NAMESPACE and the allowed host variables. Duplicate or invalid names are errors instead
+// of being silently dropped by exec.Cmd.
+type EnvBuilder struct {
+	// Allow lists the host variables passed through. Variables not set on the host are skipped.
+	Allow []string
+	// LookupEnv looks up host variables. Defaults to os.LookupEnv.
+	LookupEnv func(key string) (string, bool)
+}
+
+// Var is an environment variable.
+type Var struct {
+	Name  string
+	Value string
+	// Sensitive values are redacted in WriteDotEnv. See Sensitive.
+	Sensitive bool
+}
+
+// Env is an environment sorted by variable name.
+type Env []Var
+
+// envName matches POSIX environment variable names.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Build builds the environment of the instance.
+func (b EnvBuilder) Build(instance stack.Instance) (Env, error) {
+	lookup := b.LookupEnv
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+
+	var result Env
+	var errs []error
+	seen := make(map[string]string)
+	add := func(v Var, source string) {
+		if !envName.MatchString(v.Name) {
+			errs = append(errs, fmt.Errorf("invalid environment variable name %q from %s", v.Name, source))
+			return
+		}
+		if prev, ok := seen[v.Name]; ok {
+			errs = append(errs, fmt.Errorf("environment variable %q is set by %s and %s", v.Name, prev, source))
+			return
+		}
+		if strings.ContainsRune(v.Value, 0) {
+			errs = append(errs, fmt.Errorf("environment variable %q from %s must not contain NUL", v.Name, source))
+			return
+		}
+		seen[v.Name] = source
+		result = append(result, v)
+	}
+
+	add(Var{Name: "INSTANCE_NAME", Value: instance.Name}, "the instance")
+	add(Var{Name: "INSTANCE_NAMESPACE", Value: instance.Group}, "the instance")
+	names := make([]string, 0, len(instance.Parameters))
+	for k := range instance.Parameters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		p := instance.Parameters[k]
+		if _, ok := instance.Stack.Parameters[k]; !ok && !stack.ProvidesSelf(instance.Stack.Providers[k]) {
+			errs = append(errs, fmt.Errorf("parameter %q is not declared by stack %q", k, instance.Stack.Name))
+			continue
+		}
+		add(Var{Name: k, Value: p.Value, Sensitive: Sensitive(k, p)}, fmt.Sprintf("parameter %q", k))
+	}
+	for _, k := range b.Allow {
+		v, ok := lookup(k)
+		if !ok {
+			continue
+		}
+		add(Var{Name: k, Value: v, Sensitive: Sensitive(k, stack.Parameter{})}, fmt.Sprintf("host variable %q", k))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid environment of instance %q: %w", instance.Name, err)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// sensitiveNames are parts of names of variables considered sensitive even if they are not
+// declared as such.
+var sensitiveNames = []string{"PASSWORD", "SECRET", "TOKEN"}
+
+// Sensitive reports whether the value of the parameter must be redacted. Parameters are sensitive
+// if they are declared as such or if their name contains PASSWORD, SECRET or TOKEN.
+func Sensitive(name string, p stack.Parameter) bool {
+	if p.Sensitive {
+		return true
+	}
+	upper := strings.ToUpper(name)
+	for _, s := range sensitiveNames {
+		if strings.Contains(upper, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Environ returns the environment in the form key=value as used by exec.Cmd.
+func (e Env) Environ() []string {
+	result := make([]string, len(e))
+	for i, v := range e {
+		result[i] = v.Name + "=" + v.Value
+	}
+	return result
+}
+
+// Redacted is written in place of sensitive values.
+const Redacted = "<redacted>"
+
+// WriteDotEnv writes the environment as a .env file for debugging. Sensitive values are redacted.
+// Values are double-quoted using Go escape sequences.
+func (e Env) WriteDotEnv(w io.Writer) error {
+	var b strings.Builder
+	for _, v := range e {
+		value := v.Value
+		if v.Sensitive {
+			value = Redacted
+		}
+		fmt.Fprintf(&b, "%s=%s\n", v.Name, strconv.Quote(value))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,251 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/teleivo/providers/stack"
+)
+
+// Event in the lifecycle of an instance.
+type Event struct {
+	Phase    stack.Phase
+	Instance stack.Instance
+	// Parameters are the resolved parameters of the instance. They are nil before the instance is
+	// resolved.
+	Parameters map[string]stack.Parameter
+	// Err is the error that failed the deployment of a stack.DeployFailed event.
+	Err error
+}
+
+// Hook runs in a phase of the lifecycle of an instance. An error fails the phase.
+type Hook interface {
+	Run(ctx context.Context, event Event) error
+}
+
+type HookFunc func(ctx context.Context, event Event) error
+
+func (h HookFunc) Run(ctx context.Context, event Event) error {
+	return h(ctx, event)
+}
+
+// Observer is notified of lifecycle events. Observers cannot fail a phase.
+type Observer interface {
+	Observe(ctx context.Context, event Event)
+}
+
+type ObserverFunc func(ctx context.Context, event Event)
+
+func (o ObserverFunc) Observe(ctx context.Context, event Event) {
+	o(ctx, event)
+}
+
+// ErrHookFailed is returned if a hook fails.
+var ErrHookFailed = errors.New("hook failed")
+
+// AnyStack registers a hook for the instances of all stacks.
+const AnyStack = ""
+
+// Bus publishes lifecycle events to hooks and observers. Hooks declared by the stack of the
+// instance run first using Command, followed by the hooks registered on the bus in the order they
+// were registered. Observers are notified once all hooks succeeded. A failing hook stops the
+// remaining hooks and fails its phase
+//
+//   - stack.PreResolve, stack.PostResolve: the instance is not resolved.
+//   - stack.PreDeploy: the instance is not deployed and the deploy fails.
+//   - stack.PostDeploy: the deploy fails.
+//   - stack.PreDestroy: the instance is not destroyed and the destroy fails.
+//   - stack.PostDestroy: the destroy fails.
+//
+// A failed deploy publishes a stack.DeployFailed event. The zero value is ready to use and a nil
+// Bus publishes nothing. A Bus is safe for concurrent use.
+type Bus struct {
+	mu        sync.RWMutex
+	hooks     []hookEntry
+	observers []observerEntry
+	// Command runs the hooks declared by stacks.
+	Command Command
+}
+
+type hookEntry struct {
+	stack string
+	phase stack.Phase
+	hook  Hook
+}
+
+type observerEntry struct {
+	phases   []stack.Phase
+	observer Observer
+}
+
+// Hook registers the hook to run in given phase for the instances of the stack with given name or
+// of all stacks using AnyStack.
+func (b *Bus) Hook(stackName string, phase stack.Phase, h Hook) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = append(b.hooks, hookEntry{stack: stackName, phase: phase, hook: h})
+}
+
+// Observe registers the observer to be notified of events in given phases or in all phases if none
+// are given.
+func (b *Bus) Observe(o Observer, phases ...stack.Phase) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.observers = append(b.observers, observerEntry{phases: phases, observer: o})
+}
+
+// Publish runs the hooks of the event and notifies the observers if all hooks succeeded. Returns an
+// error wrapping ErrHookFailed and the error of the first failing hook.
+func (b *Bus) Publish(ctx context.Context, event Event) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.RLock()
+	hooks := append([]hookEntry{}, b.hooks...)
+	observers := append([]observerEntry{}, b.observers...)
+	b.mu.RUnlock()
+
+	for i, h := range event.Instance.Stack.Hooks {
+		if h.Phase != event.Phase {
+			continue
+		}
+		if err := b.Command.Run(ctx, h, event); err != nil {
+			return fmt.Errorf("%s hook %d of stack %q for instance %q: %w: %w", event.Phase, i, event.Instance.Stack.Name, event.Instance.Name, ErrHookFailed, err)
+		}
+	}
+	for _, h := range hooks {
+		if h.phase != event.Phase || (h.stack != AnyStack && h.stack != event.Instance.Stack.Name) {
+			continue
+		}
+		if err := h.hook.Run(ctx, event); err != nil {
+			return fmt.Errorf("%s hook for instance %q: %w: %w", event.Phase, event.Instance.Name, ErrHookFailed, err)
+		}
+	}
+	for _, o := range observers {
+		if observes(o.phases, event.Phase) {
+			o.observer.Observe(ctx, event)
+		}
+	}
+	return nil
+}
+
+func observes(phases []stack.Phase, phase stack.Phase) bool {
+	if len(phases) == 0 {
+		return true
+	}
+	for _, p := range phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve resolves the instance using resolve publishing the stack.PreResolve and
+// stack.PostResolve events around it.
+func (b *Bus) Resolve(ctx context.Context, instance stack.Instance, resolve func(stack.Instance) (map[string]stack.Parameter, error)) (map[string]stack.Parameter, error) {
+	if err := b.Publish(ctx, Event{Phase: stack.PreResolve, Instance: instance}); err != nil {
+		return nil, err
+	}
+	resolved, err := resolve(instance)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Publish(ctx, Event{Phase: stack.PostResolve, Instance: instance, Parameters: resolved}); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// Deployer returns a deployer publishing the deploy and destroy events of d.
+func (b *Bus) Deployer(d Deployer) Deployer {
+	if b == nil {
+		return d
+	}
+	return publishingDeployer{bus: b, deployer: d}
+}
+
+type publishingDeployer struct {
+	bus      *Bus
+	deployer Deployer
+}
+
+func (d publishingDeployer) Deploy(ctx context.Context, instance stack.Instance) error {
+	event := Event{Instance: instance, Parameters: instance.Parameters}
+	err := d.deploy(ctx, event)
+	if err == nil {
+		return nil
+	}
+	event.Phase, event.Err = stack.DeployFailed, err
+	return errors.Join(err, d.bus.Publish(ctx, event))
+}
+
+func (d publishingDeployer) deploy(ctx context.Context, event Event) error {
+	event.Phase = stack.PreDeploy
+	if err := d.bus.Publish(ctx, event); err != nil {
+		return err
+	}
+	if err := d.deployer.Deploy(ctx, event.Instance); err != nil {
+		return err
+	}
+	event.Phase = stack.PostDeploy
+	return d.bus.Publish(ctx, event)
+}
+
+func (d publishingDeployer) Destroy(ctx context.Context, instance stack.Instance) error {
+	event := Event{Phase: stack.PreDestroy, Instance: instance, Parameters: instance.Parameters}
+	if err := d.bus.Publish(ctx, event); err != nil {
+		return err
+	}
+	if err := d.deployer.Destroy(ctx, instance); err != nil {
+		return err
+	}
+	event.Phase = stack.PostDestroy
+	return d.bus.Publish(ctx, event)
+}
+
+// Command runs the commands of hooks and readiness checks declared by stacks. Commands get the same
+// hermetic environment as helmfile built from the event. See EnvBuilder.
+type Command struct {
+	// AllowEnv lists the host environment variables passed to commands. Defaults to
+	// DefaultAllowEnv.
+	AllowEnv []string
+	Stdout   io.Writer
+	Stderr   io.Writer
+}
+
+// Run runs the command of the hook.
+func (c Command) Run(ctx context.Context, hook stack.Hook, event Event) error {
+	instance := event.Instance
+	if event.Parameters != nil {
+		instance.Parameters = event.Parameters
+	}
+	return c.run(ctx, hook.Command, instance)
+}
+
+func (c Command) run(ctx context.Context, command []string, instance stack.Instance) error {
+	if len(command) == 0 {
+		return errors.New("no command given")
+	}
+	allow := c.AllowEnv
+	if allow == nil {
+		allow = DefaultAllowEnv
+	}
+	env, err := EnvBuilder{Allow: allow}.Build(instance)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = env.Environ()
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("command %q failed: %v", command[0], err)
+	}
+	return nil
+}
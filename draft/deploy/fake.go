@@ -0,0 +1,46 @@
+package deploy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/teleivo/providers/stack"
+)
+
+// Fake is a Deployer that does not deploy anything. It records the instances it deployed and
+// destroyed. Set the errors to simulate failing deployments. A Fake is safe for concurrent use.
+type Fake struct {
+	mu sync.Mutex
+	// DeployErr is returned by Deploy for the instances with the given names.
+	DeployErr map[string]error
+	// DestroyErr is returned by Destroy for the instances with the given names.
+	DestroyErr map[string]error
+	Deployed   []stack.Instance
+	Destroyed  []stack.Instance
+}
+
+func (f *Fake) Deploy(ctx context.Context, instance stack.Instance) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := f.DeployErr[instance.Name]; err != nil {
+		return err
+	}
+	f.Deployed = append(f.Deployed, instance)
+	return nil
+}
+
+func (f *Fake) Destroy(ctx context.Context, instance stack.Instance) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := f.DestroyErr[instance.Name]; err != nil {
+		return err
+	}
+	f.Destroyed = append(f.Destroyed, instance)
+	return nil
+}
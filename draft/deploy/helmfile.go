@@ -0,0 +1,115 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/teleivo/providers/stack"
+)
+
+// Helmfile deploys instances using https://github.com/helmfile/helmfile. The instances parameters
+// are passed as environment variables to the stacks helmfile. See EnvBuilder.
+type Helmfile struct {
+	// Bin is the path to the helmfile binary. Defaults to helmfile.
+	Bin string
+	// AllowEnv lists the host environment variables passed to helmfile. Defaults to
+	// DefaultAllowEnv.
+	AllowEnv []string
+	// EnvDir is the directory the environment of every helmfile run is written to as
+	// <instance>.env for debugging if not empty. Sensitive values are redacted.
+	EnvDir string
+	// StateValues passes the instances parameters as a state values file written by WriteValues
+	// using --state-values-file in addition to the environment variables. Parameters keep their
+	// type and are accessible in the helmfile using {{ .StateValues.NAME }}.
+	StateValues bool
+	Stdout      io.Writer
+	Stderr      io.Writer
+}
+
+func (h Helmfile) Deploy(ctx context.Context, instance stack.Instance) error {
+	return h.run(ctx, instance, "sync")
+}
+
+func (h Helmfile) Destroy(ctx context.Context, instance stack.Instance) error {
+	return h.run(ctx, instance, "destroy")
+}
+
+func (h Helmfile) run(ctx context.Context, instance stack.Instance, command string) error {
+	if instance.Stack.File == "" {
+		return fmt.Errorf("stack %q has no helmfile", instance.Stack.Name)
+	}
+	bin := h.Bin
+	if bin == "" {
+		bin = "helmfile"
+	}
+
+	args := []string{"--file", instance.Stack.File}
+	if h.StateValues {
+		file, err := writeValuesFile(instance)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file)
+		args = append(args, "--state-values-file", file)
+	}
+	allow := h.AllowEnv
+	if allow == nil {
+		allow = DefaultAllowEnv
+	}
+	env, err := EnvBuilder{Allow: allow}.Build(instance)
+	if err != nil {
+		return err
+	}
+	if h.EnvDir != "" {
+		if err := writeDotEnvFile(filepath.Join(h.EnvDir, instance.Name+".env"), env); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, bin, append(args, command)...)
+	cmd.Env = env.Environ()
+	cmd.Stdout = h.Stdout
+	cmd.Stderr = h.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("helmfile %s of instance %q failed: %v", command, instance.Name, err)
+	}
+	return nil
+}
+
+// writeValuesFile writes the state values of the instance to a temporary file and returns its path.
+func writeValuesFile(instance stack.Instance) (string, error) {
+	f, err := os.CreateTemp("", instance.Name+"-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("failed to create state values file of instance %q: %v", instance.Name, err)
+	}
+	err = WriteValues(f, instance)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func writeDotEnvFile(file string, env Env) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = env.WriteDotEnv(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write environment to %q: %v", file, err)
+	}
+	return nil
+}
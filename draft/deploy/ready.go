@@ -0,0 +1,140 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/teleivo/providers/stack"
+)
+
+// ErrNotReady is returned if an instance does not become ready in time.
+var ErrNotReady = errors.New("instance not ready")
+
+// Probe checks whether an instance is ready. It returns an error describing why the instance is
+// not ready.
+type Probe interface {
+	Probe(ctx context.Context, instance stack.Instance) error
+}
+
+type ProbeFunc func(ctx context.Context, instance stack.Instance) error
+
+func (p ProbeFunc) Probe(ctx context.Context, instance stack.Instance) error {
+	return p(ctx, instance)
+}
+
+// Defaults of a Gate.
+const (
+	DefaultReadyTimeout     = 5 * time.Minute
+	DefaultReadyInterval    = time.Second
+	DefaultReadyMaxInterval = 30 * time.Second
+)
+
+// Gate waits for deployed instances to become ready so instances requiring them are only deployed
+// once they can be used. Instances are probed with exponential backoff until they are ready or the
+// timeout passes. Dependents are resolved once the instances they require are ready when applying
+// a plan. See Apply.
+type Gate struct {
+	// Probe checks the readiness of every instance. Defaults to running the readiness command
+	// declared by the stack of the instance using Command. Instances of stacks without readiness
+	// check are ready once deployed then.
+	Probe   Probe
+	Command Command
+	// Timeout is the time to wait for an instance unless its stack declares a timeout. Defaults to
+	// DefaultReadyTimeout.
+	Timeout time.Duration
+	// Interval is the time between the first probes. It doubles after every probe up to
+	// MaxInterval. Defaults to DefaultReadyInterval and DefaultReadyMaxInterval.
+	Interval    time.Duration
+	MaxInterval time.Duration
+}
+
+// probe returns the probe of the instance. Returns false if the instance needs no probing.
+func (g Gate) probe(instance stack.Instance) (Probe, bool) {
+	if g.Probe != nil {
+		return g.Probe, true
+	}
+	if instance.Stack.Readiness == nil {
+		return nil, false
+	}
+	return ProbeFunc(func(ctx context.Context, instance stack.Instance) error {
+		return g.Command.run(ctx, instance.Stack.Readiness.Command, instance)
+	}), true
+}
+
+// Wait waits until the instance is ready. Returns an error wrapping ErrNotReady and the last probe
+// error if the instance is not ready in time.
+func (g Gate) Wait(ctx context.Context, instance stack.Instance) error {
+	probe, ok := g.probe(instance)
+	if !ok {
+		return nil
+	}
+	timeout := g.Timeout
+	if timeout <= 0 {
+		timeout = DefaultReadyTimeout
+	}
+	if instance.Stack.Readiness != nil {
+		d, err := instance.Stack.Readiness.TimeoutDuration()
+		if err != nil {
+			return fmt.Errorf("invalid readiness check of stack %q: %v", instance.Stack.Name, err)
+		}
+		if d > 0 {
+			timeout = d
+		}
+	}
+	interval := g.Interval
+	if interval <= 0 {
+		interval = DefaultReadyInterval
+	}
+	maxInterval := g.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = DefaultReadyMaxInterval
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for probes := 1; ; probes++ {
+		err := probe.Probe(probeCtx, instance)
+		if err == nil {
+			return nil
+		}
+
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-probeCtx.Done():
+			timer.Stop()
+			if ctx.Err() != nil {
+				return fmt.Errorf("stopped waiting for instance %q to be ready: %w", instance.Name, ctx.Err())
+			}
+			return fmt.Errorf("instance %q in group %q is not ready after %s and %d probes: %w: %v", instance.Name, instance.Group, timeout, probes, ErrNotReady, err)
+		case <-timer.C:
+		}
+		interval *= 2
+	}
+}
+
+// Deployer returns a deployer waiting for every instance d deployed to be ready. An instance that
+// is not ready in time fails to deploy.
+func (g Gate) Deployer(d Deployer) Deployer {
+	return gatedDeployer{gate: g, deployer: d}
+}
+
+type gatedDeployer struct {
+	gate     Gate
+	deployer Deployer
+}
+
+func (d gatedDeployer) Deploy(ctx context.Context, instance stack.Instance) error {
+	if err := d.deployer.Deploy(ctx, instance); err != nil {
+		return err
+	}
+	return d.gate.Wait(ctx, instance)
+}
+
+func (d gatedDeployer) Destroy(ctx context.Context, instance stack.Instance) error {
+	return d.deployer.Destroy(ctx, instance)
+}
@@ -0,0 +1,223 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/teleivo/providers/instance"
+)
+
+// Strategy decides which instances linked to an expired instance a Reaper destroys with it.
+type Strategy int
+
+const (
+	// DependentsFirst destroys the instances requiring an expired instance before the expired
+	// instance. The instances the expired instance requires are kept.
+	DependentsFirst Strategy = iota
+	// WholeChain destroys an expired instance together with all instances it is linked to either
+	// by requiring them or by being required by them.
+	WholeChain
+)
+
+// Reaper destroys expired instances. See instance.Record.Expires.
+type Reaper struct {
+	Deployer Deployer
+	Store    *instance.Store
+	Strategy Strategy
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (r *Reaper) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+// Reap destroys the expired instances and the instances linked to them according to the strategy.
+// Instances are destroyed after the instances requiring them. Pending instances are still being
+// deployed and are not reaped. Returns the records of the destroyed instances in the order they
+// were destroyed. Instances that fail to be destroyed are marked as failed in the store and the
+// instances they require are kept.
+func (r *Reaper) Reap(ctx context.Context) ([]instance.Record, error) {
+	now := r.now()
+	records := r.Store.List()
+	links := newLinks(records)
+
+	doomed := make(map[ref]struct{})
+	for _, rec := range records {
+		if rec.State == instance.Pending || !rec.Expired(now) {
+			continue
+		}
+		k := refOf(rec)
+		switch r.Strategy {
+		case WholeChain:
+			links.walk(k, doomed, links.requires, links.dependents)
+		default:
+			links.walk(k, doomed, links.dependents)
+		}
+	}
+
+	var destroyed []instance.Record
+	var errs []error
+	remaining := sortedRefs(doomed)
+	for progress := true; progress && len(remaining) > 0; {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		progress = false
+		var blocked []ref
+		for _, k := range remaining {
+			if r.required(k) {
+				blocked = append(blocked, k)
+				continue
+			}
+			rec, ok := r.Store.Get(k.group, k.name)
+			if !ok {
+				continue
+			}
+			progress = true
+			err := Destroy(ctx, r.Deployer, r.Store, k.group, k.name)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			destroyed = append(destroyed, rec)
+		}
+		remaining = blocked
+	}
+	for _, k := range remaining {
+		errs = append(errs, fmt.Errorf("kept expired instance %q in group %q as instances requiring it were not destroyed", k.name, k.group))
+	}
+
+	return destroyed, errors.Join(errs...)
+}
+
+// required reports whether any instance in the store requires the instance.
+func (r *Reaper) required(k ref) bool {
+	for _, other := range r.Store.List() {
+		for _, dest := range other.Instance.Requires {
+			if dest.Group == k.group && dest.Name == k.name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Expiry of an instance.
+type Expiry struct {
+	Group   string    `json:"group"`
+	Name    string    `json:"name"`
+	Stack   string    `json:"stack"`
+	Expires time.Time `json:"expires"`
+	// Remaining is the time left until the instance expires. It is negative if the instance is
+	// expired.
+	Remaining time.Duration `json:"remaining"`
+}
+
+// Upcoming returns the instances expiring within given duration including expired ones sorted by
+// when they expire.
+func (r *Reaper) Upcoming(within time.Duration) []Expiry {
+	now := r.now()
+	var result []Expiry
+	for _, rec := range r.Store.List() {
+		expires, ok := rec.Expires()
+		if !ok || expires.After(now.Add(within)) {
+			continue
+		}
+		result = append(result, Expiry{
+			Group:     rec.Instance.Group,
+			Name:      rec.Instance.Name,
+			Stack:     rec.Instance.Stack.ID(),
+			Expires:   expires,
+			Remaining: expires.Sub(now),
+		})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Expires.Before(result[j].Expires)
+	})
+	return result
+}
+
+// Run reaps every interval until ctx is done. The result of every reap is passed to report if it
+// is not nil.
+func (r *Reaper) Run(ctx context.Context, interval time.Duration, report func([]instance.Record, error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			destroyed, err := r.Reap(ctx)
+			if report != nil {
+				report(destroyed, err)
+			}
+		}
+	}
+}
+
+// ref references an instance by its group and name.
+type ref struct {
+	group string
+	name  string
+}
+
+func refOf(r instance.Record) ref {
+	return ref{group: r.Instance.Group, name: r.Instance.Name}
+}
+
+func sortedRefs(refs map[ref]struct{}) []ref {
+	result := make([]ref, 0, len(refs))
+	for k := range refs {
+		result = append(result, k)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].group != result[j].group {
+			return result[i].group < result[j].group
+		}
+		return result[i].name < result[j].name
+	})
+	return result
+}
+
+// links between instances in both directions.
+type links struct {
+	requires   map[ref][]ref
+	dependents map[ref][]ref
+}
+
+func newLinks(records []instance.Record) links {
+	l := links{
+		requires:   make(map[ref][]ref, len(records)),
+		dependents: make(map[ref][]ref, len(records)),
+	}
+	for _, rec := range records {
+		k := refOf(rec)
+		for _, dest := range rec.Instance.Requires {
+			d := ref{group: dest.Group, name: dest.Name}
+			l.requires[k] = append(l.requires[k], d)
+			l.dependents[d] = append(l.dependents[d], k)
+		}
+	}
+	return l
+}
+
+// walk adds k and all instances reachable from it following given links to visited.
+func (l links) walk(k ref, visited map[ref]struct{}, follow ...map[ref][]ref) {
+	if _, ok := visited[k]; ok {
+		return
+	}
+	visited[k] = struct{}{}
+	for _, edges := range follow {
+		for _, next := range edges[k] {
+			l.walk(next, visited, follow...)
+		}
+	}
+}
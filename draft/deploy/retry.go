@@ -0,0 +1,56 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/teleivo/providers/retry"
+	"github.com/teleivo/providers/stack"
+)
+
+// Retry retries failed deploys and destroys according to the retry policy of the stack of the
+// instance. Instances of stacks without policy are retried according to Policy which does not
+// retry by default. Errors of instances that were attempted more than once are a *retry.Error
+// with the history of all attempts.
+type Retry struct {
+	Policy retry.Policy
+}
+
+func (r Retry) policy(instance stack.Instance) (retry.Policy, error) {
+	if instance.Stack.Retry == nil {
+		return r.Policy, nil
+	}
+	p, err := instance.Stack.Retry.Policy()
+	if err != nil {
+		return retry.Policy{}, fmt.Errorf("stack %q has invalid retry policy: %v", instance.Stack.Name, err)
+	}
+	return p, nil
+}
+
+// Deployer returns a deployer retrying the deploys and destroys of d.
+func (r Retry) Deployer(d Deployer) Deployer {
+	return retryingDeployer{retry: r, deployer: d}
+}
+
+type retryingDeployer struct {
+	retry    Retry
+	deployer Deployer
+}
+
+func (d retryingDeployer) Deploy(ctx context.Context, instance stack.Instance) error {
+	return d.do(ctx, instance, d.deployer.Deploy)
+}
+
+func (d retryingDeployer) Destroy(ctx context.Context, instance stack.Instance) error {
+	return d.do(ctx, instance, d.deployer.Destroy)
+}
+
+func (d retryingDeployer) do(ctx context.Context, instance stack.Instance, fn func(context.Context, stack.Instance) error) error {
+	p, err := d.retry.policy(instance)
+	if err != nil {
+		return err
+	}
+	return p.Do(ctx, func(ctx context.Context) error {
+		return fn(ctx, instance)
+	})
+}
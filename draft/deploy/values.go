@@ -0,0 +1,98 @@
+package deploy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/teleivo/providers/stack"
+)
+
+// WriteValues writes the resolved parameters of the instance as a helmfile state values file in
+// YAML. Parameters are written as top-level keys sorted by name next to the INSTANCE_NAME and
+// INSTANCE_NAMESPACE the Helmfile deployer passes as environment variables as well. Values keep
+// the type of their parameter. Strings are always quoted so values like "true" or "0123" stay
+// strings. Parameters named like the keys set by the instance are errors as they would be
+// overwritten.
+func WriteValues(w io.Writer, instance stack.Instance) error {
+	values := make(map[string]stack.Parameter, len(instance.Parameters)+2)
+	for k, p := range instance.Parameters {
+		values[k] = p
+	}
+	for _, v := range []struct{ name, value string }{
+		{"INSTANCE_NAME", instance.Name},
+		{"INSTANCE_NAMESPACE", instance.Group},
+	} {
+		if _, ok := values[v.name]; ok {
+			return fmt.Errorf("state value %q of instance %q is set by the instance and its parameter", v.name, instance.Name)
+		}
+		values[v.name] = stack.Parameter{Value: v.value}
+	}
+
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# state values of instance %q in group %q of stack %q\n", instance.Name, instance.Group, instance.Stack.ID())
+	for _, k := range names {
+		if !validKey(k) {
+			return fmt.Errorf("parameter %q of instance %q cannot be written as a state value key", k, instance.Name)
+		}
+		v, err := scalar(values[k])
+		if err != nil {
+			return fmt.Errorf("failed to write parameter %q of instance %q: %v", k, instance.Name, err)
+		}
+		fmt.Fprintf(&b, "%s: %s\n", k, v)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// validKey reports whether the key can be written as a plain YAML key and used in helmfile
+// templates like {{ .StateValues.DATABASE_NAME }}.
+func validKey(k string) bool {
+	if k == "" || (k[0] >= '0' && k[0] <= '9') {
+		return false
+	}
+	for _, r := range k {
+		if r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// scalar renders the parameter value as a YAML scalar of the parameters type.
+func scalar(p stack.Parameter) (string, error) {
+	if err := p.Type.Check(p.Value); err != nil {
+		return "", err
+	}
+	switch p.Type {
+	case stack.Int:
+		n, _ := strconv.ParseInt(p.Value, 10, 64)
+		return strconv.FormatInt(n, 10), nil
+	case stack.Bool:
+		v, _ := strconv.ParseBool(p.Value)
+		return strconv.FormatBool(v), nil
+	case stack.Number:
+		f, _ := strconv.ParseFloat(p.Value, 64)
+		if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+			// keep a fraction so YAML does not turn the number into an int
+			return strconv.FormatFloat(f, 'f', 1, 64), nil
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	}
+	if !utf8.ValidString(p.Value) {
+		return "", fmt.Errorf("value is not valid UTF-8")
+	}
+	// the escape sequences of Go are a subset of the ones of YAML double-quoted scalars
+	return strconv.Quote(p.Value), nil
+}
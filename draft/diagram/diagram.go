@@ -0,0 +1,129 @@
+// Package diagram draws https://d2lang.com diagrams of stacks and their instances. Render the
+// diagrams using for example
+//
+//	d2 stacks.d2
+package diagram
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/stack"
+)
+
+// Stacks draws stacks and the stacks they require. Links are labeled with the mappings of consumed
+// parameters.
+func Stacks(w io.Writer, stacks stack.Stacks) error {
+	names := make([]string, 0, len(stacks))
+	for k := range stacks {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	required := make(map[string]struct{})
+	for _, src := range names {
+		for _, dest := range stacks[src].Requires {
+			var err error
+			if label := mappingLabel(stacks[src].Mappings[dest.Name]); label != "" {
+				_, err = fmt.Fprintf(w, "%s -> %s: %q\n", stackKey(src), stackKey(dest.ID()), label)
+			} else {
+				_, err = fmt.Fprintf(w, "%s -> %s\n", stackKey(src), stackKey(dest.ID()))
+			}
+			if err != nil {
+				return err
+			}
+			required[dest.ID()] = struct{}{}
+		}
+	}
+	for _, k := range names {
+		if _, ok := required[k]; !ok {
+			_, err := fmt.Fprintf(w, "%s\n", stackKey(k))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// stackKey returns the d2 key of the stack with given ID. IDs of versioned stacks are quoted as
+// the dots of their version would otherwise nest them.
+func stackKey(id string) string {
+	if strings.ContainsAny(id, ".@") {
+		return fmt.Sprintf("%q", id)
+	}
+	return id
+}
+
+// mappingLabel renders a mapping as one "consumed <- provided" line per consumed parameter.
+func mappingLabel(mapping stack.Mapping) string {
+	names := make([]string, 0, len(mapping))
+	for k := range mapping {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, k := range names {
+		lines = append(lines, k+" <- "+mapping[k])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Instances draws instances grouped by their group. Every instance is labeled with its name, stack
+// and state. Instances are linked to the instances they consume parameters from.
+func Instances(w io.Writer, records []instance.Record) error {
+	groups := make(map[string][]instance.Record)
+	for _, r := range records {
+		groups[r.Instance.Group] = append(groups[r.Instance.Group], r)
+	}
+	names := make([]string, 0, len(groups))
+	for k := range groups {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, group := range names {
+		rs := groups[group]
+		sort.Slice(rs, func(i, j int) bool {
+			return rs[i].Instance.Name < rs[j].Instance.Name
+		})
+
+		_, err := fmt.Fprintf(w, "%q: {\n", group)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			label := fmt.Sprintf("%s (%s)\n%s", r.Instance.Name, r.Instance.Stack.ID(), r.State)
+			_, err := fmt.Fprintf(w, "  %q: %q\n", r.Instance.Name, label)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintln(w, "}")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, group := range names {
+		for _, r := range groups[group] {
+			for _, dest := range r.Instance.Requires {
+				_, err := fmt.Fprintf(w, "%s -> %s\n", instanceID(r.Instance), instanceID(dest))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func instanceID(instance stack.Instance) string {
+	return fmt.Sprintf("%q.%q", instance.Group, instance.Name)
+}
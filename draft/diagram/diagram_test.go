@@ -0,0 +1,73 @@
+package diagram_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/teleivo/providers/diagram"
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/stack"
+)
+
+func TestStacks(t *testing.T) {
+	a := stack.Stack{Name: "a"}
+	b := stack.Stack{Name: "b", Requires: []stack.Stack{a}}
+	c := stack.Stack{Name: "c"}
+	d := stack.Stack{
+		Name:     "d",
+		Requires: []stack.Stack{a},
+		Mappings: map[string]stack.Mapping{
+			"a": {"D_HOST": "A_HOST", "D_NAME": "A_NAME"},
+		},
+	}
+
+	var got strings.Builder
+	err := diagram.Stacks(&got, stack.Stacks{"a": a, "b": b, "c": c, "d": d})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	want := `b -> a
+d -> a: "D_HOST <- A_HOST\nD_NAME <- A_NAME"
+b
+c
+d
+`
+	if diff := cmp.Diff(want, got.String()); diff != "" {
+		t.Errorf("Stacks() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	db := stack.Instance{Name: "mydb", Group: "whoami", Stack: stack.DHIS2DB}
+	core := stack.Instance{Name: "core", Group: "whoami", Stack: stack.DHIS2Core, Requires: []stack.Instance{db}}
+	pgadmin := stack.Instance{Name: "pgadmin", Group: "whoami", Stack: stack.PgAdmin, Requires: []stack.Instance{db}}
+	whoami := stack.Instance{Name: "hello", Group: "play", Stack: stack.WhoamiGo}
+
+	var got strings.Builder
+	err := diagram.Instances(&got, []instance.Record{
+		{Instance: pgadmin, State: instance.Pending},
+		{Instance: db, State: instance.Deployed},
+		{Instance: whoami, State: instance.Failed},
+		{Instance: core, State: instance.Deployed},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	want := `"play": {
+  "hello": "hello (whoami-go)\nfailed"
+}
+"whoami": {
+  "core": "core (dhis2-core)\ndeployed"
+  "mydb": "mydb (dhis2-db)\ndeployed"
+  "pgadmin": "pgadmin (pgadmin)\npending"
+}
+"whoami"."core" -> "whoami"."mydb"
+"whoami"."pgadmin" -> "whoami"."mydb"
+`
+	if diff := cmp.Diff(want, got.String()); diff != "" {
+		t.Errorf("Instances() mismatch (-want +got):\n%s", diff)
+	}
+}
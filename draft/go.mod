@@ -4,4 +4,4 @@ go 1.20
 
 require github.com/dominikbraun/graph v0.16.2
 
-require github.com/google/go-cmp v0.5.9 // indirect
+require github.com/google/go-cmp v0.5.9
@@ -0,0 +1,349 @@
+// Package group makes the groups instances are deployed in first-class. Groups are registered in
+// a Registry which limits the instances deployed in a group and which groups instances may link
+// to. A group name ends up in hostnames like the one of postgres and must therefore be DNS-safe.
+package group
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/stack"
+)
+
+// SizeParameter is the name of the instance parameter setting the size of the database of an
+// instance.
+const SizeParameter = "DATABASE_SIZE"
+
+// AnyGroup allows instances of any group to link to instances of a group. See
+// Group.AllowLinksFrom.
+const AnyGroup = "*"
+
+// Group of instances.
+type Group struct {
+	Name string `json:"name"`
+	// MaxInstances limits the number of instances in the group. Zero means unlimited.
+	MaxInstances int `json:"maxInstances,omitempty"`
+	// MaxDatabaseSize limits the sum of the SizeParameter of all instances in the group. It is a
+	// quantity like 100Gi. Empty means unlimited.
+	MaxDatabaseSize string `json:"maxDatabaseSize,omitempty"`
+	// AllowLinksFrom are the groups whose instances may link to instances of this group. Instances
+	// may only link to instances of their own group by default.
+	AllowLinksFrom []string `json:"allowLinksFrom,omitempty"`
+}
+
+// allowsLinkFrom reports whether instances of given group may link to instances of this group.
+func (g Group) allowsLinkFrom(group string) bool {
+	if group == g.Name {
+		return true
+	}
+	for _, allowed := range g.AllowLinksFrom {
+		if allowed == AnyGroup || allowed == group {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// ErrUnknownGroup is returned for instances of groups that are not registered.
+	ErrUnknownGroup = errors.New("unknown group")
+	// ErrLinkNotAllowed is returned for instances linking to instances of another group that does
+	// not allow it.
+	ErrLinkNotAllowed = errors.New("link to another group not allowed")
+	// ErrQuotaExceeded is returned if deploying instances would exceed the limits of their group.
+	ErrQuotaExceeded = errors.New("group quota exceeded")
+)
+
+// dnsLabel matches RFC 1123 DNS labels.
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// ValidateName validates that the group name is a DNS label as defined in RFC 1123. The name must
+// consist of at most 63 lower case alphanumeric characters or '-' and must start and end with an
+// alphanumeric character.
+func ValidateName(name string) error {
+	if name == "" {
+		return errors.New("group name must not be empty")
+	}
+	if len(name) > 63 {
+		return fmt.Errorf("group name %q must be at most 63 characters long", name)
+	}
+	if !dnsLabel.MatchString(name) {
+		return fmt.Errorf("group name %q must consist of lower case alphanumeric characters or '-' and must start and end with an alphanumeric character", name)
+	}
+	return nil
+}
+
+// quantitySuffixes are the multipliers of the supported quantity suffixes.
+var quantitySuffixes = map[string]int64{
+	"":   1,
+	"k":  1000,
+	"M":  1000 * 1000,
+	"G":  1000 * 1000 * 1000,
+	"T":  1000 * 1000 * 1000 * 1000,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// ParseQuantity parses a size in bytes given as a quantity like 20Gi or 500M the way Kubernetes
+// does. Only integer quantities are supported.
+func ParseQuantity(value string) (int64, error) {
+	i := strings.IndexFunc(value, func(r rune) bool { return r < '0' || r > '9' })
+	if i == -1 {
+		i = len(value)
+	}
+	number, suffix := value[:i], value[i:]
+	multiplier, ok := quantitySuffixes[suffix]
+	if number == "" || !ok {
+		return 0, fmt.Errorf("invalid quantity %q: must be a number with an optional suffix like 20Gi", value)
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid quantity %q: out of range", value)
+	}
+	return n * multiplier, nil
+}
+
+// databaseSize returns the size set by the SizeParameter of the instance. Instances consuming the
+// size from another instance do not count.
+func databaseSize(inst stack.Instance) (int64, error) {
+	p, ok := inst.Parameters[SizeParameter]
+	if !ok || p.Consumed || p.Value == "" {
+		return 0, nil
+	}
+	size, err := ParseQuantity(p.Value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s of instance %q: %v", SizeParameter, inst.Name, err)
+	}
+	return size, nil
+}
+
+// Registry of groups. A Registry is safe for concurrent use.
+type Registry struct {
+	mu     sync.RWMutex
+	groups map[string]Group
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		groups: make(map[string]Group),
+	}
+}
+
+// Register registers the group. Group names must be valid and unique.
+func (r *Registry) Register(g Group) error {
+	if err := ValidateName(g.Name); err != nil {
+		return err
+	}
+	if g.MaxInstances < 0 {
+		return fmt.Errorf("max instances of group %q must not be negative", g.Name)
+	}
+	if g.MaxDatabaseSize != "" {
+		if _, err := ParseQuantity(g.MaxDatabaseSize); err != nil {
+			return fmt.Errorf("invalid max database size of group %q: %v", g.Name, err)
+		}
+	}
+	for _, allowed := range g.AllowLinksFrom {
+		if allowed == AnyGroup {
+			continue
+		}
+		if err := ValidateName(allowed); err != nil {
+			return fmt.Errorf("invalid group allowed to link to group %q: %v", g.Name, err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.groups[g.Name]; ok {
+		return fmt.Errorf("group %q is already registered", g.Name)
+	}
+	r.groups[g.Name] = g
+	return nil
+}
+
+// Get returns the group of given name.
+func (r *Registry) Get(name string) (Group, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	g, ok := r.groups[name]
+	return g, ok
+}
+
+// List returns all groups sorted by name.
+func (r *Registry) List() []Group {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make([]Group, 0, len(r.groups))
+	for _, g := range r.groups {
+		result = append(result, g)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func (r *Registry) group(name string) (Group, error) {
+	g, ok := r.Get(name)
+	if !ok {
+		return Group{}, fmt.Errorf("group %q: %w", name, ErrUnknownGroup)
+	}
+	return g, nil
+}
+
+// Check checks that the group of the instance is registered and that the instance only links to
+// instances of groups allowing it.
+func (r *Registry) Check(inst stack.Instance) error {
+	if _, err := r.group(inst.Group); err != nil {
+		return fmt.Errorf("invalid instance %q: %w", inst.Name, err)
+	}
+	var errs []error
+	for _, dest := range inst.Requires {
+		g, err := r.group(dest.Group)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid instance %q linking to instance %q: %w", inst.Name, dest.Name, err))
+			continue
+		}
+		if !g.allowsLinkFrom(inst.Group) {
+			errs = append(errs, fmt.Errorf("instance %q in group %q must not link to instance %q in group %q: %w", inst.Name, inst.Group, dest.Name, dest.Group, ErrLinkNotAllowed))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Resolve checks the instance like Check does and resolves its parameters using
+// stack.ResolveContext.
+func (r *Registry) Resolve(ctx context.Context, inst stack.Instance) (map[string]stack.Parameter, error) {
+	if err := r.Check(inst); err != nil {
+		return nil, err
+	}
+	return stack.ResolveContext(ctx, inst)
+}
+
+// Usage of a group.
+type Usage struct {
+	Instances int `json:"instances"`
+	// DatabaseSize is the sum of the database sizes of all instances in bytes.
+	DatabaseSize int64 `json:"databaseSize"`
+}
+
+func (u *Usage) add(inst stack.Instance) error {
+	size, err := databaseSize(inst)
+	if err != nil {
+		return err
+	}
+	u.Instances++
+	u.DatabaseSize += size
+	return nil
+}
+
+// Usage returns the usage of the group by the instances in the store. Destroyed instances do not
+// count.
+func (r *Registry) Usage(store *instance.Store, name string) (Usage, error) {
+	if _, err := r.group(name); err != nil {
+		return Usage{}, err
+	}
+	var u Usage
+	for _, rec := range store.Group(name) {
+		if rec.State == instance.Destroyed {
+			continue
+		}
+		if err := u.add(rec.Instance); err != nil {
+			return Usage{}, err
+		}
+	}
+	return u, nil
+}
+
+// Admit checks that deploying the instances next to the ones in the store does not exceed the
+// limits of their groups. Instances replace the ones of the same name and group in the store.
+func (r *Registry) Admit(store *instance.Store, instances ...stack.Instance) error {
+	planned := make(map[string][]stack.Instance)
+	for _, inst := range instances {
+		planned[inst.Group] = append(planned[inst.Group], inst)
+	}
+	names := make([]string, 0, len(planned))
+	for name := range planned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		g, err := r.group(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := admit(g, store, planned[name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func admit(g Group, store *instance.Store, instances []stack.Instance) error {
+	replaced := make(map[string]struct{}, len(instances))
+	var u Usage
+	for _, inst := range instances {
+		replaced[inst.Name] = struct{}{}
+		if err := u.add(inst); err != nil {
+			return err
+		}
+	}
+	for _, rec := range store.Group(g.Name) {
+		if _, ok := replaced[rec.Instance.Name]; ok || rec.State == instance.Destroyed {
+			continue
+		}
+		if err := u.add(rec.Instance); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	if g.MaxInstances > 0 && u.Instances > g.MaxInstances {
+		errs = append(errs, fmt.Errorf("group %q would have %d instances exceeding its limit of %d: %w", g.Name, u.Instances, g.MaxInstances, ErrQuotaExceeded))
+	}
+	if g.MaxDatabaseSize != "" {
+		max, _ := ParseQuantity(g.MaxDatabaseSize)
+		if u.DatabaseSize > max {
+			errs = append(errs, fmt.Errorf("group %q would have a total %s of %d bytes exceeding its limit of %s: %w", g.Name, SizeParameter, u.DatabaseSize, g.MaxDatabaseSize, ErrQuotaExceeded))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Read reads a registry of groups from JSON like {"groups": [{"name": "whoami"}]}.
+func Read(r io.Reader) (*Registry, error) {
+	var file struct {
+		Groups []Group `json:"groups"`
+	}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to decode groups: %v", err)
+	}
+
+	registry := NewRegistry()
+	var errs []error
+	for _, g := range file.Groups {
+		if err := registry.Register(g); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
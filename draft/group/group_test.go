@@ -0,0 +1,235 @@
+package group_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/teleivo/providers/group"
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/stack"
+)
+
+func newRegistry(t *testing.T, groups ...group.Group) *group.Registry {
+	t.Helper()
+
+	r := group.NewRegistry()
+	for _, g := range groups {
+		if err := r.Register(g); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	return r
+}
+
+func database(name, grp, size string) stack.Instance {
+	return stack.Instance{
+		Name:       name,
+		Group:      grp,
+		Stack:      stack.DHIS2DB,
+		Parameters: map[string]stack.Parameter{group.SizeParameter: {Value: size}},
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	t.Run("Register", func(t *testing.T) {
+		r := newRegistry(t, group.Group{Name: "whoami"}, group.Group{Name: "dev-1", MaxInstances: 3, MaxDatabaseSize: "50Gi"})
+
+		got := r.List()
+
+		want := []group.Group{{Name: "dev-1", MaxInstances: 3, MaxDatabaseSize: "50Gi"}, {Name: "whoami"}}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("List() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenInvalidGroup", func(t *testing.T) {
+		tests := []struct {
+			group group.Group
+			want  string
+		}{
+			{group: group.Group{}, want: "group name must not be empty"},
+			{group: group.Group{Name: "Dev"}, want: `group name "Dev" must consist of lower case alphanumeric characters`},
+			{group: group.Group{Name: "dev_1"}, want: `group name "dev_1" must consist of lower case alphanumeric characters`},
+			{group: group.Group{Name: "-dev"}, want: `group name "-dev" must consist of lower case alphanumeric characters`},
+			{group: group.Group{Name: strings.Repeat("a", 64)}, want: "must be at most 63 characters long"},
+			{group: group.Group{Name: "dev", MaxInstances: -1}, want: `max instances of group "dev" must not be negative`},
+			{group: group.Group{Name: "dev", MaxDatabaseSize: "lots"}, want: `invalid quantity "lots"`},
+			{group: group.Group{Name: "dev", AllowLinksFrom: []string{"Prod"}}, want: `group name "Prod"`},
+			{group: group.Group{Name: "whoami"}, want: `group "whoami" is already registered`},
+		}
+
+		for _, tc := range tests {
+			r := newRegistry(t, group.Group{Name: "whoami"})
+
+			err := r.Register(tc.group)
+			if err == nil {
+				t.Fatalf("expected error for %+v got none", tc.group)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", tc.want, err.Error())
+			}
+		}
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		r, err := group.Read(strings.NewReader(`{"groups": [{"name": "shared", "allowLinksFrom": ["*"]}, {"name": "dev", "maxInstances": 2}]}`))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := []group.Group{{Name: "dev", MaxInstances: 2}, {Name: "shared", AllowLinksFrom: []string{"*"}}}
+		if diff := cmp.Diff(want, r.List()); diff != "" {
+			t.Errorf("Read() mismatch (-want +got):\n%s", diff)
+		}
+
+		_, err = group.Read(strings.NewReader(`{"groups": [{"name": "Dev"}, {"name": "dev", "maxDatabaseSize": "1Xi"}]}`))
+		if err == nil {
+			t.Fatal("expected error got none")
+		}
+		for _, want := range []string{`group name "Dev"`, `invalid quantity "1Xi"`} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+}
+
+func TestParseQuantity(t *testing.T) {
+	tests := map[string]int64{
+		"0":    0,
+		"512":  512,
+		"20Gi": 20 << 30,
+		"500M": 500 * 1000 * 1000,
+		"1Ti":  1 << 40,
+		"2k":   2000,
+	}
+	for in, want := range tests {
+		got, err := group.ParseQuantity(in)
+		if err != nil {
+			t.Fatalf("unexpected error for %q %v", in, err)
+		}
+		if got != want {
+			t.Errorf("ParseQuantity(%q) want %d, instead got %d", in, want, got)
+		}
+	}
+
+	for _, in := range []string{"", "Gi", "1.5Gi", "-1", "20GB", "99999999999Ti"} {
+		if _, err := group.ParseQuantity(in); err == nil {
+			t.Errorf("expected error for %q got none", in)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	r := newRegistry(t,
+		group.Group{Name: "dev"},
+		group.Group{Name: "qa"},
+		group.Group{Name: "shared", AllowLinksFrom: []string{"dev"}},
+	)
+
+	t.Run("LinkWithinGroup", func(t *testing.T) {
+		db := database("db", "dev", "20Gi")
+		core := stack.Instance{Name: "core", Group: "dev", Stack: stack.DHIS2Core, Requires: []stack.Instance{db}}
+
+		if err := r.Check(core); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("LinkToGroupAllowingIt", func(t *testing.T) {
+		db := database("db", "shared", "20Gi")
+		core := stack.Instance{Name: "core", Group: "dev", Stack: stack.DHIS2Core, Requires: []stack.Instance{db}}
+
+		if err := r.Check(core); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("FailLinkingToOtherGroup", func(t *testing.T) {
+		db := database("db", "shared", "20Gi")
+		core := stack.Instance{Name: "core", Group: "qa", Stack: stack.DHIS2Core, Requires: []stack.Instance{db}}
+
+		_, err := r.Resolve(context.Background(), core)
+		if !errors.Is(err, group.ErrLinkNotAllowed) {
+			t.Fatalf("want error %v, instead got %v", group.ErrLinkNotAllowed, err)
+		}
+		want := `instance "core" in group "qa" must not link to instance "db" in group "shared"`
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("FailGivenUnknownGroup", func(t *testing.T) {
+		_, err := r.Resolve(context.Background(), database("db", "prod", "20Gi"))
+
+		if !errors.Is(err, group.ErrUnknownGroup) {
+			t.Fatalf("want error %v, instead got %v", group.ErrUnknownGroup, err)
+		}
+		want := `invalid instance "db": group "prod": unknown group`
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+}
+
+func TestAdmit(t *testing.T) {
+	r := newRegistry(t,
+		group.Group{Name: "dev", MaxInstances: 2, MaxDatabaseSize: "50Gi"},
+		group.Group{Name: "qa"},
+	)
+	store := instance.NewStore()
+	err := store.Save(instance.Record{Instance: database("db", "dev", "30Gi"), State: instance.Deployed})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	t.Run("WithinLimits", func(t *testing.T) {
+		err := r.Admit(store, database("other", "dev", "20Gi"), database("db", "qa", "1Ti"))
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+
+		u, err := r.Usage(store, "dev")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if diff := cmp.Diff(group.Usage{Instances: 1, DatabaseSize: 30 << 30}, u); diff != "" {
+			t.Errorf("Usage() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ReplaceInstance", func(t *testing.T) {
+		err := r.Admit(store, database("db", "dev", "50Gi"))
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("FailExceedingLimits", func(t *testing.T) {
+		err := r.Admit(store, database("other", "dev", "21Gi"), database("more", "dev", "0"))
+
+		if !errors.Is(err, group.ErrQuotaExceeded) {
+			t.Fatalf("want error %v, instead got %v", group.ErrQuotaExceeded, err)
+		}
+		for _, want := range []string{
+			`group "dev" would have 3 instances exceeding its limit of 2`,
+			`group "dev" would have a total DATABASE_SIZE of 54760833024 bytes exceeding its limit of 50Gi`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+
+	t.Run("FailGivenInvalidSize", func(t *testing.T) {
+		err := r.Admit(store, database("other", "dev", "big"))
+
+		want := `invalid DATABASE_SIZE of instance "other"`
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain '%s', instead got '%v'", want, err)
+		}
+	})
+}
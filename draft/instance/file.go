@@ -0,0 +1,126 @@
+package instance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/teleivo/providers/stack"
+)
+
+// fileRecord is the JSON representation of a record. Stacks and linked instances are referenced
+// by name as stacks contain providers which cannot be encoded.
+type fileRecord struct {
+	Name       string                     `json:"name"`
+	Group      string                     `json:"group"`
+	Stack      string                     `json:"stack"`
+	Parameters map[string]stack.Parameter `json:"parameters,omitempty"`
+	Requires   []fileRef                  `json:"requires,omitempty"`
+	State      State                      `json:"state"`
+	Created    time.Time                  `json:"created,omitempty"`
+	// TTL is encoded as a duration like 24h0m0s. It is omitted if the instance never expires.
+	TTL string `json:"ttl,omitempty"`
+}
+
+type fileRef struct {
+	Name  string `json:"name"`
+	Group string `json:"group"`
+}
+
+// Write writes all records as JSON.
+func (s *Store) Write(w io.Writer) error {
+	records := s.List()
+	result := make([]fileRecord, 0, len(records))
+	for _, r := range records {
+		fr := fileRecord{
+			Name:       r.Instance.Name,
+			Group:      r.Instance.Group,
+			Stack:      r.Instance.Stack.ID(),
+			Parameters: r.Instance.Parameters,
+			State:      r.State,
+			Created:    r.Created,
+		}
+		if r.TTL > 0 {
+			fr.TTL = r.TTL.String()
+		}
+		for _, dest := range r.Instance.Requires {
+			fr.Requires = append(fr.Requires, fileRef{Name: dest.Name, Group: dest.Group})
+		}
+		result = append(result, fr)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+// Read reads records written by Store.Write into a new store. Stacks are looked up by name in
+// given stacks.
+func Read(r io.Reader, stacks stack.Stacks) (*Store, error) {
+	var frs []fileRecord
+	err := json.NewDecoder(r).Decode(&frs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode instances: %v", err)
+	}
+
+	byKey := make(map[key]fileRecord, len(frs))
+	for _, fr := range frs {
+		byKey[key{group: fr.Group, name: fr.Name}] = fr
+	}
+
+	s := NewStore()
+	resolved := make(map[key]stack.Instance, len(frs))
+	var resolve func(k key, visiting map[key]struct{}) (stack.Instance, error)
+	resolve = func(k key, visiting map[key]struct{}) (stack.Instance, error) {
+		if inst, ok := resolved[k]; ok {
+			return inst, nil
+		}
+		if _, ok := visiting[k]; ok {
+			return stack.Instance{}, fmt.Errorf("instance %q in group %q requires itself", k.name, k.group)
+		}
+		visiting[k] = struct{}{}
+
+		fr, ok := byKey[k]
+		if !ok {
+			return stack.Instance{}, fmt.Errorf("instance %q in group %q does not exist", k.name, k.group)
+		}
+		st, ok := stacks[fr.Stack]
+		if !ok {
+			return stack.Instance{}, fmt.Errorf("instance %q in group %q is of unknown stack %q", k.name, k.group, fr.Stack)
+		}
+		inst := stack.Instance{
+			Name:       fr.Name,
+			Group:      fr.Group,
+			Stack:      st,
+			Parameters: fr.Parameters,
+		}
+		for _, ref := range fr.Requires {
+			dest, err := resolve(key{group: ref.Group, name: ref.Name}, visiting)
+			if err != nil {
+				return stack.Instance{}, err
+			}
+			inst.Requires = append(inst.Requires, dest)
+		}
+		resolved[k] = inst
+		return inst, nil
+	}
+
+	for _, fr := range frs {
+		k := key{group: fr.Group, name: fr.Name}
+		inst, err := resolve(k, make(map[key]struct{}))
+		if err != nil {
+			return nil, err
+		}
+		ttl, err := ParseTTL(fr.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("instance %q in group %q: %v", fr.Name, fr.Group, err)
+		}
+		err = s.Save(Record{Instance: inst, State: fr.State, Created: fr.Created, TTL: ttl})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
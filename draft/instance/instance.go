@@ -0,0 +1,206 @@
+// Package instance keeps track of deployed stack instances. Instances are identified by their name
+// within their group as that is what makes them unique in a cluster. See for example the hostname
+// pattern used by postgres which combines the instance name and group.
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/teleivo/providers/stack"
+)
+
+// State of an instance.
+type State string
+
+const (
+	Pending   State = "pending"
+	Deployed  State = "deployed"
+	Failed    State = "failed"
+	Destroyed State = "destroyed"
+)
+
+// Record of a stack instance and its state.
+type Record struct {
+	Instance stack.Instance
+	State    State
+	// Created is when the instance was first saved.
+	Created time.Time
+	// TTL is how long the instance lives counted from its creation. Instances with a zero TTL
+	// never expire.
+	TTL time.Duration
+}
+
+// Expires returns when the instance expires. Returns false if the instance never expires.
+func (r Record) Expires() (time.Time, bool) {
+	if r.TTL <= 0 {
+		return time.Time{}, false
+	}
+	return r.Created.Add(r.TTL), true
+}
+
+// Expired reports whether the instance is expired at given time.
+func (r Record) Expired(now time.Time) bool {
+	expires, ok := r.Expires()
+	return ok && !now.Before(expires)
+}
+
+// TTLParameter is the name of the instance parameter setting the TTL of an instance.
+const TTLParameter = "INSTANCE_TTL"
+
+// ParseTTL parses the TTL of an instance given either as a number of seconds like 3600 or as a
+// duration like 1h. The empty TTL means the instance never expires.
+func ParseTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	var ttl time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		ttl = time.Duration(seconds) * time.Second
+	} else {
+		ttl, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid TTL %q: must be seconds or a duration like 24h", value)
+		}
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("invalid TTL %q: must not be negative", value)
+	}
+	return ttl, nil
+}
+
+// InstanceTTL returns the TTL set by the TTLParameter of the instance.
+func InstanceTTL(inst stack.Instance) (time.Duration, error) {
+	return ParseTTL(inst.Parameters[TTLParameter].Value)
+}
+
+// Store of instance records. A Store is safe for concurrent use.
+type Store struct {
+	// Now returns the current time records are created at. Defaults to time.Now. It must be set
+	// before the store is used.
+	Now func() time.Time
+
+	mu      sync.RWMutex
+	records map[key]Record
+}
+
+type key struct {
+	group string
+	name  string
+}
+
+// NewStore creates an empty store.
+func NewStore() *Store {
+	return &Store{
+		records: make(map[key]Record),
+	}
+}
+
+func (s *Store) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+// Save creates or updates the record of an instance. Records without creation time keep the one of
+// the record they update or are created now.
+func (s *Store) Save(r Record) error {
+	if r.Instance.Name == "" {
+		return fmt.Errorf("instance of stack %q must have a name", r.Instance.Stack.Name)
+	}
+	if r.Instance.Group == "" {
+		return fmt.Errorf("instance %q must have a group", r.Instance.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key{group: r.Instance.Group, name: r.Instance.Name}
+	if r.Created.IsZero() {
+		if prev, ok := s.records[k]; ok {
+			r.Created = prev.Created
+		} else {
+			r.Created = s.now()
+		}
+	}
+	s.records[k] = r
+	return nil
+}
+
+// ErrNoTTL is returned when extending the TTL of an instance that never expires.
+var ErrNoTTL = errors.New("instance has no TTL")
+
+// Extend extends the TTL of instance name in given group by d.
+func (s *Store) Extend(group, name string, d time.Duration) (Record, error) {
+	if d <= 0 {
+		return Record{}, fmt.Errorf("TTL of instance %q must be extended by a positive duration instead of %s", name, d)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key{group: group, name: name}
+	r, ok := s.records[k]
+	if !ok {
+		return Record{}, fmt.Errorf("instance %q does not exist in group %q", name, group)
+	}
+	if r.TTL <= 0 {
+		return Record{}, fmt.Errorf("failed to extend instance %q in group %q: %w", name, group, ErrNoTTL)
+	}
+	r.TTL += d
+	s.records[k] = r
+	return r, nil
+}
+
+// Get returns the record of instance name in given group.
+func (s *Store) Get(group, name string) (Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.records[key{group: group, name: name}]
+	return r, ok
+}
+
+// Delete removes the record of instance name in given group.
+func (s *Store) Delete(group, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key{group: group, name: name})
+}
+
+// List returns all records sorted by group and name.
+func (s *Store) List() []Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]Record, 0, len(s.records))
+	for _, r := range s.records {
+		result = append(result, r)
+	}
+	sortRecords(result)
+	return result
+}
+
+// Group returns all records of given group sorted by name.
+func (s *Store) Group(group string) []Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []Record
+	for k, r := range s.records {
+		if k.group == group {
+			result = append(result, r)
+		}
+	}
+	sortRecords(result)
+	return result
+}
+
+func sortRecords(records []Record) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Instance.Group != records[j].Instance.Group {
+			return records[i].Instance.Group < records[j].Instance.Group
+		}
+		return records[i].Instance.Name < records[j].Instance.Name
+	})
+}
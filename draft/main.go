@@ -1,58 +1,74 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
-	"sort"
 	"strings"
 
-	"github.com/dominikbraun/graph"
+	"github.com/teleivo/providers/diagram"
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/picker"
 	"github.com/teleivo/providers/stack"
 )
 
 func main() {
-	if err := run(); err != nil {
+	if err := run(os.Args[1:]); err != nil {
 		fmt.Printf("exit due to error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
-	stacks, err := stack.New(
-		stack.DHIS2Core,
-		stack.DHIS2DB,
-		stack.PgAdmin,
-		stack.DHIS2,
-		stack.WhoamiGo,
-	)
+func run(args []string) error {
+	flags := flag.NewFlagSet("providers", flag.ContinueOnError)
+	names := flags.String("stacks", "", "comma separated names of stacks to select a chain from without prompting")
+	chainFile := flags.String("chain-file", "", "path to a JSON chain spec to select a chain from without prompting")
+	format := flags.String("format", "text", "output format of the selected chain: text or json")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	stacks, err := stack.Default()
 	if err != nil {
 		return fmt.Errorf("failed creating IM stacks: %v", err)
 	}
 
+	if *names != "" || *chainFile != "" {
+		return selectChain(os.Stdout, stacks, *names, *chainFile, *format)
+	}
+
 	err = drawStacks(stacks)
 	if err != nil {
 		return fmt.Errorf("failed drawing IM stack diagram: %v", err)
 	}
 
 	fmt.Println()
-	chain, err := pickChain(stacks)
+	chain, err := picker.New(os.Stdin, os.Stdout, stacks).Pick()
 	if err != nil {
 		return err
 	}
 
 	fmt.Println()
-	err = deploy(chain)
+	err = deploy(chain.Chain)
 	if err != nil {
 		return fmt.Errorf("failed deploying chain %v: %v", chain, err)
 	}
 
 	fmt.Println()
-	err = deployDHIS2Core()
+	instances := instance.NewStore()
+	err = deployDHIS2Core(instances)
 	if err != nil {
 		return fmt.Errorf("failed deploying dhis2-core: %v", err)
 	}
 
+	err = drawInstances(instances)
+	if err != nil {
+		return fmt.Errorf("failed drawing IM instance diagram: %v", err)
+	}
+
 	return nil
 }
 
@@ -63,125 +79,71 @@ func drawStacks(stacks stack.Stacks) error {
 	}
 	defer f.Close()
 
-	required := make(map[string]struct{})
-	for src, v := range stacks {
-		for _, dest := range v.Requires {
-			fmt.Fprintf(f, "%s -> %s\n", src, dest.Name)
-			required[dest.Name] = struct{}{}
-		}
-	}
-	for k := range stacks {
-		if _, ok := required[k]; !ok {
-			fmt.Fprintf(f, "%s\n", k)
-		}
+	err = diagram.Stacks(f, stacks)
+	if err != nil {
+		return err
 	}
 	fmt.Printf("created https://d2lang.com diagram of IM stacks in %q\n", f.Name())
 
 	return nil
 }
 
-// pickChain is a sketch of chained deployments guiding users in selecting stacks.
-// On every selection we automatically pick the required stacks and topologically sort them.
-func pickChain(stacks stack.Stacks) ([]stack.Stack, error) {
-	g := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
-
-	opts := make([]stack.Stack, 0, len(stacks))
-	for _, s := range stacks {
-		opts = append(opts, s)
+func drawInstances(instances *instance.Store) error {
+	f, err := os.Create("instances.d2")
+	if err != nil {
+		return err
 	}
-	sort.Slice(opts, func(i, j int) bool {
-		return opts[i].Name < opts[j].Name
-	})
-	var chainOrder []string
-
-	fmt.Println("Pick a stack chain to deploy")
-	for len(opts) > 0 {
-		fmt.Print("Pick one of ")
-		fmt.Print(renderOptions(opts))
-		fmt.Print(": ")
-
-		n, err := readNumber()
-		if err != nil || n >= len(opts) {
-			fmt.Println("Please choose one of the stacks")
-			continue
-		}
+	defer f.Close()
 
-		opt := opts[n]
-		opts = removeByIdx(opts, n)
-		err = g.AddVertex(opt.Name)
-		if err != nil && !errors.Is(err, graph.ErrVertexAlreadyExists) {
-			return nil, fmt.Errorf("failed adding vertex %q: %v", opt.Name, err)
-		}
-		for _, dest := range opt.Requires {
-			opts = removeByName(opts, dest.Name)
-			err := g.AddVertex(dest.Name)
-			if err != nil && !errors.Is(err, graph.ErrVertexAlreadyExists) {
-				return nil, fmt.Errorf("failed adding vertex %q: %v", dest.Name, err)
-			}
-			err = g.AddEdge(dest.Name, opt.Name)
-			if err != nil && !errors.Is(err, graph.ErrEdgeAlreadyExists) {
-				return nil, fmt.Errorf("failed adding edge %q -> %q to chain: %v", dest.Name, opt.Name, err)
-			}
-		}
+	err = diagram.Instances(f, instances.List())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created https://d2lang.com diagram of IM instances in %q\n", f.Name())
 
-		chainOrder, err = graph.TopologicalSort(g)
-		if err != nil {
-			return nil, fmt.Errorf("failed topological sort stack chain: %v", err)
-		}
-		fmt.Printf("Current stack chain in deployment order: %v\n", chainOrder)
+	return nil
+}
 
-		if len(opts) > 0 {
-			fmt.Print("Enter 0 to deploy stack|any other number to continue picking stacks: ")
-			n, err = readNumber()
-			if err != nil {
-				fmt.Println("Please choose one of the stacks")
-				continue
-			}
-			if n == 0 {
-				break
-			}
-		}
+// selectChain selects a chain from given comma separated stack names or a chain spec file without
+// prompting the user. The chain is printed in deployment order.
+func selectChain(w io.Writer, stacks stack.Stacks, names, chainFile, format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %q, must be one of text or json", format)
 	}
 
-	chain := make([]stack.Stack, 0, len(chainOrder))
-	for _, s := range chainOrder {
-		chain = append(chain, stacks[s])
+	var spec stack.ChainSpec
+	if names != "" {
+		spec.Stacks = append(spec.Stacks, strings.Split(names, ",")...)
 	}
-	return chain, nil
-}
-
-func renderOptions(stacks []stack.Stack) string {
-	var opts strings.Builder
-	for i, s := range stacks {
-		opts.WriteString(fmt.Sprintf("%d) %q", i, s.Name))
-		if i < len(stacks)-1 {
-			opts.WriteString(" ")
+	if chainFile != "" {
+		f, err := os.Open(chainFile)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		fileSpec, err := stack.ReadChainSpec(f)
+		if err != nil {
+			return fmt.Errorf("failed reading chain spec %q: %v", chainFile, err)
+		}
+		spec.Stacks = append(spec.Stacks, fileSpec.Stacks...)
 	}
-	return opts.String()
-}
 
-func readNumber() (int, error) {
-	var choice int
-	_, err := fmt.Scanf("%d", &choice)
+	chain, err := stacks.Chain(spec.Stacks...)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse number: %v", err)
+		return fmt.Errorf("failed selecting stack chain: %v", err)
 	}
-	return choice, nil
-}
 
-func removeByIdx(stacks []stack.Stack, i int) []stack.Stack {
-	return append(stacks[:i], stacks[i+1:]...)
-}
-
-func removeByName(stacks []stack.Stack, name string) []stack.Stack {
-	for i, s := range stacks {
-		if s.Name == name {
-			return removeByIdx(stacks, i)
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		return enc.Encode(stack.ChainSpec{Stacks: chain.IDs()})
+	}
+	for _, name := range chain.IDs() {
+		_, err := fmt.Fprintln(w, name)
+		if err != nil {
+			return err
 		}
 	}
-
-	return stacks
+	return nil
 }
 
 func deploy(chain []stack.Stack) error {
@@ -202,7 +164,7 @@ func deploy(chain []stack.Stack) error {
 
 // deployDHIS2Core is a sketch of how it could look like when deploying dhis2-core linked to dhis2-db
 // it shows consumed parameters and multiple variables/patterns previously only hostname pattern.
-func deployDHIS2Core() error {
+func deployDHIS2Core(instances *instance.Store) error {
 	// right now users provide the linked instance from which to consume
 	// so imagine a user deploying an instance of dhis2-core linking to dhis2DBInstance
 	source := stack.Instance{
@@ -225,42 +187,24 @@ func deployDHIS2Core() error {
 		},
 	}
 
+	target := stack.Instance{
+		Name:     "core",
+		Group:    source.Group,
+		Stack:    stack.DHIS2Core,
+		Requires: []stack.Instance{source},
+	}
 	// resolve parameters using source instance and target stack
-	targetParams := make(map[string]stack.Parameter, len(stack.DHIS2Core.Parameters))
-	for k, p := range stack.DHIS2Core.Parameters {
-		if !p.Consumed {
-			targetParams[k] = stack.Parameter{
-				Value: p.Value,
-			}
-			continue
-		}
-
-		// find parameter on the source instance parameters first
-		if param, ok := source.Parameters[k]; ok {
-			targetParams[k] = stack.Parameter{
-				Value:    param.Value,
-				Consumed: true,
-			}
-			continue
-		}
-
-		// find parameter on the source parameter providers next
-		p, ok := source.Stack.Providers[k]
-		if !ok {
-			return fmt.Errorf("source stack %q cannot provide parameter %q", source.Stack.Name, k)
-		}
-
-		v, err := p.Provide(source)
-		if err != nil {
-			return fmt.Errorf("failed to evaluate parameter %q using source stack %q", k, source.Stack.Name)
-		}
-		targetParams[k] = stack.Parameter{
-			Value:    v,
-			Consumed: true,
-		}
+	targetParams, err := stack.Resolve(target)
+	if err != nil {
+		return err
 	}
+	target.Parameters = targetParams
 
 	fmt.Printf("deploying %q linked to %q(%s) with parameters %#v\n", "dhis-core", source.Name, source.Stack.Name, targetParams)
 
-	return nil
+	err = instances.Save(instance.Record{Instance: source, State: instance.Deployed})
+	if err != nil {
+		return err
+	}
+	return instances.Save(instance.Record{Instance: target, State: instance.Deployed})
 }
@@ -0,0 +1,238 @@
+// Package picker guides users in interactively picking a chain of stacks to deploy. On every pick we
+// automatically add the required stacks and keep the chain in topological order.
+package picker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/teleivo/providers/stack"
+)
+
+// ErrAborted is returned if the user quits picking a chain.
+var ErrAborted = errors.New("picking stack chain aborted")
+
+// Picker reads the users choices from a reader and writes prompts to a writer.
+type Picker struct {
+	in     *bufio.Scanner
+	out    io.Writer
+	stacks stack.Stacks
+	// selected are the stacks picked by the user. Stacks required by them are not part of selected
+	// so they can be removed once no selected stack needs them anymore.
+	selected []string
+}
+
+// New creates a picker for picking a chain out of stacks.
+func New(r io.Reader, w io.Writer, stacks stack.Stacks) *Picker {
+	return &Picker{
+		in:     bufio.NewScanner(r),
+		out:    w,
+		stacks: stacks,
+	}
+}
+
+// Pick prompts the user until the user confirms a chain. Returns ErrAborted if the user quits.
+func (p *Picker) Pick() (*stack.Chain, error) {
+	p.printf("Pick a stack chain to deploy\n")
+	for {
+		chain, err := p.chain()
+		if err != nil && len(p.selected) > 0 {
+			// the last pick cannot be chained with the stacks picked before like when their
+			// version constraints conflict
+			p.printf("Cannot pick %q: %v\n", p.selected[len(p.selected)-1], err)
+			p.selected = p.selected[:len(p.selected)-1]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		opts := p.options(chain)
+
+		p.printf("Current stack chain in deployment order: %v\n", chain.Names())
+		if len(opts) > 0 {
+			p.printf("Stacks:\n")
+			for i, s := range opts {
+				p.printf("  %d) %s\n", i, describe(s))
+			}
+		}
+		p.printf("Pick a stack by number, remove one using \"r <name>\", \"d\" when done or \"q\" to quit: ")
+
+		line, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case line == "q":
+			return nil, ErrAborted
+		case line == "d":
+			if len(chain.Chain) == 0 {
+				p.printf("Please pick at least one stack\n")
+				continue
+			}
+			ok, err := p.confirm(chain)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return chain, nil
+			}
+		case strings.HasPrefix(line, "r "):
+			p.remove(chain, strings.TrimSpace(strings.TrimPrefix(line, "r ")))
+		default:
+			n, err := strconv.Atoi(line)
+			if err != nil || n < 0 || n >= len(opts) {
+				p.printf("Please choose one of the stacks\n")
+				continue
+			}
+			p.selected = append(p.selected, opts[n].Name)
+		}
+	}
+}
+
+// chain creates the chain of the selected stacks and their required stacks. The latest versions
+// of the stacks meeting the constraints of the stacks requiring them are picked.
+func (p *Picker) chain() (*stack.Chain, error) {
+	if len(p.selected) == 0 {
+		return stack.NewChain()
+	}
+	chain, err := p.stacks.Chain(p.selected...)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating stack chain: %v", err)
+	}
+	return chain, nil
+}
+
+// options returns the latest version of every stack that is not yet part of the chain sorted by
+// name.
+func (p *Picker) options(chain *stack.Chain) []stack.Stack {
+	inChain := make(map[string]struct{}, len(chain.Chain))
+	for _, s := range chain.Chain {
+		inChain[s.Name] = struct{}{}
+	}
+
+	latest := make(map[string]stack.Stack, len(p.stacks))
+	for _, s := range p.stacks {
+		if _, ok := inChain[s.Name]; ok {
+			continue
+		}
+		if _, ok := latest[s.Name]; !ok {
+			latest[s.Name] = p.stacks.Versions(s.Name)[0]
+		}
+	}
+	opts := make([]stack.Stack, 0, len(latest))
+	for _, s := range latest {
+		opts = append(opts, s)
+	}
+	sort.Slice(opts, func(i, j int) bool {
+		return opts[i].Name < opts[j].Name
+	})
+	return opts
+}
+
+// remove removes a selected stack from the chain. Stacks it required are removed as well unless
+// another selected stack still requires them.
+func (p *Picker) remove(chain *stack.Chain, name string) {
+	for i, s := range p.selected {
+		if s == name {
+			p.selected = append(p.selected[:i:i], p.selected[i+1:]...)
+			return
+		}
+	}
+
+	var dependents []string
+	for _, s := range chain.Chain {
+		for _, dest := range s.Requires {
+			if dest.Name == name {
+				dependents = append(dependents, s.Name)
+			}
+		}
+	}
+	if len(dependents) > 0 {
+		p.printf("Cannot remove %q as it is required by %v\n", name, dependents)
+		return
+	}
+	p.printf("Stack %q is not part of the chain\n", name)
+}
+
+func (p *Picker) confirm(chain *stack.Chain) (bool, error) {
+	p.printf("Stack chain in deployment order:\n")
+	for _, s := range chain.Chain {
+		p.printf("  %s\n", describe(s))
+	}
+	p.printf("Deploy this chain? [y/n]: ")
+
+	line, err := p.readLine()
+	if err != nil {
+		return false, err
+	}
+	return line == "y" || line == "yes", nil
+}
+
+func (p *Picker) readLine() (string, error) {
+	if !p.in.Scan() {
+		if err := p.in.Err(); err != nil {
+			return "", fmt.Errorf("failed reading choice: %v", err)
+		}
+		return "", fmt.Errorf("failed reading choice: %w", io.ErrUnexpectedEOF)
+	}
+	return strings.TrimSpace(p.in.Text()), nil
+}
+
+func (p *Picker) printf(format string, a ...any) {
+	fmt.Fprintf(p.out, format, a...)
+}
+
+// describe renders the ID of a stack with the parameters a user needs to provide, the
+// parameters it provides and the stacks it requires.
+func describe(s stack.Stack) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("%q", s.ID()))
+	var parts []string
+	if params := userParameters(s); len(params) > 0 {
+		parts = append(parts, "parameters: "+strings.Join(params, ", "))
+	}
+	if providers := sortedKeys(s.Providers); len(providers) > 0 {
+		parts = append(parts, "provides: "+strings.Join(providers, ", "))
+	}
+	if len(s.Requires) > 0 {
+		requires := make([]string, 0, len(s.Requires))
+		for _, r := range s.Requires {
+			requires = append(requires, r.Name)
+		}
+		parts = append(parts, "requires: "+strings.Join(requires, ", "))
+	}
+	if len(parts) > 0 {
+		b.WriteString(" (")
+		b.WriteString(strings.Join(parts, "; "))
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// userParameters returns the sorted names of parameters a user needs to provide. These are neither
+// consumed nor do they have a default value.
+func userParameters(s stack.Stack) []string {
+	var result []string
+	for k, p := range s.Parameters {
+		if !p.Consumed && p.Value == "" {
+			result = append(result, k)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func sortedKeys(providers map[string]stack.Provider) []string {
+	result := make([]string, 0, len(providers))
+	for k := range providers {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
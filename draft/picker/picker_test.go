@@ -0,0 +1,167 @@
+package picker_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/teleivo/providers/picker"
+	"github.com/teleivo/providers/stack"
+)
+
+func TestPick(t *testing.T) {
+	stacks, err := stack.New(stack.DHIS2Core, stack.DHIS2DB, stack.PgAdmin, stack.DHIS2, stack.WhoamiGo)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tests := map[string]struct {
+		input string
+		want  []string
+	}{
+		// options are sorted by name: 0) dhis2 1) dhis2-core 2) dhis2-db 3) pgadmin 4) whoami-go
+		"PickStackWithRequiredStack": {
+			input: "1\nd\ny\n",
+			want:  []string{"dhis2-db", "dhis2-core"},
+		},
+		"PickMultipleStacks": {
+			// after picking dhis2-core the options are 0) dhis2 1) pgadmin 2) whoami-go
+			input: "1\n1\nd\ny\n",
+			want:  []string{"dhis2-db", "dhis2-core", "pgadmin"},
+		},
+		"RemoveStackAlsoRemovesNoLongerRequiredStacks": {
+			input: "1\nr dhis2-core\n4\nd\ny\n",
+			want:  []string{"whoami-go"},
+		},
+		"RemoveStackKeepsStillRequiredStacks": {
+			input: "1\n1\nr dhis2-core\nd\ny\n",
+			want:  []string{"dhis2-db", "pgadmin"},
+		},
+		"ContinuePickingAfterDeclining": {
+			input: "4\nd\nn\n0\nd\ny\n",
+			want:  []string{"whoami-go", "dhis2"},
+		},
+		"IgnoreInvalidChoices": {
+			input: "foo\n42\nd\n4\nd\ny\n",
+			want:  []string{"whoami-go"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out strings.Builder
+			p := picker.New(strings.NewReader(tc.input), &out, stacks)
+
+			chain, err := p.Pick()
+			if err != nil {
+				t.Fatalf("unexpected error %v, output:\n%s", err, out.String())
+			}
+
+			if diff := cmp.Diff(tc.want, chain.Names()); diff != "" {
+				t.Errorf("Pick() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("RefuseRemovingStillRequiredStack", func(t *testing.T) {
+		var out strings.Builder
+		p := picker.New(strings.NewReader("1\nr dhis2-db\nd\ny\n"), &out, stacks)
+
+		chain, err := p.Pick()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if diff := cmp.Diff([]string{"dhis2-db", "dhis2-core"}, chain.Names()); diff != "" {
+			t.Errorf("Pick() mismatch (-want +got):\n%s", diff)
+		}
+		if want := `Cannot remove "dhis2-db" as it is required by [dhis2-core]`; !strings.Contains(out.String(), want) {
+			t.Errorf("want output to contain '%s', instead got '%s'", want, out.String())
+		}
+	})
+
+	t.Run("ShowParametersAndProviders", func(t *testing.T) {
+		var out strings.Builder
+		p := picker.New(strings.NewReader("q\n"), &out, stacks)
+
+		_, err := p.Pick()
+		if !errors.Is(err, picker.ErrAborted) {
+			t.Fatalf("want error %v, instead got %v", picker.ErrAborted, err)
+		}
+
+		want := `2) "dhis2-db" (parameters: DATABASE_ID, DATABASE_NAME, DATABASE_PASSWORD, DATABASE_USERNAME; provides: DATABASE_GREETING, DATABASE_HOSTNAME, DATABASE_JDBC_URL)`
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want output to contain '%s', instead got '%s'", want, out.String())
+		}
+		want = `3) "pgadmin" (parameters: PGADMIN_PASSWORD, PGADMIN_USERNAME; requires: dhis2-db)`
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want output to contain '%s', instead got '%s'", want, out.String())
+		}
+	})
+
+	t.Run("PickLatestVersion", func(t *testing.T) {
+		versioned, err := stack.New(
+			stack.Stack{Name: "a", Version: "1.0.0"},
+			stack.Stack{Name: "a", Version: "2.0.0"},
+			stack.Stack{Name: "b"},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var out strings.Builder
+		p := picker.New(strings.NewReader("0\nd\ny\n"), &out, versioned)
+
+		chain, err := p.Pick()
+		if err != nil {
+			t.Fatalf("unexpected error %v, output:\n%s", err, out.String())
+		}
+
+		if diff := cmp.Diff([]string{"a@2.0.0"}, chain.IDs()); diff != "" {
+			t.Errorf("Pick() mismatch (-want +got):\n%s", diff)
+		}
+		want := "Stacks:\n  0) \"a@2.0.0\"\n  1) \"b\"\n"
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want output to contain '%s', instead got '%s'", want, out.String())
+		}
+	})
+
+	t.Run("DropPickThatCannotBeChained", func(t *testing.T) {
+		c1 := stack.Stack{Name: "c", Version: "1.0.0"}
+		c2 := stack.Stack{Name: "c", Version: "2.0.0"}
+		conflicting, err := stack.New(
+			stack.Stack{Name: "a", Requires: []stack.Stack{c1}, Constraints: map[string]string{"c": "^1"}},
+			stack.Stack{Name: "b", Requires: []stack.Stack{c2}, Constraints: map[string]string{"c": "^2"}},
+			c1,
+			c2,
+		)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var out strings.Builder
+		// after picking a the options are 0) b
+		p := picker.New(strings.NewReader("0\n0\nd\ny\n"), &out, conflicting)
+
+		chain, err := p.Pick()
+		if err != nil {
+			t.Fatalf("unexpected error %v, output:\n%s", err, out.String())
+		}
+
+		if diff := cmp.Diff([]string{"c@1.0.0", "a"}, chain.IDs()); diff != "" {
+			t.Errorf("Pick() mismatch (-want +got):\n%s", diff)
+		}
+		if want := `Cannot pick "b"`; !strings.Contains(out.String(), want) {
+			t.Errorf("want output to contain '%s', instead got '%s'", want, out.String())
+		}
+	})
+
+	t.Run("FailGivenEndOfInput", func(t *testing.T) {
+		p := picker.New(strings.NewReader("1\n"), io.Discard, stacks)
+
+		_, err := p.Pick()
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("want error %v, instead got %v", io.ErrUnexpectedEOF, err)
+		}
+	})
+}
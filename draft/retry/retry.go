@@ -0,0 +1,193 @@
+// Package retry retries operations that fail due to transient errors like a flaky network or an
+// overloaded cluster. Operations are retried with exponential backoff and jitter according to a
+// Policy. The errors of all attempts are kept so the history of a failed operation can be
+// inspected.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Defaults of a Policy.
+const (
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// Policy decides how often and when a failed operation is retried. The zero value makes a single
+// attempt.
+type Policy struct {
+	// MaxAttempts is the maximum number of attempts including the first one.
+	MaxAttempts int
+	// Backoff is the wait before the first retry. It doubles after every retry up to MaxBackoff.
+	// Defaults to DefaultBackoff and DefaultMaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction between 0 and 1 of the backoff that is randomly subtracted from it so
+	// that operations failing together are not retried together.
+	Jitter float64
+	// Retryable reports whether an error is transient. All errors are retryable if nil. Errors
+	// marked using Permanent and context errors are never retried.
+	Retryable func(error) bool
+}
+
+// Validate validates the policy.
+func (p Policy) Validate() error {
+	var errs []error
+	if p.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("max attempts must not be negative, instead got %d", p.MaxAttempts))
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		errs = append(errs, errors.New("backoff must not be negative"))
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		errs = append(errs, fmt.Errorf("jitter must be between 0 and 1, instead got %g", p.Jitter))
+	}
+	return errors.Join(errs...)
+}
+
+// OnMessages returns a Retryable func treating errors as transient if their message contains any
+// of the given substrings.
+func OnMessages(substrings ...string) func(error) bool {
+	return func(err error) bool {
+		msg := err.Error()
+		for _, s := range substrings {
+			if strings.Contains(msg, s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Permanent marks the error as not retryable.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func (p Policy) retryable(err error) bool {
+	var permanent permanentError
+	if errors.As(err, &permanent) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// backoff returns the wait before the retry following given attempt. r is a random number in [0, 1).
+func (p Policy) backoff(attempt int, r float64) time.Duration {
+	wait := p.Backoff
+	if wait <= 0 {
+		wait = DefaultBackoff
+	}
+	maxWait := p.MaxBackoff
+	if maxWait <= 0 {
+		maxWait = DefaultMaxBackoff
+	}
+	for i := 1; i < attempt && wait < maxWait; i++ {
+		wait *= 2
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	return wait - time.Duration(p.Jitter*r*float64(wait))
+}
+
+// Attempt of an operation.
+type Attempt struct {
+	// Wait is the time waited before the attempt.
+	Wait time.Duration
+	Err  error
+}
+
+// Error is returned if an operation failed after more than one attempt or was given up because its
+// context was done.
+type Error struct {
+	// Attempts in the order they were made.
+	Attempts []Attempt
+	// Cause is the error of the context if the operation was given up because the context was
+	// done.
+	Cause error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	attempts := "attempts"
+	if len(e.Attempts) == 1 {
+		attempts = "attempt"
+	}
+	fmt.Fprintf(&b, "failed after %d %s", len(e.Attempts), attempts)
+	if e.Cause != nil {
+		fmt.Fprintf(&b, " and gave up: %v", e.Cause)
+	}
+	for i, a := range e.Attempts {
+		if a.Wait > 0 {
+			fmt.Fprintf(&b, "\nattempt %d after %s: %v", i+1, a.Wait, a.Err)
+		} else {
+			fmt.Fprintf(&b, "\nattempt %d: %v", i+1, a.Err)
+		}
+	}
+	return b.String()
+}
+
+// Unwrap returns the errors of all attempts and the cause.
+func (e *Error) Unwrap() []error {
+	result := make([]error, 0, len(e.Attempts)+1)
+	for _, a := range e.Attempts {
+		result = append(result, a.Err)
+	}
+	if e.Cause != nil {
+		result = append(result, e.Cause)
+	}
+	return result
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable, the attempts are used
+// up or ctx is done. Returns the error of fn if it was called once without being given up on and an
+// *Error with the history of all attempts otherwise.
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	var attempts []Attempt
+	var wait time.Duration
+	for n := 1; ; n++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		attempts = append(attempts, Attempt{Wait: wait, Err: err})
+		if n >= p.MaxAttempts || !p.retryable(err) {
+			break
+		}
+
+		wait = p.backoff(n, rand.Float64())
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &Error{Attempts: attempts, Cause: ctx.Err()}
+		case <-timer.C:
+		}
+	}
+	if len(attempts) == 1 {
+		return attempts[0].Err
+	}
+	return &Error{Attempts: attempts}
+}
@@ -0,0 +1,147 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/teleivo/providers/retry"
+)
+
+// failing returns an operation failing with "boom <call>" for the given number of calls.
+func failing(calls int) (func(context.Context) error, *int) {
+	var n int
+	return func(context.Context) error {
+		n++
+		if n <= calls {
+			return fmt.Errorf("boom %d", n)
+		}
+		return nil
+	}, &n
+}
+
+func TestPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("SucceedAfterRetries", func(t *testing.T) {
+		fn, calls := failing(2)
+
+		err := retry.Policy{MaxAttempts: 3, Backoff: time.Millisecond}.Do(ctx, fn)
+
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if *calls != 3 {
+			t.Errorf("want 3 calls, instead got %d", *calls)
+		}
+	})
+
+	t.Run("ReturnHistoryGivenExhaustedAttempts", func(t *testing.T) {
+		fn, _ := failing(5)
+
+		err := retry.Policy{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}.Do(ctx, fn)
+
+		var retryErr *retry.Error
+		if !errors.As(err, &retryErr) {
+			t.Fatalf("want error of type %T, instead got %v", retryErr, err)
+		}
+		var got []time.Duration
+		for _, a := range retryErr.Attempts {
+			got = append(got, a.Wait)
+		}
+		if diff := cmp.Diff([]time.Duration{0, time.Millisecond, 2 * time.Millisecond}, got); diff != "" {
+			t.Errorf("waits mismatch (-want +got):\n%s", diff)
+		}
+		want := "failed after 3 attempts\nattempt 1: boom 1\nattempt 2 after 1ms: boom 2\nattempt 3 after 2ms: boom 3"
+		if err.Error() != want {
+			t.Errorf("want error '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("JitterBackoff", func(t *testing.T) {
+		fn, _ := failing(5)
+		backoff := 4 * time.Millisecond
+
+		err := retry.Policy{MaxAttempts: 4, Backoff: backoff, MaxBackoff: backoff, Jitter: 0.5}.Do(ctx, fn)
+
+		var retryErr *retry.Error
+		if !errors.As(err, &retryErr) {
+			t.Fatalf("want error of type %T, instead got %v", retryErr, err)
+		}
+		for _, a := range retryErr.Attempts[1:] {
+			if a.Wait < backoff/2 || a.Wait > backoff {
+				t.Errorf("want wait between %s and %s, instead got %s", backoff/2, backoff, a.Wait)
+			}
+		}
+	})
+
+	t.Run("StopGivenErrorThatIsNotRetryable", func(t *testing.T) {
+		tests := map[string]struct {
+			policy retry.Policy
+			err    error
+		}{
+			"NotMatchingMessages": {
+				policy: retry.Policy{MaxAttempts: 3, Retryable: retry.OnMessages("timeout", "connection refused")},
+				err:    errors.New("permission denied"),
+			},
+			"Permanent": {
+				policy: retry.Policy{MaxAttempts: 3},
+				err:    retry.Permanent(errors.New("invalid chart")),
+			},
+		}
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				var calls int
+				err := tc.policy.Do(ctx, func(context.Context) error {
+					calls++
+					return tc.err
+				})
+
+				if !errors.Is(err, tc.err) {
+					t.Errorf("want error %v, instead got %v", tc.err, err)
+				}
+				if calls != 1 {
+					t.Errorf("want 1 call, instead got %d", calls)
+				}
+			})
+		}
+	})
+
+	t.Run("StopGivenCancelledContext", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		err := retry.Policy{MaxAttempts: 3, Backoff: time.Hour}.Do(ctx, func(context.Context) error {
+			cancel()
+			return errors.New("timeout")
+		})
+
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("want error %v, instead got %v", context.Canceled, err)
+		}
+		if want := "failed after 1 attempt and gave up: context canceled\nattempt 1: timeout"; err.Error() != want {
+			t.Errorf("want error '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		err := retry.Policy{MaxAttempts: -1, Backoff: -time.Second, Jitter: 2}.Validate()
+
+		if err == nil {
+			t.Fatal("expected error got none")
+		}
+		for _, want := range []string{
+			"max attempts must not be negative",
+			"backoff must not be negative",
+			"jitter must be between 0 and 1",
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+}
@@ -0,0 +1,614 @@
+// Package server serves stacks, chain planning and instance deployment over HTTP. See
+// openapi.yaml for a description of the API.
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teleivo/providers/audit"
+	"github.com/teleivo/providers/deploy"
+	"github.com/teleivo/providers/group"
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/stack"
+)
+
+//go:embed openapi.yaml
+var openAPI []byte
+
+// Server handles HTTP requests. Create one using New.
+type Server struct {
+	// stacks are snapshotted once per request so reloading them does not affect requests in flight.
+	stacks   *stack.Registry
+	store    *instance.Store
+	deployer deploy.Deployer
+	// groups restricts the groups instances are deployed in if not nil.
+	groups *group.Registry
+	// audit records plans, deploys and destroys if not nil.
+	audit *audit.Log
+	// events publishes lifecycle events if not nil.
+	events *deploy.Bus
+	// mu serializes reserving instances.
+	mu  sync.Mutex
+	mux *http.ServeMux
+}
+
+// New creates a server deploying instances of stacks using the deployer. Instances are recorded in
+// the store.
+func New(stacks stack.Stacks, store *instance.Store, deployer deploy.Deployer) *Server {
+	s := &Server{
+		stacks:   stack.NewRegistry(stacks),
+		store:    store,
+		deployer: deployer,
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/openapi.yaml", s.handleOpenAPI)
+	s.mux.HandleFunc("/stacks", s.handleStacks)
+	s.mux.HandleFunc("/stacks/", s.handleStack)
+	s.mux.HandleFunc("/chains", s.handleChains)
+	s.mux.HandleFunc("/instances", s.handleInstances)
+	s.mux.HandleFunc("/instances/resolve", s.handleResolve)
+	s.mux.HandleFunc("/instances/", s.handleInstance)
+	s.mux.HandleFunc("/groups", s.handleGroups)
+	s.mux.HandleFunc("/reload", s.handleReload)
+	return s
+}
+
+// WithRegistry serves the stacks of the registry instead of the stacks given to New. Reloading the
+// registry changes the stacks of new requests while requests in flight keep the stacks they
+// started with.
+func (s *Server) WithRegistry(registry *stack.Registry) *Server {
+	s.stacks = registry
+	return s
+}
+
+// WithGroups restricts the groups instances are deployed in to the ones in the registry. Instances
+// of unknown groups are rejected, links across groups are refused unless allowed and the limits of
+// every group are enforced.
+func (s *Server) WithGroups(groups *group.Registry) *Server {
+	s.groups = groups
+	return s
+}
+
+// ActorHeader is the request header naming the actor recorded in the audit log.
+const ActorHeader = "X-Actor"
+
+// WithAudit records resolved instances as plans and every deploy and destroy in the audit log. The
+// actor is taken from the ActorHeader and is anonymous if it is not set.
+func (s *Server) WithAudit(log *audit.Log) *Server {
+	s.audit = log
+	return s
+}
+
+// WithEvents publishes the lifecycle events of resolving, deploying and destroying instances on
+// the bus. Failing hooks fail the request.
+func (s *Server) WithEvents(bus *deploy.Bus) *Server {
+	s.events = bus
+	return s
+}
+
+// deployerFor returns the deployer publishing lifecycle events and recording in the audit log on
+// behalf of the actor of the request if the server audits.
+func (s *Server) deployerFor(r *http.Request) deploy.Deployer {
+	return s.deployerAs(s.recorder(r))
+}
+
+func (s *Server) deployerAs(rec audit.Recorder) deploy.Deployer {
+	d := s.events.Deployer(s.deployer)
+	if s.audit == nil {
+		return d
+	}
+	return rec.Deployer(d, s.store)
+}
+
+func (s *Server) recorder(r *http.Request) audit.Recorder {
+	actor := r.Header.Get(ActorHeader)
+	if actor == "" {
+		actor = "anonymous"
+	}
+	return audit.Recorder{Log: s.audit, Actor: actor}
+}
+
+// Reaper returns a reaper destroying the expired instances of the server. Instances are destroyed
+// like on requests publishing lifecycle events and recording in the audit log on behalf of actor.
+func (s *Server) Reaper(actor string) *deploy.Reaper {
+	return &deploy.Reaper{
+		Deployer: s.deployerAs(audit.Recorder{Log: s.audit, Actor: actor}),
+		Store:    s.store,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Error is the body of every error response.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details lists the individual errors if multiple errors occurred.
+	Details []string `json:"details,omitempty"`
+	// Issues lists the individual validation errors with their structured details. It is only set
+	// for errors with code invalid.
+	Issues []stack.Issue `json:"issues,omitempty"`
+}
+
+// Error codes.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeInvalid          = "invalid"
+	CodeConflict         = "conflict"
+	CodeDeployFailed     = "deploy_failed"
+	CodeQuotaExceeded    = "quota_exceeded"
+	CodeInternal         = "internal"
+	CodeHookFailed       = "hook_failed"
+)
+
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	body := Error{Code: code, Message: err.Error()}
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		for _, e := range joined.Unwrap() {
+			body.Details = append(body.Details, e.Error())
+		}
+	}
+	if code == CodeInvalid {
+		body.Issues = stack.Issues(err)
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	return false
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Errorf("failed to decode request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(openAPI)
+}
+
+// Stack describes a stack and the schema of its parameters.
+type Stack struct {
+	Name       string      `json:"name"`
+	Version    string      `json:"version,omitempty"`
+	Parameters []Parameter `json:"parameters"`
+	Providers  []string    `json:"providers"`
+	// Requires lists the IDs of the required stacks. See stack.Stack.ID.
+	Requires []string `json:"requires"`
+	// Constraints on the versions of required stacks by the name of the required stack.
+	Constraints map[string]string `json:"constraints,omitempty"`
+}
+
+// Parameter describes a stack parameter.
+type Parameter struct {
+	Name     string `json:"name"`
+	Default  string `json:"default,omitempty"`
+	Consumed bool   `json:"consumed"`
+	// Origin is the name of the stack originally providing a consumed parameter.
+	Origin   string `json:"origin,omitempty"`
+	Required bool   `json:"required"`
+	// Type of the parameter value. See stack.Type.
+	Type      stack.Type `json:"type,omitempty"`
+	Sensitive bool       `json:"sensitive,omitempty"`
+}
+
+func toStack(s stack.Stack) Stack {
+	result := Stack{
+		Name:        s.Name,
+		Version:     s.Version,
+		Parameters:  make([]Parameter, 0, len(s.Parameters)),
+		Providers:   make([]string, 0, len(s.Providers)),
+		Requires:    make([]string, 0, len(s.Requires)),
+		Constraints: s.Constraints,
+	}
+	for k, p := range s.Parameters {
+		param := Parameter{
+			Name:      k,
+			Default:   p.Value,
+			Consumed:  p.Consumed,
+			Required:  !p.Consumed && p.Value == "",
+			Type:      p.Type,
+			Sensitive: p.Sensitive,
+		}
+		if p.Consumed {
+			if origin, _, err := s.Origin(k); err == nil {
+				param.Origin = origin.Name
+			}
+		}
+		result.Parameters = append(result.Parameters, param)
+	}
+	sort.Slice(result.Parameters, func(i, j int) bool {
+		return result.Parameters[i].Name < result.Parameters[j].Name
+	})
+	for k := range s.Providers {
+		result.Providers = append(result.Providers, k)
+	}
+	sort.Strings(result.Providers)
+	for _, r := range s.Requires {
+		result.Requires = append(result.Requires, r.ID())
+	}
+	return result
+}
+
+func (s *Server) handleStacks(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	stacks := s.stacks.Stacks()
+	names := make([]string, 0, len(stacks))
+	for k := range stacks {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	result := make([]Stack, 0, len(names))
+	for _, name := range names {
+		result = append(result, toStack(stacks[name]))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleStack(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	st, err := s.stacks.Stacks().Get(strings.TrimPrefix(r.URL.Path, "/stacks/"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toStack(st))
+}
+
+func (s *Server) handleChains(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var spec stack.ChainSpec
+	if !decode(w, r, &spec) {
+		return
+	}
+	chain, err := s.stacks.Stacks().Chain(spec.Stacks...)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalid, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stack.ChainSpec{Stacks: chain.IDs()})
+}
+
+// InstanceRequest requests resolving or deploying an instance.
+type InstanceRequest struct {
+	Name  string `json:"name"`
+	Group string `json:"group"`
+	Stack string `json:"stack"`
+	// Parameters set by the user.
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// Requires links the instance to these existing instances to consume parameters from.
+	Requires []InstanceRef `json:"requires,omitempty"`
+}
+
+// InstanceRef references an instance by its name and group.
+type InstanceRef struct {
+	Name  string `json:"name"`
+	Group string `json:"group"`
+}
+
+// Instance is a resolved instance.
+type Instance struct {
+	Name  string `json:"name"`
+	Group string `json:"group"`
+	Stack string `json:"stack"`
+	// Parameters are the resolved parameters. Values of sensitive parameters are redacted. See
+	// deploy.Sensitive.
+	Parameters map[string]stack.Parameter `json:"parameters"`
+	Requires   []InstanceRef              `json:"requires,omitempty"`
+	State      instance.State             `json:"state,omitempty"`
+	// Expires is when the instance expires. It is omitted if the instance never expires.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func toInstance(r instance.Record) Instance {
+	result := Instance{
+		Name:       r.Instance.Name,
+		Group:      r.Instance.Group,
+		Stack:      r.Instance.Stack.ID(),
+		Parameters: make(map[string]stack.Parameter, len(r.Instance.Parameters)),
+		State:      r.State,
+	}
+	for k, p := range r.Instance.Parameters {
+		if deploy.Sensitive(k, p) {
+			p.Value = deploy.Redacted
+		}
+		result.Parameters[k] = p
+	}
+	for _, dest := range r.Instance.Requires {
+		result.Requires = append(result.Requires, InstanceRef{Name: dest.Name, Group: dest.Group})
+	}
+	if expires, ok := r.Expires(); ok {
+		result.Expires = &expires
+	}
+	return result
+}
+
+// resolve resolves the requested instance. Writes an error response and returns false if the
+// instance cannot be resolved.
+func (s *Server) resolve(ctx context.Context, w http.ResponseWriter, req InstanceRequest) (stack.Instance, bool) {
+	if req.Name == "" || req.Group == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, errors.New("name and group are required"))
+		return stack.Instance{}, false
+	}
+	st, err := s.stacks.Stacks().Get(req.Stack)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalid, err)
+		return stack.Instance{}, false
+	}
+
+	inst := stack.Instance{
+		Name:       req.Name,
+		Group:      req.Group,
+		Stack:      st,
+		Parameters: make(map[string]stack.Parameter, len(req.Parameters)),
+	}
+	for k, v := range req.Parameters {
+		inst.Parameters[k] = stack.Parameter{Value: v}
+	}
+	for _, ref := range req.Requires {
+		dest, ok := s.store.Get(ref.Group, ref.Name)
+		if !ok {
+			writeError(w, http.StatusUnprocessableEntity, CodeInvalid, fmt.Errorf("linked instance %q does not exist in group %q", ref.Name, ref.Group))
+			return stack.Instance{}, false
+		}
+		if dest.State != instance.Deployed {
+			writeError(w, http.StatusUnprocessableEntity, CodeInvalid, fmt.Errorf("linked instance %q in group %q is %s", ref.Name, ref.Group, dest.State))
+			return stack.Instance{}, false
+		}
+		inst.Requires = append(inst.Requires, dest.Instance)
+	}
+
+	resolve := func(inst stack.Instance) (map[string]stack.Parameter, error) {
+		if s.groups != nil {
+			return s.groups.Resolve(ctx, inst)
+		}
+		return stack.ResolveContext(ctx, inst)
+	}
+	params, err := s.events.Resolve(ctx, inst, resolve)
+	if errors.Is(err, deploy.ErrHookFailed) {
+		writeError(w, http.StatusBadGateway, CodeHookFailed, err)
+		return stack.Instance{}, false
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalid, err)
+		return stack.Instance{}, false
+	}
+	inst.Parameters = params
+	if _, err := instance.InstanceTTL(inst); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalid, err)
+		return stack.Instance{}, false
+	}
+	return inst, true
+}
+
+func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req InstanceRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	inst, ok := s.resolve(r.Context(), w, req)
+	if !ok {
+		return
+	}
+	if s.audit != nil {
+		err := s.recorder(r).Plan(deploy.Plan{Group: inst.Group, Instances: []stack.Instance{inst}}, s.store)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, toInstance(instance.Record{Instance: inst}))
+}
+
+func (s *Server) handleInstances(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		records := s.store.List()
+		result := make([]Instance, 0, len(records))
+		for _, rec := range records {
+			result = append(result, toInstance(rec))
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	var req InstanceRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if _, ok := s.store.Get(req.Group, req.Name); ok {
+		writeError(w, http.StatusConflict, CodeConflict, fmt.Errorf("instance %q already exists in group %q", req.Name, req.Group))
+		return
+	}
+	inst, ok := s.resolve(r.Context(), w, req)
+	if !ok {
+		return
+	}
+	// the deployer records the reserved instance as a new one
+	d := s.deployerFor(r)
+	if !s.reserve(w, inst) {
+		return
+	}
+
+	err := deploy.Apply(r.Context(), d, s.store, deploy.Plan{Group: inst.Group, Instances: []stack.Instance{inst}})
+	if err != nil {
+		writeError(w, http.StatusBadGateway, CodeDeployFailed, err)
+		return
+	}
+	rec, _ := s.store.Get(inst.Group, inst.Name)
+	writeJSON(w, http.StatusCreated, toInstance(rec))
+}
+
+// reserve records the instance as pending unless it exists or its group cannot admit it. Reserving
+// is serialized so concurrent requests can neither deploy the same instance nor together exceed
+// the limits of a group. Writes an error response and returns false if the instance cannot be
+// reserved.
+func (s *Server) reserve(w http.ResponseWriter, inst stack.Instance) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store.Get(inst.Group, inst.Name); ok {
+		writeError(w, http.StatusConflict, CodeConflict, fmt.Errorf("instance %q already exists in group %q", inst.Name, inst.Group))
+		return false
+	}
+	if s.groups != nil {
+		if err := s.groups.Admit(s.store, inst); err != nil {
+			writeError(w, http.StatusConflict, CodeQuotaExceeded, err)
+			return false
+		}
+	}
+	ttl, err := instance.InstanceTTL(inst)
+	if err == nil {
+		err = s.store.Save(instance.Record{Instance: inst, State: instance.Pending, TTL: ttl})
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err)
+		return false
+	}
+	return true
+}
+
+// handleInstance handles requests to /instances/{group}/{name}.
+func (s *Server) handleInstance(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	group, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/instances/"), "/")
+	if !ok || group == "" || name == "" || strings.Contains(name, "/") {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Errorf("path %q does not exist", r.URL.Path))
+		return
+	}
+	if r.Method == http.MethodGet {
+		rec, ok := s.store.Get(group, name)
+		if !ok {
+			writeError(w, http.StatusNotFound, CodeNotFound, fmt.Errorf("instance %q does not exist in group %q", name, group))
+			return
+		}
+		writeJSON(w, http.StatusOK, toInstance(rec))
+		return
+	}
+
+	err := deploy.Destroy(r.Context(), s.deployerFor(r), s.store, group, name)
+	if errors.Is(err, deploy.ErrInUse) {
+		writeError(w, http.StatusConflict, CodeConflict, err)
+		return
+	}
+	if errors.Is(err, deploy.ErrNotFound) {
+		writeError(w, http.StatusNotFound, CodeNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, CodeDeployFailed, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Group describes a group and its usage by the deployed instances.
+type Group struct {
+	group.Group
+	Usage group.Usage `json:"usage"`
+}
+
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if s.groups == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, errors.New("groups are not restricted"))
+		return
+	}
+
+	groups := s.groups.List()
+	result := make([]Group, 0, len(groups))
+	for _, g := range groups {
+		u, err := s.groups.Usage(s.store, g.Name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, err)
+			return
+		}
+		result = append(result, Group{Group: g, Usage: u})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Reload is the result of reloading the stacks.
+type Reload struct {
+	// Changed is true if the catalog changed and its stacks were swapped in.
+	Changed bool `json:"changed"`
+	// Stacks is the number of stacks served.
+	Stacks int `json:"stacks"`
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	changed, err := s.stacks.Reload()
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalid, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Reload{Changed: changed, Stacks: len(s.stacks.Stacks())})
+}
@@ -0,0 +1,549 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/teleivo/providers/audit"
+	"github.com/teleivo/providers/deploy"
+	"github.com/teleivo/providers/group"
+	"github.com/teleivo/providers/instance"
+	"github.com/teleivo/providers/server"
+	"github.com/teleivo/providers/stack"
+)
+
+func TestServer(t *testing.T) {
+	stacks, err := stack.Default()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	t.Run("ListStacks", func(t *testing.T) {
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}))
+		defer srv.Close()
+
+		var got []server.Stack
+		do(t, srv, http.MethodGet, "/stacks", nil, http.StatusOK, &got)
+
+		if len(got) != len(stacks) {
+			t.Fatalf("want %d stacks, instead got %v", len(stacks), got)
+		}
+		want := server.Stack{
+			Name: "pgadmin",
+			Parameters: []server.Parameter{
+				{Name: "DATABASE_HOSTNAME", Consumed: true, Origin: "dhis2-db"},
+				{Name: "DATABASE_NAME", Consumed: true, Origin: "dhis2-db"},
+				{Name: "DATABASE_PASSWORD", Consumed: true, Origin: "dhis2-db", Sensitive: true},
+				{Name: "DATABASE_USERNAME", Consumed: true, Origin: "dhis2-db"},
+				{Name: "PGADMIN_PASSWORD", Required: true, Sensitive: true},
+				{Name: "PGADMIN_USERNAME", Required: true},
+			},
+			Providers: []string{},
+			Requires:  []string{"dhis2-db"},
+		}
+		if diff := cmp.Diff(want, got[3]); diff != "" {
+			t.Errorf("GET /stacks mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("GetUnknownStack", func(t *testing.T) {
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}))
+		defer srv.Close()
+
+		var got server.Error
+		do(t, srv, http.MethodGet, "/stacks/pgadmn", nil, http.StatusNotFound, &got)
+
+		if got.Code != server.CodeNotFound || !strings.Contains(got.Message, `did you mean "pgadmin"`) {
+			t.Errorf("unexpected error %+v", got)
+		}
+	})
+
+	t.Run("ComputeChain", func(t *testing.T) {
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}))
+		defer srv.Close()
+
+		var got stack.ChainSpec
+		do(t, srv, http.MethodPost, "/chains", stack.ChainSpec{Stacks: []string{"pgadmin", "dhis2-core"}}, http.StatusOK, &got)
+
+		want := stack.ChainSpec{Stacks: []string{"dhis2-db", "pgadmin", "dhis2-core"}}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("POST /chains mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ResolveFailsGivenMissingParameters", func(t *testing.T) {
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}))
+		defer srv.Close()
+
+		var got server.Error
+		do(t, srv, http.MethodPost, "/instances/resolve", server.InstanceRequest{
+			Name:       "mydb",
+			Group:      "whoami",
+			Stack:      "dhis2-db",
+			Parameters: map[string]string{"DATABASE_ID": "1"},
+		}, http.StatusUnprocessableEntity, &got)
+
+		if got.Code != server.CodeInvalid {
+			t.Errorf("want code %q, instead got %q", server.CodeInvalid, got.Code)
+		}
+		if len(got.Details) != 3 {
+			t.Errorf("want 3 details, instead got %v", got.Details)
+		}
+		if len(got.Issues) != 3 {
+			t.Errorf("want 3 issues, instead got %v", got.Issues)
+		}
+	})
+
+	t.Run("DeployLinkedInstancesAndDestroy", func(t *testing.T) {
+		deployer := &deploy.Fake{}
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), deployer))
+		defer srv.Close()
+
+		do(t, srv, http.MethodPost, "/instances", server.InstanceRequest{
+			Name:  "mydb",
+			Group: "whoami",
+			Stack: "dhis2-db",
+			Parameters: map[string]string{
+				"DATABASE_ID":       "1",
+				"DATABASE_USERNAME": "foo",
+				"DATABASE_PASSWORD": "faa",
+				"DATABASE_NAME":     "mono",
+			},
+		}, http.StatusCreated, nil)
+
+		core := server.InstanceRequest{
+			Name:     "core",
+			Group:    "whoami",
+			Stack:    "dhis2-core",
+			Requires: []server.InstanceRef{{Name: "mydb", Group: "whoami"}},
+		}
+		var resolved server.Instance
+		do(t, srv, http.MethodPost, "/instances/resolve", core, http.StatusOK, &resolved)
+		if want, got := "mydb-database-postgresql.whoami.svc", resolved.Parameters["DATABASE_HOSTNAME"].Value; want != got {
+			t.Errorf("want consumed hostname %q, instead got %q", want, got)
+		}
+		if resolved.State != "" {
+			t.Errorf("want resolved instance to have no state, instead got %q", resolved.State)
+		}
+
+		var got server.Instance
+		do(t, srv, http.MethodPost, "/instances", core, http.StatusCreated, &got)
+		if got.State != instance.Deployed {
+			t.Errorf("want state %q, instead got %q", instance.Deployed, got.State)
+		}
+		if len(deployer.Deployed) != 2 {
+			t.Fatalf("want 2 deployed instances, instead got %v", deployer.Deployed)
+		}
+
+		var errResp server.Error
+		do(t, srv, http.MethodPost, "/instances", core, http.StatusConflict, &errResp)
+		do(t, srv, http.MethodDelete, "/instances/whoami/mydb", nil, http.StatusConflict, &errResp)
+		do(t, srv, http.MethodDelete, "/instances/whoami/core", nil, http.StatusNoContent, nil)
+		do(t, srv, http.MethodDelete, "/instances/whoami/mydb", nil, http.StatusNoContent, nil)
+		do(t, srv, http.MethodGet, "/instances/whoami/mydb", nil, http.StatusNotFound, &errResp)
+
+		if len(deployer.Destroyed) != 2 {
+			t.Fatalf("want 2 destroyed instances, instead got %v", deployer.Destroyed)
+		}
+	})
+
+	t.Run("RedactSensitiveParameters", func(t *testing.T) {
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}))
+		defer srv.Close()
+		db := server.InstanceRequest{
+			Name:  "mydb",
+			Group: "whoami",
+			Stack: "dhis2-db",
+			Parameters: map[string]string{
+				"DATABASE_ID":       "1",
+				"DATABASE_USERNAME": "foo",
+				"DATABASE_PASSWORD": "s3cret",
+				"DATABASE_NAME":     "mono",
+			},
+		}
+
+		for _, r := range []struct {
+			method, path string
+			body         any
+			status       int
+		}{
+			{http.MethodPost, "/instances/resolve", db, http.StatusOK},
+			{http.MethodPost, "/instances", db, http.StatusCreated},
+			{http.MethodGet, "/instances/whoami/mydb", nil, http.StatusOK},
+			{http.MethodGet, "/instances", nil, http.StatusOK},
+		} {
+			var got json.RawMessage
+			do(t, srv, r.method, r.path, r.body, r.status, &got)
+
+			if strings.Contains(string(got), "s3cret") {
+				t.Errorf("want %s %s not to contain the password, instead got '%s'", r.method, r.path, got)
+			}
+			if redacted, _ := json.Marshal(deploy.Redacted); !strings.Contains(string(got), string(redacted)) {
+				t.Errorf("want %s %s to contain %q, instead got '%s'", r.method, r.path, deploy.Redacted, got)
+			}
+		}
+	})
+
+	t.Run("DeployFails", func(t *testing.T) {
+		deployer := &deploy.Fake{DeployErr: map[string]error{"hello": errors.New("boom")}}
+		store := instance.NewStore()
+		srv := httptest.NewServer(server.New(stacks, store, deployer))
+		defer srv.Close()
+
+		var got server.Error
+		do(t, srv, http.MethodPost, "/instances", server.InstanceRequest{
+			Name:  "hello",
+			Group: "whoami",
+			Stack: "whoami-go",
+		}, http.StatusBadGateway, &got)
+
+		if got.Code != server.CodeDeployFailed {
+			t.Errorf("want code %q, instead got %q", server.CodeDeployFailed, got.Code)
+		}
+		if r, _ := store.Get("whoami", "hello"); r.State != instance.Failed {
+			t.Errorf("want state %q, instead got %q", instance.Failed, r.State)
+		}
+	})
+
+	t.Run("RestrictGroups", func(t *testing.T) {
+		groups := group.NewRegistry()
+		for _, g := range []group.Group{{Name: "dev", MaxInstances: 1}, {Name: "qa"}} {
+			if err := groups.Register(g); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}).WithGroups(groups))
+		defer srv.Close()
+
+		db := server.InstanceRequest{
+			Name:  "mydb",
+			Group: "prod",
+			Stack: "dhis2-db",
+			Parameters: map[string]string{
+				"DATABASE_ID":       "1",
+				"DATABASE_USERNAME": "foo",
+				"DATABASE_PASSWORD": "faa",
+				"DATABASE_NAME":     "mono",
+			},
+		}
+		var errResp server.Error
+		do(t, srv, http.MethodPost, "/instances/resolve", db, http.StatusUnprocessableEntity, &errResp)
+		if want := `group "prod": unknown group`; !strings.Contains(errResp.Message, want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, errResp.Message)
+		}
+
+		db.Group = "dev"
+		do(t, srv, http.MethodPost, "/instances", db, http.StatusCreated, nil)
+
+		core := server.InstanceRequest{
+			Name:     "core",
+			Group:    "qa",
+			Stack:    "dhis2-core",
+			Requires: []server.InstanceRef{{Name: "mydb", Group: "dev"}},
+		}
+		do(t, srv, http.MethodPost, "/instances", core, http.StatusUnprocessableEntity, &errResp)
+		if want := `instance "core" in group "qa" must not link to instance "mydb" in group "dev"`; !strings.Contains(errResp.Message, want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, errResp.Message)
+		}
+
+		core.Group = "dev"
+		do(t, srv, http.MethodPost, "/instances", core, http.StatusConflict, &errResp)
+		if errResp.Code != server.CodeQuotaExceeded {
+			t.Errorf("want code %q, instead got %q", server.CodeQuotaExceeded, errResp.Code)
+		}
+
+		var got []server.Group
+		do(t, srv, http.MethodGet, "/groups", nil, http.StatusOK, &got)
+		want := []server.Group{
+			{Group: group.Group{Name: "dev", MaxInstances: 1}, Usage: group.Usage{Instances: 1, DatabaseSize: 20 << 30}},
+			{Group: group.Group{Name: "qa"}},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("GET /groups mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ReserveInstancesGivenConcurrentRequests", func(t *testing.T) {
+		groups := group.NewRegistry()
+		for _, g := range []group.Group{{Name: "dev", MaxInstances: 1}, {Name: "whoami"}} {
+			if err := groups.Register(g); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+
+		tests := map[string]func(i int) string{
+			"SameName": func(int) string { return `{"name": "hello", "group": "whoami", "stack": "whoami-go"}` },
+			"ExceedQuota": func(i int) string {
+				return fmt.Sprintf(`{"name": "hello-%d", "group": "dev", "stack": "whoami-go"}`, i)
+			},
+		}
+		for name, body := range tests {
+			t.Run(name, func(t *testing.T) {
+				const requests = 10
+				// all requests resolve their instance before any of them deploys
+				var resolved sync.WaitGroup
+				resolved.Add(requests)
+				var bus deploy.Bus
+				bus.Hook(deploy.AnyStack, stack.PostResolve, deploy.HookFunc(func(context.Context, deploy.Event) error {
+					resolved.Done()
+					resolved.Wait()
+					return nil
+				}))
+				srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}).WithGroups(groups).WithEvents(&bus))
+				defer srv.Close()
+
+				statuses := make(chan int, requests)
+				for i := 0; i < requests; i++ {
+					go func(i int) {
+						res, err := srv.Client().Post(srv.URL+"/instances", "application/json", strings.NewReader(body(i)))
+						if err != nil {
+							statuses <- 0
+							return
+						}
+						res.Body.Close()
+						statuses <- res.StatusCode
+					}(i)
+				}
+
+				got := make(map[int]int)
+				for i := 0; i < requests; i++ {
+					got[<-statuses]++
+				}
+				want := map[int]int{http.StatusCreated: 1, http.StatusConflict: requests - 1}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("statuses mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+
+	t.Run("RunHooks", func(t *testing.T) {
+		var bus deploy.Bus
+		bus.Hook("whoami-go", stack.PreResolve, deploy.HookFunc(func(_ context.Context, e deploy.Event) error {
+			if e.Instance.Name == "blocked" {
+				return errors.New("blocked by hook")
+			}
+			return nil
+		}))
+		var events []string
+		bus.Observe(deploy.ObserverFunc(func(_ context.Context, e deploy.Event) {
+			events = append(events, string(e.Phase))
+		}), stack.PostDeploy, stack.PostDestroy)
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}).WithEvents(&bus))
+		defer srv.Close()
+
+		var errResp server.Error
+		do(t, srv, http.MethodPost, "/instances", server.InstanceRequest{Name: "blocked", Group: "whoami", Stack: "whoami-go"}, http.StatusBadGateway, &errResp)
+		if errResp.Code != server.CodeHookFailed {
+			t.Errorf("want code %q, instead got %q", server.CodeHookFailed, errResp.Code)
+		}
+		do(t, srv, http.MethodPost, "/instances", server.InstanceRequest{Name: "whoami", Group: "whoami", Stack: "whoami-go"}, http.StatusCreated, nil)
+		do(t, srv, http.MethodDelete, "/instances/whoami/whoami", nil, http.StatusNoContent, nil)
+
+		if diff := cmp.Diff([]string{"post-deploy", "post-destroy"}, events); diff != "" {
+			t.Errorf("events mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("AuditRequests", func(t *testing.T) {
+		var log bytes.Buffer
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}).WithAudit(audit.NewLog(&log)))
+		defer srv.Close()
+
+		whoami := server.InstanceRequest{Name: "whoami", Group: "whoami", Stack: "whoami-go"}
+		do(t, srv, http.MethodPost, "/instances/resolve", whoami, http.StatusOK, nil)
+		do(t, srv, http.MethodPost, "/instances", whoami, http.StatusCreated, nil)
+		do(t, srv, http.MethodDelete, "/instances/whoami/whoami", nil, http.StatusNoContent, nil)
+
+		entries, err := audit.Read(bytes.NewReader(log.Bytes()), audit.Filter{Instance: "whoami"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, fmt.Sprintf("%s %s %s", e.Actor, e.Action, e.Outcome))
+		}
+		want := []string{"anonymous plan success", "anonymous deploy success", "anonymous destroy success"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("audit log mismatch (-want +got):\n%s", diff)
+		}
+		if _, err := audit.Verify(bytes.NewReader(log.Bytes())); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("ReapExpiredInstances", func(t *testing.T) {
+		var log bytes.Buffer
+		store := instance.NewStore()
+		store.Now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+		handler := server.New(stacks, store, &deploy.Fake{}).WithAudit(audit.NewLog(&log))
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+
+		do(t, srv, http.MethodPost, "/instances", server.InstanceRequest{
+			Name:       "whoami",
+			Group:      "whoami",
+			Stack:      "whoami-go",
+			Parameters: map[string]string{"INSTANCE_TTL": "1h"},
+		}, http.StatusCreated, nil)
+
+		r := handler.Reaper("reaper")
+		r.Now = func() time.Time { return time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC) }
+		destroyed, err := r.Reap(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if len(destroyed) != 1 {
+			t.Fatalf("want 1 destroyed instance, instead got %v", destroyed)
+		}
+		var errResp server.Error
+		do(t, srv, http.MethodGet, "/instances/whoami/whoami", nil, http.StatusNotFound, &errResp)
+		entries, err := audit.Read(bytes.NewReader(log.Bytes()), audit.Filter{Instance: "whoami"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, fmt.Sprintf("%s %s %s", e.Actor, e.Action, e.Outcome))
+		}
+		want := []string{"anonymous deploy success", "reaper destroy success"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("audit log mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ReloadStacks", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "stacks.json")
+		writeCatalog(t, file, `{"stacks": [{"name": "hello", "parameters": {"GREETING": {"value": "hello"}}}]}`)
+		registry, err := stack.LoadRegistry(file, stack.NewProviderRegistry())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		deployer := &blockingDeployer{started: make(chan struct{}), release: make(chan struct{})}
+		srv := httptest.NewServer(server.New(nil, instance.NewStore(), deployer).WithRegistry(registry))
+		defer srv.Close()
+
+		// deploy an instance that is in flight while the stacks are reloaded
+		status := make(chan int, 1)
+		go func() {
+			body := strings.NewReader(`{"name": "my", "group": "whoami", "stack": "hello"}`)
+			res, err := srv.Client().Post(srv.URL+"/instances", "application/json", body)
+			if err != nil {
+				status <- 0
+				return
+			}
+			res.Body.Close()
+			status <- res.StatusCode
+		}()
+		<-deployer.started
+
+		writeCatalog(t, file, `{"stacks": [{"name": "hello", "parameters": {"GREETING": {"value": "hi"}}}, {"name": "bye"}]}`)
+		var got server.Reload
+		do(t, srv, http.MethodPost, "/reload", nil, http.StatusOK, &got)
+		if diff := cmp.Diff(server.Reload{Changed: true, Stacks: 2}, got); diff != "" {
+			t.Errorf("POST /reload mismatch (-want +got):\n%s", diff)
+		}
+		close(deployer.release)
+
+		if got := <-status; got != http.StatusCreated {
+			t.Fatalf("want status %d, instead got %d", http.StatusCreated, got)
+		}
+		if got := deployer.deployed.Stack.Parameters["GREETING"].Value; got != "hello" {
+			t.Errorf("want instance in flight to keep its stack, instead got GREETING %q", got)
+		}
+		do(t, srv, http.MethodGet, "/stacks/bye", nil, http.StatusOK, nil)
+
+		writeCatalog(t, file, `{"stacks": [{"name": "hello", "requires": ["missing"]}]}`)
+		var errResp server.Error
+		do(t, srv, http.MethodPost, "/reload", nil, http.StatusUnprocessableEntity, &errResp)
+		if errResp.Code != server.CodeInvalid {
+			t.Errorf("want code %q, instead got %q", server.CodeInvalid, errResp.Code)
+		}
+		do(t, srv, http.MethodGet, "/stacks/bye", nil, http.StatusOK, nil)
+	})
+
+	t.Run("ServeOpenAPI", func(t *testing.T) {
+		srv := httptest.NewServer(server.New(stacks, instance.NewStore(), &deploy.Fake{}))
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL + "/openapi.yaml")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("want status %d, instead got %d", http.StatusOK, res.StatusCode)
+		}
+	})
+}
+
+// do sends a request with the JSON encoded body and decodes the response into result if not nil.
+// blockingDeployer blocks deploying until released.
+type blockingDeployer struct {
+	started  chan struct{}
+	release  chan struct{}
+	deployed stack.Instance
+}
+
+func (d *blockingDeployer) Deploy(_ context.Context, instance stack.Instance) error {
+	close(d.started)
+	<-d.release
+	d.deployed = instance
+	return nil
+}
+
+func (d *blockingDeployer) Destroy(context.Context, stack.Instance) error {
+	return nil
+}
+
+func writeCatalog(t *testing.T, file, catalog string) {
+	t.Helper()
+
+	if err := os.WriteFile(file, []byte(catalog), 0o600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path string, body any, wantStatus int, result any) {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatalf("failed to encode request body: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, srv.URL+path, &reqBody)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != wantStatus {
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(res.Body)
+		t.Fatalf("%s %s: want status %d, instead got %d: %s", method, path, wantStatus, res.StatusCode, buf.String())
+	}
+	if result != nil {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package stack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Catalog is the declarative definition of stacks as found in stack files like
+//
+//	{
+//	  "stacks": [
+//	    {
+//	      "name": "dhis2-db",
+//	      "version": "16.0.0",
+//	      "parameters": {"DATABASE_NAME": {}},
+//	      "providers": {
+//	        "DATABASE_HOSTNAME": {"type": "hostname", "args": {"service": "database-postgresql"}}
+//	      }
+//	    },
+//	    {
+//	      "name": "pgadmin",
+//	      "parameters": {"PGADMIN_DB_HOST": {"consumed": true}},
+//	      "requires": ["dhis2-db"],
+//	      "constraints": {"dhis2-db": "^16"},
+//	      "mappings": {"dhis2-db": {"PGADMIN_DB_HOST": "DATABASE_HOSTNAME"}}
+//	    }
+//	  ]
+//	}
+type Catalog struct {
+	Stacks []Definition `json:"stacks"`
+}
+
+// Definition is the declarative definition of a stack.
+type Definition struct {
+	Name       string                        `json:"name"`
+	File       string                        `json:"file,omitempty"`
+	Parameters map[string]Parameter          `json:"parameters,omitempty"`
+	Providers  map[string]ProviderDefinition `json:"providers,omitempty"`
+	// Requires the stacks with these names.
+	Requires []string `json:"requires,omitempty"`
+	// Mappings of consumed parameters by the name of the required stack. See Stack.Mappings.
+	Mappings map[string]Mapping `json:"mappings,omitempty"`
+	// Version of the stack. See Stack.Version.
+	Version string `json:"version,omitempty"`
+	// Constraints on the versions of required stacks by the name of the required stack. See
+	// Stack.Constraints.
+	Constraints map[string]string `json:"constraints,omitempty"`
+	// Hooks of the stack. See Stack.Hooks.
+	Hooks []Hook `json:"hooks,omitempty"`
+	// Readiness check of the stack. See Stack.Readiness.
+	Readiness *Readiness `json:"readiness,omitempty"`
+	// Retry policy of the stack. See Stack.Retry.
+	Retry *Retry `json:"retry,omitempty"`
+}
+
+func (d Definition) id() string {
+	return Stack{Name: d.Name, Version: d.Version}.ID()
+}
+
+// ProviderDefinition references a provider registered in a ProviderRegistry by its type.
+type ProviderDefinition struct {
+	Type string            `json:"type"`
+	Args map[string]string `json:"args,omitempty"`
+	// DependsOn declares the parameters or providers of the stack the provider depends on. See
+	// WithDependencies.
+	DependsOn []string `json:"dependsOn,omitempty"`
+	// Retry policy of the provider. See WithRetry.
+	Retry *Retry `json:"retry,omitempty"`
+}
+
+// ReadCatalog reads a JSON encoded catalog.
+func ReadCatalog(r io.Reader) (Catalog, error) {
+	var c Catalog
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&c)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("failed to decode catalog: %v", err)
+	}
+	return c, nil
+}
+
+// Load reads a JSON encoded catalog and creates its stacks using the providers of the registry.
+func Load(r io.Reader, registry *ProviderRegistry) (Stacks, error) {
+	c, err := ReadCatalog(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.Build(registry)
+}
+
+// Build creates the stacks of the catalog using the providers of the registry. A stack requires
+// the latest version of a required stack meeting its constraint. Stacks are validated like stacks
+// created using New.
+func (c Catalog) Build(registry *ProviderRegistry) (Stacks, error) {
+	defs := make(map[string]Definition, len(c.Stacks))
+	versions := make(map[string][]string, len(c.Stacks))
+	var errs []error
+	for _, d := range c.Stacks {
+		if d.Name == "" {
+			errs = append(errs, errors.New("stack must have a name"))
+			continue
+		}
+		id := d.id()
+		if _, ok := defs[id]; ok {
+			errs = append(errs, &DuplicateStackError{Stack: d.Name, Version: d.Version})
+			continue
+		}
+		defs[id] = d
+		versions[d.Name] = append(versions[d.Name], d.Version)
+	}
+	// required stacks are referenced by ID once their version is picked
+	requiredIDs := make(map[string][]string, len(defs))
+	for _, d := range c.Stacks {
+		for _, dest := range d.Requires {
+			available, ok := versions[dest]
+			if !ok {
+				errs = append(errs, &MissingRequiredStackError{Stack: d.Name, Required: dest})
+				continue
+			}
+			id := dest
+			if constraint, ok := d.Constraints[dest]; ok {
+				cs, err := ParseConstraint(constraint)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("invalid constraint for stack %q on stack %q: %v", d.Name, dest, err))
+					continue
+				}
+				matching := matchingVersions(cs, available)
+				if len(matching) == 0 {
+					errs = append(errs, &UnsatisfiableConstraintError{
+						Stack:       dest,
+						Constraints: map[string]string{d.Name: constraint},
+						Versions:    sortedVersions(available),
+					})
+					continue
+				}
+				id = Definition{Name: dest, Version: matching[0]}.id()
+			} else if latest := sortedVersions(available); len(latest) > 0 {
+				id = Definition{Name: dest, Version: latest[0]}.id()
+			}
+			requiredIDs[d.id()] = append(requiredIDs[d.id()], id)
+		}
+	}
+	requires := make(map[string][]string, len(defs))
+	for _, d := range defs {
+		requires[d.Name] = append(requires[d.Name], d.Requires...)
+	}
+	for _, path := range cycles(requires) {
+		errs = append(errs, &CycleError{Path: path})
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// stacks hold their required stacks so they need to be built in topological order
+	built := make(map[string]Stack, len(defs))
+	var build func(id string) (Stack, error)
+	build = func(id string) (Stack, error) {
+		if s, ok := built[id]; ok {
+			return s, nil
+		}
+		d := defs[id]
+		s := Stack{
+			Name:        d.Name,
+			Version:     d.Version,
+			File:        d.File,
+			Parameters:  d.Parameters,
+			Providers:   make(map[string]Provider, len(d.Providers)),
+			Mappings:    d.Mappings,
+			Constraints: d.Constraints,
+			Hooks:       d.Hooks,
+			Readiness:   d.Readiness,
+			Retry:       d.Retry,
+		}
+		var errs []error
+		for k, pd := range d.Providers {
+			p, err := registry.New(pd.Type, pd.Args)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("stack %q provider %q: %v", d.Name, k, err))
+				continue
+			}
+			p = declare(p, k)
+			if pd.Retry != nil {
+				policy, err := pd.Retry.Policy()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("stack %q provider %q has invalid retry policy: %v", d.Name, k, err))
+					continue
+				}
+				p = WithRetry(p, policy)
+			}
+			if len(pd.DependsOn) > 0 {
+				p = WithDependencies(p, pd.DependsOn...)
+			}
+			s.Providers[k] = p
+		}
+		for _, dest := range requiredIDs[id] {
+			r, err := build(dest)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			s.Requires = append(s.Requires, r)
+		}
+		if len(errs) > 0 {
+			return Stack{}, errors.Join(errs...)
+		}
+
+		built[id] = s
+		return s, nil
+	}
+
+	names := make([]string, 0, len(defs))
+	for k := range defs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	stacks := make([]Stack, 0, len(names))
+	for _, name := range names {
+		s, err := build(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		stacks = append(stacks, s)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return New(stacks...)
+}
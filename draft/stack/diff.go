@@ -0,0 +1,328 @@
+package stack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangeKind is the kind of a change between two catalogs.
+type ChangeKind string
+
+// Change kinds.
+const (
+	StackAdded         ChangeKind = "stack_added"
+	StackRemoved       ChangeKind = "stack_removed"
+	VersionAdded       ChangeKind = "version_added"
+	VersionRemoved     ChangeKind = "version_removed"
+	ParameterAdded     ChangeKind = "parameter_added"
+	ParameterRemoved   ChangeKind = "parameter_removed"
+	ParameterRequired  ChangeKind = "parameter_required"
+	ParameterConsumed  ChangeKind = "parameter_consumed"
+	DefaultChanged     ChangeKind = "default_changed"
+	ProviderAdded      ChangeKind = "provider_added"
+	ProviderRemoved    ChangeKind = "provider_removed"
+	RequirementAdded   ChangeKind = "requirement_added"
+	RequirementRemoved ChangeKind = "requirement_removed"
+	MappingChanged     ChangeKind = "mapping_changed"
+	ConstraintChanged  ChangeKind = "constraint_changed"
+	TypeChanged        ChangeKind = "type_changed"
+)
+
+// Change between two catalogs. A change is breaking if instances of the old catalog or callers
+// deploying them need to change to work with the new catalog.
+type Change struct {
+	Kind  ChangeKind `json:"kind"`
+	Stack string     `json:"stack"`
+	// Name of the changed parameter, provider, required stack or version.
+	Name     string `json:"name,omitempty"`
+	Breaking bool   `json:"breaking"`
+	// Old and New values of a changed default, mapping, constraint or type.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+	// Consumers are the stacks of the old catalog consuming a removed parameter or provider.
+	Consumers []string `json:"consumers,omitempty"`
+}
+
+func (c Change) String() string {
+	var b strings.Builder
+	if c.Breaking {
+		b.WriteString("breaking: ")
+	} else {
+		b.WriteString("non-breaking: ")
+	}
+	fmt.Fprintf(&b, "%s stack %q", strings.ReplaceAll(string(c.Kind), "_", " "), c.Stack)
+	if c.Name != "" {
+		fmt.Fprintf(&b, " %q", c.Name)
+	}
+	if c.Old != "" || c.New != "" {
+		fmt.Fprintf(&b, " from %q to %q", c.Old, c.New)
+	}
+	if len(c.Consumers) > 0 {
+		fmt.Fprintf(&b, " consumed by %s", strings.Join(c.Consumers, ", "))
+	}
+	return b.String()
+}
+
+// Diff compares the stacks of catalog next to the ones of catalog old. Stacks are compared by name
+// using their latest versions. Versions added or removed are reported as well. Removing a parameter
+// the user sets is breaking because callers setting it fail to resolve. Removing a parameter or
+// provider other stacks consume directly or passed through other stacks, requiring a new parameter
+// from the user, consuming a parameter the user used to set, changing the type of a parameter to
+// anything but a string, removing a version, adding or changing requirements of a stack and
+// removing a requirement the stack consumes parameters from are breaking as well. Changes are
+// sorted by stack and then by kind and name.
+func Diff(old, next Stacks) []Change {
+	var result []Change
+	oldNames, newNames := stackNames(old), stackNames(next)
+	for _, name := range oldNames.sorted() {
+		if _, ok := newNames[name]; !ok {
+			result = append(result, Change{Kind: StackRemoved, Stack: name, Breaking: true})
+		}
+	}
+	for _, name := range newNames.sorted() {
+		if _, ok := oldNames[name]; !ok {
+			result = append(result, Change{Kind: StackAdded, Stack: name})
+			continue
+		}
+		result = append(result, diffVersions(old, next, name)...)
+
+		o, _ := old.Get(name)
+		n, _ := next.Get(name)
+		result = append(result, diffParameters(old, o, n)...)
+		result = append(result, diffProviders(old, o, n)...)
+		result = append(result, diffRequirements(o, n)...)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Stack != b.Stack {
+			return a.Stack < b.Stack
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return result
+}
+
+// Breaking reports whether any of the changes is breaking.
+func Breaking(changes []Change) bool {
+	for _, c := range changes {
+		if c.Breaking {
+			return true
+		}
+	}
+	return false
+}
+
+// names is a set of stack names.
+type names map[string]struct{}
+
+func stackNames(stacks Stacks) names {
+	result := make(names, len(stacks))
+	for _, s := range stacks {
+		result[s.Name] = struct{}{}
+	}
+	return result
+}
+
+func (n names) sorted() []string {
+	result := make([]string, 0, len(n))
+	for k := range n {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func diffVersions(old, next Stacks, name string) []Change {
+	var result []Change
+	oldVersions := make(map[string]struct{})
+	for _, s := range old.Versions(name) {
+		oldVersions[s.Version] = struct{}{}
+	}
+	newVersions := make(map[string]struct{})
+	for _, s := range next.Versions(name) {
+		newVersions[s.Version] = struct{}{}
+		if _, ok := oldVersions[s.Version]; !ok && s.Version != "" {
+			result = append(result, Change{Kind: VersionAdded, Stack: name, Name: s.Version})
+		}
+	}
+	for v := range oldVersions {
+		if _, ok := newVersions[v]; !ok && v != "" {
+			result = append(result, Change{Kind: VersionRemoved, Stack: name, Name: v, Breaking: true})
+		}
+	}
+	return result
+}
+
+func diffParameters(old Stacks, o, n Stack) []Change {
+	var result []Change
+	for _, k := range sortedParameterNames(o.Parameters) {
+		op := o.Parameters[k]
+		np, ok := n.Parameters[k]
+		if !ok {
+			consumers := consumersOf(old, o.Name, k)
+			result = append(result, Change{Kind: ParameterRemoved, Stack: o.Name, Name: k, Breaking: !op.Consumed || len(consumers) > 0, Consumers: consumers})
+			continue
+		}
+		switch {
+		case !op.Consumed && np.Consumed:
+			result = append(result, Change{Kind: ParameterConsumed, Stack: o.Name, Name: k, Breaking: true})
+		case required(np) && !required(op):
+			result = append(result, Change{Kind: ParameterRequired, Stack: o.Name, Name: k, Breaking: true, Old: op.Value})
+		case !np.Consumed && op.Value != np.Value:
+			result = append(result, Change{Kind: DefaultChanged, Stack: o.Name, Name: k, Old: op.Value, New: np.Value})
+		}
+		if ot, nt := typeName(op.Type), typeName(np.Type); ot != nt {
+			// values valid for the old type might be invalid for the new one unless it is a string
+			result = append(result, Change{Kind: TypeChanged, Stack: o.Name, Name: k, Breaking: nt != String, Old: string(ot), New: string(nt)})
+		}
+	}
+	for _, k := range sortedParameterNames(n.Parameters) {
+		if _, ok := o.Parameters[k]; ok {
+			continue
+		}
+		np := n.Parameters[k]
+		if required(np) {
+			result = append(result, Change{Kind: ParameterRequired, Stack: o.Name, Name: k, Breaking: true})
+			continue
+		}
+		result = append(result, Change{Kind: ParameterAdded, Stack: o.Name, Name: k, New: np.Value})
+	}
+	return result
+}
+
+func typeName(t Type) Type {
+	if t == "" {
+		return String
+	}
+	return t
+}
+
+// required reports whether the user needs to set the parameter.
+func required(p Parameter) bool {
+	return !p.Consumed && p.Value == ""
+}
+
+func diffProviders(old Stacks, o, n Stack) []Change {
+	var result []Change
+	for _, k := range sortedProviderNames(o.Providers) {
+		if _, ok := n.Providers[k]; ok {
+			continue
+		}
+		consumers := consumersOf(old, o.Name, k)
+		result = append(result, Change{Kind: ProviderRemoved, Stack: o.Name, Name: k, Breaking: len(consumers) > 0, Consumers: consumers})
+	}
+	for _, k := range sortedProviderNames(n.Providers) {
+		if _, ok := o.Providers[k]; !ok {
+			result = append(result, Change{Kind: ProviderAdded, Stack: o.Name, Name: k})
+		}
+	}
+	return result
+}
+
+func diffRequirements(o, n Stack) []Change {
+	var result []Change
+	oldRequires, newRequires := make(names), make(names)
+	for _, dest := range o.Requires {
+		oldRequires[dest.Name] = struct{}{}
+	}
+	for _, dest := range n.Requires {
+		newRequires[dest.Name] = struct{}{}
+	}
+	for _, dest := range oldRequires.sorted() {
+		if _, ok := newRequires[dest]; !ok {
+			// parameters consumed from the requirement lose their source
+			result = append(result, Change{Kind: RequirementRemoved, Stack: o.Name, Name: dest, Breaking: consumesFrom(o, dest)})
+		}
+	}
+	for _, dest := range newRequires.sorted() {
+		if _, ok := oldRequires[dest]; !ok {
+			result = append(result, Change{Kind: RequirementAdded, Stack: o.Name, Name: dest, Breaking: true})
+			continue
+		}
+		if om, nm := mappingString(o.Mappings[dest]), mappingString(n.Mappings[dest]); om != nm {
+			result = append(result, Change{Kind: MappingChanged, Stack: o.Name, Name: dest, Breaking: true, Old: om, New: nm})
+		}
+		if oc, nc := o.Constraints[dest], n.Constraints[dest]; oc != nc {
+			result = append(result, Change{Kind: ConstraintChanged, Stack: o.Name, Name: dest, Breaking: true, Old: oc, New: nc})
+		}
+	}
+	return result
+}
+
+// consumersOf returns the names of the stacks consuming the parameter or provider name of the
+// stack named source. Stacks consuming it passed through by a consumer are consumers as well.
+func consumersOf(stacks Stacks, source, name string) []string {
+	consumers := make(names)
+	var collect func(source, name string)
+	collect = func(source, name string) {
+		for _, s := range stacks {
+			for _, dest := range s.Requires {
+				if dest.Name != source {
+					continue
+				}
+				for _, k := range sortedParameterNames(s.Parameters) {
+					if !s.Parameters[k].Consumed || s.source(source, k) != name {
+						continue
+					}
+					consumers[s.Name] = struct{}{}
+					// stacks requiring s can consume the parameter from it
+					collect(s.Name, k)
+				}
+			}
+		}
+	}
+	collect(source, name)
+	if len(consumers) == 0 {
+		return nil
+	}
+	return consumers.sorted()
+}
+
+// consumesFrom reports whether stack s consumes any parameter from its required stack named dest.
+func consumesFrom(s Stack, dest string) bool {
+	for _, d := range s.Requires {
+		if d.Name != dest {
+			continue
+		}
+		for k, p := range s.Parameters {
+			if !p.Consumed {
+				continue
+			}
+			name := s.source(dest, k)
+			if _, ok := d.Parameters[name]; ok {
+				return true
+			}
+			if _, ok := d.Providers[name]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func mappingString(m Mapping) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + m[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func sortedProviderNames(providers map[string]Provider) []string {
+	result := make([]string, 0, len(providers))
+	for k := range providers {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
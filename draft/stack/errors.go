@@ -0,0 +1,188 @@
+package stack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// UnmetParameterError reports a consumed parameter that none of the stacks required stacks
+// provides.
+type UnmetParameterError struct {
+	Stack     string `json:"stack"`
+	Parameter string `json:"parameter"`
+	// Requires are the names of the required stacks that do not provide the parameter.
+	Requires []string `json:"requires"`
+}
+
+func (e *UnmetParameterError) Error() string {
+	if len(e.Requires) == 0 {
+		return fmt.Sprintf("stack %q consumes parameter %q but does not require any stack", e.Stack, e.Parameter)
+	}
+	return fmt.Sprintf("no provider for stack %q parameter %q", e.Stack, e.Parameter)
+}
+
+// AmbiguousProviderError reports a consumed parameter that multiple required stacks provide.
+type AmbiguousProviderError struct {
+	Stack     string `json:"stack"`
+	Parameter string `json:"parameter"`
+	// Providers are the names of the required stacks providing the parameter.
+	Providers []string `json:"providers"`
+}
+
+func (e *AmbiguousProviderError) Error() string {
+	return fmt.Sprintf("every consumed parameter must have exactly one provider. %d provider(s) %v for stack %q parameter %q", len(e.Providers), e.Providers, e.Stack, e.Parameter)
+}
+
+// CycleError reports stacks requiring each other.
+type CycleError struct {
+	// Path of stacks forming the cycle in which each stack requires the next one. The path starts
+	// and ends with the same stack.
+	Path []string `json:"path"`
+}
+
+func (e *CycleError) Error() string {
+	if len(e.Path) == 2 {
+		return fmt.Sprintf("stack %q requires itself", e.Path[0])
+	}
+	var b strings.Builder
+	for i, name := range e.Path {
+		if i > 0 {
+			b.WriteString(" -> ")
+		}
+		fmt.Fprintf(&b, "%q", name)
+	}
+	return "cycle of required stacks " + b.String()
+}
+
+// MissingRequiredStackError reports a required stack that is not part of the stacks.
+type MissingRequiredStackError struct {
+	Stack    string `json:"stack"`
+	Required string `json:"required"`
+}
+
+func (e *MissingRequiredStackError) Error() string {
+	return fmt.Sprintf("stack %q requires stack %q which is missing", e.Stack, e.Required)
+}
+
+// DuplicateStackError reports multiple stacks of the same name and version or a stack without
+// version that is also defined with a version.
+type DuplicateStackError struct {
+	Stack   string `json:"stack"`
+	Version string `json:"version,omitempty"`
+}
+
+func (e *DuplicateStackError) Error() string {
+	if e.Version != "" {
+		return fmt.Sprintf("stack %q version %q is defined more than once", e.Stack, e.Version)
+	}
+	return fmt.Sprintf("stack %q is defined more than once", e.Stack)
+}
+
+// UnsatisfiableConstraintError reports constraints on the version of a required stack that none
+// of its versions meets.
+type UnsatisfiableConstraintError struct {
+	// Stack is the name of the required stack.
+	Stack string `json:"stack"`
+	// Constraints are keyed by the names of the stacks requiring the stack. A constraint given
+	// when selecting the stack for a chain has the empty key.
+	Constraints map[string]string `json:"constraints"`
+	// Versions of the stack ordered from latest to oldest.
+	Versions []string `json:"versions"`
+}
+
+func (e *UnsatisfiableConstraintError) Error() string {
+	names := make([]string, 0, len(e.Constraints))
+	for k := range e.Constraints {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	constraints := make([]string, len(names))
+	for i, name := range names {
+		if name == "" {
+			constraints[i] = fmt.Sprintf("%q selected", e.Constraints[name])
+		} else {
+			constraints[i] = fmt.Sprintf("%q of stack %q", e.Constraints[name], name)
+		}
+	}
+	available := "it has no versions"
+	if len(e.Versions) > 0 {
+		available = "available versions are " + strings.Join(e.Versions, ", ")
+	}
+	return fmt.Sprintf("no version of stack %q meets constraints %s: %s", e.Stack, strings.Join(constraints, ", "), available)
+}
+
+// Issue is an error in a form that is easy to render for example as JSON.
+type Issue struct {
+	// Type of the issue like unmet_parameter. Errors of other types than the ones in this package
+	// are of type invalid.
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	// Details is the error of one of the types in this package like *UnmetParameterError. Nil for
+	// other errors.
+	Details any `json:"details,omitempty"`
+}
+
+// Issues flattens given, possibly joined and wrapped, error into issues.
+func Issues(err error) []Issue {
+	var result []Issue
+	var walk func(err error)
+	walk = func(err error) {
+		if err == nil {
+			return
+		}
+		if t := issueType(err); t != "" {
+			result = append(result, Issue{Type: t, Message: err.Error(), Details: err})
+			return
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+			return
+		case interface{ Unwrap() error }:
+			inner := e.Unwrap()
+			if hasIssue(inner) {
+				walk(inner)
+				return
+			}
+		}
+		result = append(result, Issue{Type: "invalid", Message: err.Error()})
+	}
+	walk(err)
+	return result
+}
+
+// hasIssue reports whether err or any error it wraps is one of the types in this package or
+// joins multiple errors.
+func hasIssue(err error) bool {
+	if issueType(err) != "" {
+		return true
+	}
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		return true
+	case interface{ Unwrap() error }:
+		return hasIssue(e.Unwrap())
+	}
+	return false
+}
+
+func issueType(err error) string {
+	switch err.(type) {
+	case *UnmetParameterError:
+		return "unmet_parameter"
+	case *AmbiguousProviderError:
+		return "ambiguous_provider"
+	case *CycleError:
+		return "cycle"
+	case *UnsatisfiableConstraintError:
+		return "unsatisfiable_constraint"
+	case *MissingRequiredStackError:
+		return "missing_required_stack"
+	case *DuplicateStackError:
+		return "duplicate_stack"
+	}
+	return ""
+}
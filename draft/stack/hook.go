@@ -0,0 +1,62 @@
+package stack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Phase of the lifecycle of an instance.
+type Phase string
+
+// Lifecycle phases in the order they happen. An instance is resolved, deployed and eventually
+// destroyed. DeployFailed replaces PostDeploy if deploying fails.
+const (
+	PreResolve   Phase = "pre-resolve"
+	PostResolve  Phase = "post-resolve"
+	PreDeploy    Phase = "pre-deploy"
+	PostDeploy   Phase = "post-deploy"
+	DeployFailed Phase = "deploy-failed"
+	PreDestroy   Phase = "pre-destroy"
+	PostDestroy  Phase = "post-destroy"
+)
+
+// Phases are all lifecycle phases in order.
+var Phases = []Phase{PreResolve, PostResolve, PreDeploy, PostDeploy, DeployFailed, PreDestroy, PostDestroy}
+
+func (p Phase) known() bool {
+	for _, k := range Phases {
+		if p == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Hook is a command a stack runs in a phase of the lifecycle of its instances like seeding the
+// database after an instance of dhis2-db is deployed
+//
+//	{"phase": "post-deploy", "command": ["./stacks/dhis2-db/seed.sh"]}
+//
+// Hooks are declarative. Deployers decide how to run them.
+type Hook struct {
+	Phase Phase `json:"phase"`
+	// Command is the program and its arguments.
+	Command []string `json:"command"`
+}
+
+// validateHooks ensures hooks run a command in a known phase.
+func validateHooks(stacks []Stack) error {
+	var errs []error
+	for _, s := range stacks {
+		for i, h := range s.Hooks {
+			if !h.Phase.known() {
+				errs = append(errs, fmt.Errorf("stack %q hook %d has unknown phase %q", s.Name, i, h.Phase))
+			}
+			if len(h.Command) == 0 || h.Command[0] == "" {
+				errs = append(errs, fmt.Errorf("stack %q hook %d must have a command", s.Name, i))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,236 @@
+package stack
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ProviderFactory creates a provider configured by given arguments.
+type ProviderFactory func(args map[string]string) (Provider, error)
+
+// ProviderRegistry holds named provider factories. Stacks defined in files reference providers by
+// their name and arguments. A ProviderRegistry is safe for concurrent use.
+type ProviderRegistry struct {
+	mu        sync.RWMutex
+	factories map[string]ProviderFactory
+	// secretKey is the key secret providers derive secrets from.
+	secretKey []byte
+}
+
+// NewProviderRegistry creates a registry with the builtin providers
+//
+//   - hostname: provides the hostname of a service of the instance. Argument service is the name
+//     of the service, for example database-postgresql.
+//   - constant: provides argument value.
+//   - parameter: provides the value of the instances parameter or provider named by argument name.
+//   - secret: provides a secret of argument length bytes (defaults to 32) encoded in base64. The
+//     secret is derived from the secret key of the registry, the group, name and stack of the
+//     instance, the name the provider is declared under in a catalog and its arguments so it
+//     stays the same across runs. Argument name tells apart secrets of providers created outside
+//     a catalog. The instance providing the secret receives it as a sensitive parameter named
+//     after the provider. See SetSecretKey and SelfProvider.
+//   - template: provides the result of executing argument template. See TemplateProvider.
+func NewProviderRegistry() *ProviderRegistry {
+	r := &ProviderRegistry{
+		factories: make(map[string]ProviderFactory),
+	}
+	r.factories["hostname"] = newHostnameProvider
+	r.factories["constant"] = newConstantProvider
+	r.factories["parameter"] = newParameterProvider
+	r.factories["secret"] = r.newSecretProvider
+	r.factories["template"] = newTemplateProviderFromArgs
+	return r
+}
+
+// Register registers a provider factory under name. Returns an error if a factory is already
+// registered under that name.
+func (r *ProviderRegistry) Register(name string, factory ProviderFactory) error {
+	if name == "" {
+		return errors.New("provider name must not be empty")
+	}
+	if factory == nil {
+		return fmt.Errorf("provider %q must have a factory", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.factories[name]; ok {
+		return fmt.Errorf("provider %q is already registered", name)
+	}
+	r.factories[name] = factory
+	return nil
+}
+
+// SetSecretKey sets the key secret providers derive secrets from. Anyone knowing the key can derive
+// the secrets of all instances. Secret providers fail if no key is set.
+func (r *ProviderRegistry) SetSecretKey(key []byte) error {
+	if len(key) == 0 {
+		return errors.New("secret key must not be empty")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secretKey = append([]byte(nil), key...)
+	return nil
+}
+
+func (r *ProviderRegistry) key() []byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.secretKey
+}
+
+// New creates the provider registered under name using given arguments.
+func (r *ProviderRegistry) New(name string, args map[string]string) (Provider, error) {
+	r.mu.RLock()
+	factory, ok := r.factories[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, must be one of %v", name, r.Names())
+	}
+
+	p, err := factory(args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider %q: %v", name, err)
+	}
+	return p, nil
+}
+
+// Names returns the sorted names of all registered providers.
+func (r *ProviderRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make([]string, 0, len(r.factories))
+	for k := range r.factories {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// checkArgs validates that only allowed arguments are given and that required ones are not empty.
+func checkArgs(args map[string]string, required []string, optional ...string) error {
+	allowed := make(map[string]struct{}, len(required)+len(optional))
+	var errs []error
+	for _, k := range required {
+		allowed[k] = struct{}{}
+		if args[k] == "" {
+			errs = append(errs, fmt.Errorf("argument %q is required", k))
+		}
+	}
+	for _, k := range optional {
+		allowed[k] = struct{}{}
+	}
+	for k := range args {
+		if _, ok := allowed[k]; !ok {
+			errs = append(errs, fmt.Errorf("unknown argument %q", k))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func newHostnameProvider(args map[string]string) (Provider, error) {
+	err := checkArgs(args, []string{"service"})
+	if err != nil {
+		return nil, err
+	}
+	service := args["service"]
+	return ProviderFunc(func(instance Instance) (string, error) {
+		return fmt.Sprintf("%s-%s.%s.svc", instance.Name, service, instance.Group), nil
+	}), nil
+}
+
+func newConstantProvider(args map[string]string) (Provider, error) {
+	err := checkArgs(args, []string{"value"})
+	if err != nil {
+		return nil, err
+	}
+	value := args["value"]
+	return ProviderFunc(func(Instance) (string, error) {
+		return value, nil
+	}), nil
+}
+
+func newParameterProvider(args map[string]string) (Provider, error) {
+	err := checkArgs(args, []string{"name"})
+	if err != nil {
+		return nil, err
+	}
+	name := args["name"]
+	return WithDependencies(ProviderFunc(func(instance Instance) (string, error) {
+		p, ok := instance.Parameters[name]
+		if !ok {
+			return "", fmt.Errorf("instance %q has no parameter %q", instance.Name, name)
+		}
+		return p.Value, nil
+	}), name), nil
+}
+
+// maxSecretLength is the maximum length of a secret in bytes.
+const maxSecretLength = 1024
+
+func (r *ProviderRegistry) newSecretProvider(args map[string]string) (Provider, error) {
+	err := checkArgs(args, nil, "length", "name")
+	if err != nil {
+		return nil, err
+	}
+	length := 32
+	if v, ok := args["length"]; ok {
+		length, err = strconv.Atoi(v)
+		if err != nil || length <= 0 || length > maxSecretLength {
+			return nil, fmt.Errorf("argument \"length\" must be a number between 1 and %d, instead got %q", maxSecretLength, v)
+		}
+	}
+	return secretProvider{registry: r, length: length, name: args["name"]}, nil
+}
+
+type secretProvider struct {
+	registry *ProviderRegistry
+	length   int
+	name     string
+	// declared is the name the provider is declared under in a stack.
+	declared string
+}
+
+func (p secretProvider) Provide(instance Instance) (string, error) {
+	key := p.registry.key()
+	if len(key) == 0 {
+		return "", errors.New("no secret key to derive the secret from is set")
+	}
+	return deriveSecret(key, p.length, instance.Group, instance.Name, instance.Stack.Name, p.declared, p.name, strconv.Itoa(p.length)), nil
+}
+
+func (p secretProvider) ProvidesSelf() bool {
+	return true
+}
+
+// declare returns the provider declared under name in a stack. Secret providers derive different
+// secrets for every name.
+func declare(p Provider, name string) Provider {
+	if s, ok := p.(secretProvider); ok {
+		s.declared = name
+		return s
+	}
+	return p
+}
+
+// deriveSecret derives a secret of length bytes from the key and the parts using HMAC-SHA256 in
+// counter mode.
+func deriveSecret(key []byte, length int, parts ...string) string {
+	msg := []byte(strings.Join(parts, "\x00"))
+	var out []byte
+	for i := 1; len(out) < length; i++ {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte{byte(i >> 8), byte(i)})
+		mac.Write(msg)
+		out = mac.Sum(out)
+	}
+	return base64.RawURLEncoding.EncodeToString(out[:length])
+}
@@ -0,0 +1,51 @@
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Readiness declares how to check that an instance of a stack is ready to be used by instances
+// requiring it like a database accepting connections
+//
+//	{"command": ["sh", "-c", "pg_isready -h \"$DATABASE_HOSTNAME\""], "timeout": "5m"}
+//
+// The command succeeds once the instance is ready. Deployers decide how and how often to run it.
+type Readiness struct {
+	// Command is the program and its arguments.
+	Command []string `json:"command"`
+	// Timeout is the duration like 5m to wait for an instance to become ready. Deployers pick a
+	// default if empty.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// TimeoutDuration returns the parsed timeout. Returns zero if the timeout is empty.
+func (r Readiness) TimeoutDuration() (time.Duration, error) {
+	if r.Timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(r.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("timeout %q must be a positive duration like 5m", r.Timeout)
+	}
+	return d, nil
+}
+
+// validateReadiness ensures readiness checks run a command and have a valid timeout.
+func validateReadiness(stacks []Stack) error {
+	var errs []error
+	for _, s := range stacks {
+		if s.Readiness == nil {
+			continue
+		}
+		if len(s.Readiness.Command) == 0 || s.Readiness.Command[0] == "" {
+			errs = append(errs, fmt.Errorf("stack %q readiness check must have a command", s.Name))
+		}
+		if _, err := s.Readiness.TimeoutDuration(); err != nil {
+			errs = append(errs, fmt.Errorf("stack %q readiness check: %v", s.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,110 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Registry holds the stacks of a catalog file that is reloaded while the registry is in use so a
+// long-running service picks up new stack definitions without a restart. A new catalog is only
+// swapped in if it is valid. Stacks returns a snapshot that reloading does not change so callers
+// like deployments keep the stacks they started with. A Registry is safe for concurrent use.
+type Registry struct {
+	file      string
+	providers *ProviderRegistry
+
+	// reload serializes reloads
+	reload sync.Mutex
+	// hash of the catalog the stacks were built from
+	hash [sha256.Size]byte
+	// invalid is the hash of the last catalog that failed to build
+	invalid [sha256.Size]byte
+
+	mu     sync.RWMutex
+	stacks Stacks
+}
+
+// NewRegistry creates a registry of fixed stacks. Reloading it does nothing.
+func NewRegistry(stacks Stacks) *Registry {
+	return &Registry{stacks: stacks}
+}
+
+// LoadRegistry creates a registry of the stacks in the catalog file. See Load.
+func LoadRegistry(file string, providers *ProviderRegistry) (*Registry, error) {
+	r := &Registry{file: file, providers: providers}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Stacks returns the current stacks. The stacks must not be modified.
+func (r *Registry) Stacks() Stacks {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.stacks
+}
+
+// Reload reads the catalog file and swaps in its stacks if the catalog changed. Returns an error
+// and keeps the current stacks if the catalog cannot be read or is invalid. Reports whether the
+// stacks were swapped.
+func (r *Registry) Reload() (bool, error) {
+	return r.load(false)
+}
+
+// load loads the catalog file. Catalogs that failed to build before are skipped if skipInvalid is
+// set so polling reports an invalid catalog only once.
+func (r *Registry) load(skipInvalid bool) (bool, error) {
+	if r.file == "" {
+		return false, nil
+	}
+	r.reload.Lock()
+	defer r.reload.Unlock()
+
+	b, err := os.ReadFile(r.file)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.Sum256(b)
+	if hash == r.hash {
+		return false, nil
+	}
+	if skipInvalid && hash == r.invalid {
+		return false, nil
+	}
+
+	stacks, err := Load(bytes.NewReader(b), r.providers)
+	if err != nil {
+		r.invalid = hash
+		return false, fmt.Errorf("invalid catalog %q: %w", r.file, err)
+	}
+	r.mu.Lock()
+	r.stacks = stacks
+	r.mu.Unlock()
+	r.hash = hash
+	return true, nil
+}
+
+// Poll reloads the catalog file every interval until ctx is done. report is called with the result
+// of every reload that swapped the stacks or failed. A catalog that failed is reported once until
+// it changes.
+func (r *Registry) Poll(ctx context.Context, interval time.Duration, report func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := r.load(true)
+		if changed || err != nil {
+			report(err)
+		}
+	}
+}
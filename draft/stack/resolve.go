@@ -0,0 +1,205 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Resolve resolves all parameters of the instance. Parameters set on the instance take precedence
+// over the default values of its stack. Consumed parameters are resolved using the instances it
+// requires. A consumed parameter is first looked up in the required instances parameters and then
+// evaluated using the required instances stack providers. A parameter the required instance
+// consumes itself is followed through its required instances. The instance originally providing a
+// consumed parameter is recorded as its origin. Providers of the stack implementing SelfProvider are
+// evaluated and set as parameters of the instance.
+//
+// Returns an error if a parameter without default value is not set, if a consumed or unknown
+// parameter is set, if a value does not match the type of its parameter or if a consumed parameter
+// cannot be resolved.
+func Resolve(instance Instance) (map[string]Parameter, error) {
+	return ResolveContext(context.Background(), instance)
+}
+
+// ResolveContext resolves all parameters of the instance like Resolve. The context is passed to
+// providers implementing ContextProvider so retrying providers stop once it is done.
+func ResolveContext(ctx context.Context, instance Instance) (map[string]Parameter, error) {
+	var errs []error
+	for _, k := range sortedParameterNames(instance.Parameters) {
+		p, ok := instance.Stack.Parameters[k]
+		if !ok {
+			errs = append(errs, fmt.Errorf("stack %q has no parameter %q", instance.Stack.Name, k))
+			continue
+		}
+		if p.Consumed && !instance.Parameters[k].Consumed {
+			errs = append(errs, fmt.Errorf("stack %q parameter %q is consumed and cannot be set", instance.Stack.Name, k))
+		}
+	}
+
+	sources, err := requiredInstances(instance)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	result := make(map[string]Parameter, len(instance.Stack.Parameters))
+	for _, k := range sortedParameterNames(instance.Stack.Parameters) {
+		p := instance.Stack.Parameters[k]
+		if !p.Consumed {
+			value := p.Value
+			if v, ok := instance.Parameters[k]; ok {
+				value = v.Value
+			}
+			if value == "" {
+				errs = append(errs, fmt.Errorf("stack %q parameter %q is required", instance.Stack.Name, k))
+				continue
+			}
+			if err := p.Type.Check(value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid stack %q parameter %q: %v", instance.Stack.Name, k, err))
+				continue
+			}
+			result[k] = Parameter{Value: value, Type: p.Type, Sensitive: p.Sensitive}
+			continue
+		}
+
+		v, origin, err := consume(ctx, instance.Stack, sources, k)
+		if err == nil {
+			err = p.Type.Check(v)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to resolve stack %q parameter %q: %v", instance.Stack.Name, k, err))
+			continue
+		}
+		result[k] = Parameter{Value: v, Consumed: true, Origin: &origin, Type: p.Type, Sensitive: p.Sensitive}
+	}
+	for _, k := range sortedProviderNames(instance.Stack.Providers) {
+		if !ProvidesSelf(instance.Stack.Providers[k]) {
+			continue
+		}
+		v, err := provide(ctx, instance, k, make(map[string]struct{}))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stack %q provider %q failed: %v", instance.Stack.Name, k, err))
+			continue
+		}
+		result[k] = Parameter{Value: v, Sensitive: true}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return result, nil
+}
+
+// requiredInstances returns the instances the instance requires ensuring there is exactly one
+// instance for every stack the instances stack requires.
+func requiredInstances(instance Instance) ([]Instance, error) {
+	linked := make(map[string]Instance, len(instance.Requires))
+	for _, r := range instance.Requires {
+		if _, ok := linked[r.Stack.Name]; ok {
+			return nil, fmt.Errorf("instance %q is linked to multiple instances of stack %q", instance.Name, r.Stack.Name)
+		}
+		linked[r.Stack.Name] = r
+	}
+
+	var errs []error
+	result := make([]Instance, 0, len(instance.Stack.Requires))
+	for _, dest := range instance.Stack.Requires {
+		r, ok := linked[dest.Name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("instance %q of stack %q must be linked to an instance of stack %q", instance.Name, instance.Stack.Name, dest.Name))
+			continue
+		}
+		delete(linked, dest.Name)
+		result = append(result, r)
+	}
+	for k := range linked {
+		errs = append(errs, fmt.Errorf("instance %q of stack %q cannot be linked to an instance of stack %q", instance.Name, instance.Stack.Name, k))
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// consume resolves the consumed parameter of stack consumer from the first of the sources providing
+// it. Stack validation ensures there is exactly one.
+func consume(ctx context.Context, consumer Stack, sources []Instance, consumed string) (string, Origin, error) {
+	for _, source := range sources {
+		origin := Origin{Instance: source.Name, Group: source.Group, Stack: source.Stack.Name}
+		name := consumer.source(source.Stack.Name, consumed)
+		if p, ok := source.Stack.Parameters[name]; ok {
+			v, resolved := source.Parameters[name]
+			if !p.Consumed {
+				if !resolved {
+					v = p
+				}
+				return v.Value, origin, nil
+			}
+
+			// the source passes through a parameter it consumed itself
+			if resolved && v.Origin != nil {
+				return v.Value, *v.Origin, nil
+			}
+			upstream, err := requiredInstances(source)
+			if err != nil {
+				return "", Origin{}, err
+			}
+			return consume(ctx, source.Stack, upstream, name)
+		}
+		if _, ok := source.Stack.Providers[name]; ok {
+			v, err := provide(ctx, source, name, make(map[string]struct{}))
+			if err != nil {
+				return "", Origin{}, fmt.Errorf("provider of stack %q failed: %v", source.Stack.Name, err)
+			}
+			return v, origin, nil
+		}
+	}
+
+	return "", Origin{}, errors.New("no linked instance provides it")
+}
+
+// provide evaluates the provider name of the instances stack. Providers it depends on are evaluated
+// first in dependency order and passed to it as instance parameters.
+func provide(ctx context.Context, instance Instance, name string, visiting map[string]struct{}) (string, error) {
+	p := instance.Stack.Providers[name]
+	d, ok := p.(Dependent)
+	if !ok {
+		return provideContext(ctx, p, instance)
+	}
+
+	visiting[name] = struct{}{}
+	defer delete(visiting, name)
+	params := make(map[string]Parameter, len(instance.Parameters))
+	for k, v := range instance.Parameters {
+		params[k] = v
+	}
+	for _, dep := range d.DependsOn() {
+		if _, ok := params[dep]; ok {
+			continue
+		}
+		if _, ok := instance.Stack.Providers[dep]; !ok {
+			return "", fmt.Errorf("provider %q depends on unknown parameter %q", name, dep)
+		}
+		if _, ok := visiting[dep]; ok {
+			return "", fmt.Errorf("provider %q depends on %q which creates a cycle", name, dep)
+		}
+		v, err := provide(ctx, instance, dep, visiting)
+		if err != nil {
+			return "", err
+		}
+		params[dep] = Parameter{Value: v}
+	}
+	instance.Parameters = params
+
+	return provideContext(ctx, p, instance)
+}
+
+func sortedParameterNames(params map[string]Parameter) []string {
+	result := make([]string, 0, len(params))
+	for k := range params {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
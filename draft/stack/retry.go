@@ -0,0 +1,116 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/teleivo/providers/retry"
+)
+
+// Retry declares the retry policy of a stack or provider like
+//
+//	{"maxAttempts": 3, "backoff": "2s", "maxBackoff": "30s", "jitter": 0.2, "retryOn": ["timeout"]}
+//
+// The policy of a stack applies to deploying and destroying its instances. See retry.Policy.
+type Retry struct {
+	// MaxAttempts is the maximum number of attempts including the first one.
+	MaxAttempts int `json:"maxAttempts"`
+	// Backoff and MaxBackoff are durations like 2s.
+	Backoff    string  `json:"backoff,omitempty"`
+	MaxBackoff string  `json:"maxBackoff,omitempty"`
+	Jitter     float64 `json:"jitter,omitempty"`
+	// RetryOn lists parts of the messages of retryable errors. All errors are retryable if empty.
+	RetryOn []string `json:"retryOn,omitempty"`
+}
+
+// Policy returns the retry policy.
+func (r Retry) Policy() (retry.Policy, error) {
+	p := retry.Policy{MaxAttempts: r.MaxAttempts, Jitter: r.Jitter}
+	var errs []error
+	for _, d := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{{"backoff", r.Backoff, &p.Backoff}, {"maxBackoff", r.MaxBackoff, &p.MaxBackoff}} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			errs = append(errs, fmt.Errorf("%s %q must be a positive duration like 2s", d.name, d.value))
+			continue
+		}
+		*d.dest = v
+	}
+	if len(r.RetryOn) > 0 {
+		p.Retryable = retry.OnMessages(r.RetryOn...)
+	}
+	if err := errors.Join(append(errs, p.Validate())...); err != nil {
+		return retry.Policy{}, err
+	}
+	return p, nil
+}
+
+// validateRetries ensures the retry policies of stacks are valid.
+func validateRetries(stacks []Stack) error {
+	var errs []error
+	for _, s := range stacks {
+		if s.Retry == nil {
+			continue
+		}
+		if _, err := s.Retry.Policy(); err != nil {
+			errs = append(errs, fmt.Errorf("stack %q has invalid retry policy: %w", s.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ContextProvider is implemented by providers that can be cancelled. Resolving instances using
+// ResolveContext passes its context to them.
+type ContextProvider interface {
+	ProvideContext(ctx context.Context, instance Instance) (string, error)
+}
+
+// provideContext evaluates the provider passing ctx if it accepts one.
+func provideContext(ctx context.Context, p Provider, instance Instance) (string, error) {
+	if cp, ok := p.(ContextProvider); ok {
+		return cp.ProvideContext(ctx, instance)
+	}
+	return p.Provide(instance)
+}
+
+// WithRetry retries the provider according to the policy. The provider keeps the dependencies it
+// declares.
+func WithRetry(p Provider, policy retry.Policy) Provider {
+	r := retryingProvider{provider: p, policy: policy}
+	if d, ok := p.(Dependent); ok {
+		return WithDependencies(r, d.DependsOn()...)
+	}
+	return r
+}
+
+type retryingProvider struct {
+	provider Provider
+	policy   retry.Policy
+}
+
+func (r retryingProvider) Provide(instance Instance) (string, error) {
+	return r.ProvideContext(context.Background(), instance)
+}
+
+func (r retryingProvider) ProvideContext(ctx context.Context, instance Instance) (string, error) {
+	var result string
+	err := r.policy.Do(ctx, func(ctx context.Context) error {
+		v, err := provideContext(ctx, r.provider, instance)
+		result = v
+		return err
+	})
+	return result, err
+}
+
+func (r retryingProvider) ProvidesSelf() bool {
+	return ProvidesSelf(r.provider)
+}
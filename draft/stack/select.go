@@ -0,0 +1,340 @@
+package stack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ChainSpec specifies a chain by the names of the stacks a user wants to deploy. Stacks required
+// by these stacks do not need to be listed.
+type ChainSpec struct {
+	Stacks []string `json:"stacks"`
+}
+
+// ReadChainSpec reads a JSON encoded chain spec like
+//
+//	{"stacks": ["dhis2-core", "pgadmin"]}
+func ReadChainSpec(r io.Reader) (ChainSpec, error) {
+	var spec ChainSpec
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&spec)
+	if err != nil {
+		return ChainSpec{}, fmt.Errorf("failed to decode chain spec: %v", err)
+	}
+	return spec, nil
+}
+
+// Chain creates a chain of the stacks with given names. The required stacks are added to the chain
+// as well. Names are trimmed and empty names are ignored. A name can constrain the version of the
+// stack like dhis2-db@^16. The latest versions meeting the constraints of the selection and of the
+// stacks requiring them are picked. Stacks are picked starting with the ones no other stack
+// requires without revisiting a pick. Returns an error listing all unknown stack names with
+// suggestions for the names the user might have meant or the constraints no version meets.
+func (s Stacks) Chain(names ...string) (*Chain, error) {
+	var errs []error
+	order := make([]string, 0, len(names))
+	selected := make(map[string]string, len(names))
+	for _, ref := range names {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			continue // like the trailing comma of -stacks dhis2-core,
+		}
+		_, err := s.Get(ref)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		name, constraint := splitRef(ref)
+		prev, ok := selected[name]
+		if !ok {
+			order = append(order, name)
+		}
+		if prev != "" && constraint != "" {
+			constraint = prev + ", " + constraint
+		} else if prev != "" {
+			constraint = prev
+		}
+		selected[name] = constraint
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("no stacks selected")
+	}
+
+	picked, err := s.pick(selected)
+	if err != nil {
+		return nil, err
+	}
+
+	// link the picked versions so required stacks are the picked ones
+	linked := make(map[string]Stack, len(picked))
+	var link func(name string) Stack
+	link = func(name string) Stack {
+		if st, ok := linked[name]; ok {
+			return st
+		}
+		st := picked[name]
+		requires := make([]Stack, 0, len(st.Requires))
+		for _, dest := range st.Requires {
+			requires = append(requires, link(dest.Name))
+		}
+		st.Requires = requires
+		linked[name] = st
+		return st
+	}
+	all := make([]Stack, 0, len(picked))
+	for _, name := range sortedStackNames(picked) {
+		all = append(all, link(name))
+	}
+	if _, err := New(all...); err != nil {
+		return nil, fmt.Errorf("invalid chain: %w", err)
+	}
+
+	result := make([]Stack, 0, len(order))
+	for _, name := range order {
+		result = append(result, linked[name])
+	}
+	return NewChain(result...)
+}
+
+// pick picks a version of the selected stacks and the stacks they require. Selected is keyed by
+// stack name with the constraint on its version as value.
+func (s Stacks) pick(selected map[string]string) (map[string]Stack, error) {
+	all := make([]Stack, 0, len(s))
+	for _, id := range sortedStackNames(s) {
+		all = append(all, s[id])
+	}
+	requires := requirements(all)
+
+	// order stacks so that stacks come before the stacks they require. All constraints on a stack
+	// are thus known by the time it is picked.
+	var order []string
+	visited := make(map[string]struct{})
+	var visit func(name string)
+	visit = func(name string) {
+		if _, ok := visited[name]; ok {
+			return
+		}
+		visited[name] = struct{}{}
+		dests := append([]string(nil), requires[name]...)
+		sort.Strings(dests)
+		for _, dest := range dests {
+			visit(dest)
+		}
+		order = append(order, name)
+	}
+	names := make([]string, 0, len(selected))
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		visit(name)
+	}
+
+	constraints := make(map[string]map[string]string, len(order))
+	for name, c := range selected {
+		constraints[name] = map[string]string{"": c}
+	}
+	var errs []error
+	picked := make(map[string]Stack, len(order))
+	for i := len(order) - 1; i >= 0; i-- {
+		name := order[i]
+		cs, ok := constraints[name]
+		if !ok {
+			continue // only required by versions that have not been picked
+		}
+		st, err := s.pickVersion(name, cs)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		picked[name] = st
+		for _, dest := range st.Requires {
+			if constraints[dest.Name] == nil {
+				constraints[dest.Name] = make(map[string]string)
+			}
+			constraints[dest.Name][st.Name] = st.Constraints[dest.Name]
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return picked, nil
+}
+
+// pickVersion returns the latest version of the stack meeting all constraints. Constraints are
+// keyed by the name of the stack requiring the stack. Empty constraints are met by any version.
+func (s Stacks) pickVersion(name string, constraints map[string]string) (Stack, error) {
+	versions := s.Versions(name)
+	if len(versions) == 0 {
+		return Stack{}, s.unknownStackError(name)
+	}
+
+	parsed := make([]Constraint, 0, len(constraints))
+	nonEmpty := make(map[string]string, len(constraints))
+	for k, v := range constraints {
+		if v == "" {
+			continue
+		}
+		c, err := ParseConstraint(v)
+		if err != nil {
+			return Stack{}, err
+		}
+		parsed = append(parsed, c)
+		nonEmpty[k] = v
+	}
+	if len(parsed) == 0 {
+		return versions[0], nil
+	}
+
+	available := make([]string, 0, len(versions))
+	for _, st := range versions {
+		available = append(available, st.Version)
+		v, err := ParseVersion(st.Version)
+		if err != nil {
+			continue
+		}
+		ok := true
+		for _, c := range parsed {
+			ok = ok && c.Check(v)
+		}
+		if ok {
+			return st, nil
+		}
+	}
+	return Stack{}, &UnsatisfiableConstraintError{
+		Stack:       name,
+		Constraints: nonEmpty,
+		Versions:    sortedVersions(available),
+	}
+}
+
+// Get returns the latest version of the stack with given name. The name can constrain the version
+// like dhis2-db@^16 or dhis2-db@16.0.0. Returns an error with suggestions for the names the user
+// might have meant if there is no such stack.
+func (s Stacks) Get(name string) (Stack, error) {
+	name, constraint := splitRef(name)
+	return s.pickVersion(name, map[string]string{"": constraint})
+}
+
+// Versions returns all versions of the stack with given name ordered from latest to oldest.
+func (s Stacks) Versions(name string) []Stack {
+	var result []Stack
+	for _, st := range s {
+		if st.Name == name {
+			result = append(result, st)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		vi, _ := ParseVersion(result[i].Version)
+		vj, _ := ParseVersion(result[j].Version)
+		return vi.Compare(vj) > 0
+	})
+	return result
+}
+
+// splitRef splits a stack reference like dhis2-db@^16 into the stack name and the constraint on
+// its version.
+func splitRef(ref string) (name, constraint string) {
+	name, constraint, _ = strings.Cut(ref, "@")
+	return name, constraint
+}
+
+func sortedStackNames(stacks map[string]Stack) []string {
+	result := make([]string, 0, len(stacks))
+	for k := range stacks {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s Stacks) unknownStackError(name string) error {
+	suggestions := s.suggest(name)
+	if len(suggestions) == 0 {
+		return fmt.Errorf("unknown stack %q", name)
+	}
+
+	quoted := make([]string, len(suggestions))
+	for i, v := range suggestions {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	return fmt.Errorf("unknown stack %q, did you mean %s?", name, strings.Join(quoted, " or "))
+}
+
+// suggest returns the names of stacks similar to name ordered by similarity.
+func (s Stacks) suggest(name string) []string {
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	var suggestions []suggestion
+	maxDistance := len(name) / 3
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+	seen := make(map[string]struct{}, len(s))
+	for _, st := range s {
+		k := st.Name
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		d := levenshtein(strings.ToLower(name), strings.ToLower(k))
+		if d <= maxDistance || (name != "" && strings.Contains(k, name)) {
+			suggestions = append(suggestions, suggestion{name: k, distance: d})
+		}
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
+		}
+		return suggestions[i].name < suggestions[j].name
+	})
+
+	result := make([]string, len(suggestions))
+	for i, v := range suggestions {
+		result[i] = v.name
+	}
+	return result
+}
+
+// levenshtein computes the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(values ...int) int {
+	result := values[0]
+	for _, v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+	return result
+}
@@ -4,8 +4,12 @@
 package stack
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 
 	"github.com/dominikbraun/graph"
 )
@@ -14,6 +18,9 @@ type Stacks map[string]Stack
 
 type Stack struct {
 	Name string
+	// Version is the semantic version of the stack like 16.0.0. Stacks can have multiple versions
+	// which are told apart by their ID. A stack without version can only be defined once.
+	Version string
 	// File is the path to the helmfile.
 	File string
 	// Parameters used by the stacks helmfile template.
@@ -22,13 +29,110 @@ type Stack struct {
 	Providers map[string]Provider
 	// Requires these stacks to deploy an instance of this stack.
 	Requires []Stack
+	// Mappings map consumed parameters to differently named parameters or providers of a required
+	// stack. Mappings are keyed by the name of the required stack.
+	Mappings map[string]Mapping
+	// Constraints on the versions of required stacks keyed by the name of the required stack. See
+	// Constraint for the syntax. Chains pick the latest versions meeting all constraints.
+	Constraints map[string]string
+	// Hooks run in phases of the lifecycle of the stacks instances in the order they are declared.
+	Hooks []Hook
+	// Readiness checks that an instance is ready before instances requiring it are deployed. Nil if
+	// instances are ready once deployed.
+	Readiness *Readiness
+	// Retry policy for deploying and destroying instances. Nil if failures are not retried.
+	Retry *Retry
+}
+
+// ID identifies a version of a stack by its name and version like dhis2-db@16.0.0. The ID of a
+// stack without version is its name.
+func (s Stack) ID() string {
+	if s.Version == "" {
+		return s.Name
+	}
+	return s.Name + "@" + s.Version
+}
+
+// Mapping maps the names of consumed parameters to the names of the parameters or providers of a
+// required stack they consume. Consumed parameters without mapping consume the parameter or
+// provider of the same name.
+type Mapping map[string]string
+
+// source returns the name of the parameter or provider of required stack dest that the consumed
+// parameter name consumes.
+func (s Stack) source(dest, name string) string {
+	if v, ok := s.Mappings[dest][name]; ok {
+		return v
+	}
+	return name
 }
 
 // Parameter is a stack parameter.
 type Parameter struct {
-	Value string
+	Value string `json:"value"`
 	// Consumed signals that this parameter is provided by another i.e. one of the stacks required stacks.
-	Consumed bool
+	Consumed bool `json:"consumed,omitempty"`
+	// Origin is the instance that originally provided a resolved consumed parameter. This is not
+	// necessarily the instance it was consumed from as consumed parameters are passed through.
+	Origin *Origin `json:"origin,omitempty"`
+	// Type of the parameter value. Values are strings if empty. Consumed parameters declare the type
+	// they expect from the instance they consume them from.
+	Type Type `json:"type,omitempty"`
+	// Sensitive values like passwords are redacted wherever parameters are written for debugging.
+	// Consumed parameters declare whether they are sensitive as well.
+	Sensitive bool `json:"sensitive,omitempty"`
+}
+
+// Type of a parameter value. Parameter values are always passed around as strings. The type
+// decides which strings are valid and how values are rendered where types are preserved like in
+// helmfile state values.
+type Type string
+
+// Parameter types.
+const (
+	String Type = "string"
+	Int    Type = "int"
+	Bool   Type = "bool"
+	Number Type = "number"
+)
+
+func (t Type) known() bool {
+	switch t {
+	case "", String, Int, Bool, Number:
+		return true
+	}
+	return false
+}
+
+// Check checks that the value is valid for the type.
+func (t Type) Check(value string) error {
+	switch t {
+	case "", String:
+		return nil
+	case Int:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("value %q must be an int", value)
+		}
+	case Bool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("value %q must be a bool", value)
+		}
+	case Number:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("value %q must be a finite number", value)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", t)
+	}
+	return nil
+}
+
+// Origin of a consumed parameter.
+type Origin struct {
+	Instance string `json:"instance"`
+	Group    string `json:"group"`
+	Stack    string `json:"stack"`
 }
 
 // Provides a stack parameters value.
@@ -42,12 +146,62 @@ func (p ProviderFunc) Provide(instance Instance) (string, error) {
 	return p(instance)
 }
 
+// Dependent is implemented by providers that depend on other parameters or providers of the stack
+// declaring them. Providers a provider depends on are evaluated first and passed to it as instance
+// parameters.
+type Dependent interface {
+	DependsOn() []string
+}
+
+// WithDependencies declares that the provider depends on the parameters or providers with given
+// names in addition to the ones it might already depend on.
+func WithDependencies(p Provider, names ...string) Provider {
+	var dependsOn []string
+	if d, ok := p.(Dependent); ok {
+		dependsOn = append(dependsOn, d.DependsOn()...)
+	}
+	return dependentProvider{Provider: p, dependsOn: append(dependsOn, names...)}
+}
+
+// SelfProvider is implemented by providers whose value the instance providing it needs itself like
+// a generated database password. Resolving an instance sets the values of these providers of its
+// stack as sensitive parameters of the instance named after the provider.
+type SelfProvider interface {
+	ProvidesSelf() bool
+}
+
+// ProvidesSelf reports whether the instance providing the value of p receives it as well.
+func ProvidesSelf(p Provider) bool {
+	sp, ok := p.(SelfProvider)
+	return ok && sp.ProvidesSelf()
+}
+
+type dependentProvider struct {
+	Provider
+	dependsOn []string
+}
+
+func (d dependentProvider) DependsOn() []string {
+	return d.dependsOn
+}
+
+func (d dependentProvider) ProvidesSelf() bool {
+	return ProvidesSelf(d.Provider)
+}
+
+func (d dependentProvider) ProvideContext(ctx context.Context, instance Instance) (string, error) {
+	return provideContext(ctx, d.Provider, instance)
+}
+
 // Instance of a stack which has all the parameters needed to deploy the instance.
 type Instance struct {
 	Name       string
 	Group      string
 	Stack      Stack
 	Parameters map[string]Parameter
+	// Requires these instances i.e. the instances this instance is linked to and consumes
+	// parameters from.
+	Requires []Instance
 }
 
 // Chain of stacks to be deployed in order.
@@ -58,60 +212,234 @@ type Chain struct {
 	Chain   []Stack
 }
 
-// New creates stacks ensuring consumed parameters are provided by required stacks.
+// New creates stacks ensuring stacks are unique, required stacks are part of the stacks, consumed
+// parameters are provided by required stacks and providers only depend on parameters or providers
+// of their stack without cycles. All issues found are reported together. Use errors.As to inspect
+// errors of the types in this package or Issues to flatten them.
 func New(stacks ...Stack) (Stacks, error) {
-	err := validateConsumedParams(stacks)
-	if err != nil {
-		return nil, err
-	}
-
-	err = validateNoCycles(stacks)
+	err := errors.Join(
+		validateUnique(stacks),
+		validateVersions(stacks),
+		validateRequiredStacks(stacks),
+		validateNames(stacks),
+		validateTypes(stacks),
+		validateHooks(stacks),
+		validateReadiness(stacks),
+		validateRetries(stacks),
+		validateConsumedParams(stacks),
+		validateMappings(stacks),
+		validateProviders(stacks),
+		validateNoCycles(stacks),
+	)
 	if err != nil {
 		return nil, err
 	}
 
 	result := make(Stacks, len(stacks))
 	for _, s := range stacks {
-		result[s.Name] = s
+		result[s.ID()] = s
 	}
 	return result, nil
 }
 
+// validateNames ensures a stack does not declare a parameter and a provider of the same name as
+// that makes it an ambiguous source for its consumers.
+func validateNames(stacks []Stack) error {
+	var errs []error
+	for _, s := range stacks {
+		for _, k := range sortedParameterNames(s.Parameters) {
+			if _, ok := s.Providers[k]; ok {
+				errs = append(errs, fmt.Errorf("stack %q declares %q as both parameter and provider", s.Name, k))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateTypes ensures parameter types are known and default values match them.
+func validateTypes(stacks []Stack) error {
+	var errs []error
+	for _, s := range stacks {
+		for _, k := range sortedParameterNames(s.Parameters) {
+			p := s.Parameters[k]
+			if !p.Type.known() {
+				errs = append(errs, fmt.Errorf("stack %q parameter %q has unknown type %q", s.Name, k, p.Type))
+				continue
+			}
+			if p.Consumed || p.Value == "" {
+				continue
+			}
+			if err := p.Type.Check(p.Value); err != nil {
+				errs = append(errs, fmt.Errorf("stack %q parameter %q has invalid default: %v", s.Name, k, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
 func validateConsumedParams(stacks []Stack) error {
 	var errs []error
 	for _, s := range stacks { // validate each stacks consumed parameters are provided by its required stacks
 		// collect all consumed parameters
-		freq := make(map[string]int)
+		consumedParams := make(map[string]struct{})
 		for k, p := range s.Parameters {
 			if !p.Consumed {
 				continue
 			}
-			freq[k] = 0
+			consumedParams[k] = struct{}{}
 		}
 
-		// generate frequency map of provided parameters
+		// collect the required stacks providing every consumed parameter. A consumed parameter of a
+		// required stack counts as well as it passes the value it consumed through to this stack.
+		requires := make([]string, 0, len(s.Requires))
 		for _, dest := range s.Requires {
-			// TODO does it matter if a consumed parameter is itself a consumed parameter on the required stack?
-			// as long as we have no cycles its not a problem.
-			for n := range dest.Parameters {
-				_, ok := freq[n]
-				if ok {
-					freq[n]++
+			requires = append(requires, dest.Name)
+		}
+		providers := make(map[string][]string, len(consumedParams))
+		for k := range consumedParams {
+			for _, dest := range s.Requires {
+				n := s.source(dest.Name, k)
+				if _, ok := dest.Parameters[n]; ok {
+					providers[k] = append(providers[k], dest.Name)
+				}
+				if _, ok := dest.Providers[n]; ok {
+					providers[k] = append(providers[k], dest.Name)
 				}
 			}
-			for n := range dest.Providers {
-				_, ok := freq[n]
-				if ok {
-					freq[n]++
+		}
+		consumed := make([]string, 0, len(consumedParams))
+		for p := range consumedParams {
+			consumed = append(consumed, p)
+		}
+		sort.Strings(consumed)
+		for _, p := range consumed {
+			switch cnt := len(providers[p]); {
+			case cnt == 0:
+				errs = append(errs, &UnmetParameterError{Stack: s.Name, Parameter: p, Requires: requires})
+			case cnt == 1:
+				_, _, err := s.Origin(p)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("no origin for stack %q parameter %q: %v", s.Name, p, err))
 				}
+			default:
+				errs = append(errs, &AmbiguousProviderError{Stack: s.Name, Parameter: p, Providers: providers[p]})
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateMappings ensures mappings only map consumed parameters to parameters or providers of
+// required stacks.
+func validateMappings(stacks []Stack) error {
+	var errs []error
+	for _, s := range stacks {
+		dests := make([]string, 0, len(s.Mappings))
+		for k := range s.Mappings {
+			dests = append(dests, k)
+		}
+		sort.Strings(dests)
+
+		for _, destName := range dests {
+			var dest *Stack
+			for i := range s.Requires {
+				if s.Requires[i].Name == destName {
+					dest = &s.Requires[i]
+				}
+			}
+			if dest == nil {
+				errs = append(errs, fmt.Errorf("stack %q maps parameters of stack %q which it does not require", s.Name, destName))
+				continue
+			}
+
+			mapping := s.Mappings[destName]
+			names := make([]string, 0, len(mapping))
+			for k := range mapping {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			for _, k := range names {
+				if p, ok := s.Parameters[k]; !ok || !p.Consumed {
+					errs = append(errs, fmt.Errorf("stack %q maps parameter %q which it does not consume", s.Name, k))
+					continue
+				}
+				_, isParam := dest.Parameters[mapping[k]]
+				_, isProvider := dest.Providers[mapping[k]]
+				if !isParam && !isProvider {
+					errs = append(errs, fmt.Errorf("stack %q maps parameter %q to %q which stack %q does not provide", s.Name, k, mapping[k], destName))
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Origin returns the stack originally providing the consumed parameter name and the name the
+// parameter has on that stack. The parameter is followed through the required stacks that consume
+// it themselves until a stack declaring it as a parameter or provider is found. Mappings are
+// followed as well.
+func (s Stack) Origin(name string) (Stack, string, error) {
+	return s.origin(name, make(map[string]struct{}))
+}
+
+func (s Stack) origin(name string, visited map[string]struct{}) (Stack, string, error) {
+	if _, ok := visited[s.Name]; ok {
+		return Stack{}, "", fmt.Errorf("parameter %q is consumed in a cycle through stack %q", name, s.Name)
+	}
+	visited[s.Name] = struct{}{}
+
+	for _, dest := range s.Requires {
+		n := s.source(dest.Name, name)
+		if p, ok := dest.Parameters[n]; ok {
+			if p.Consumed {
+				return dest.origin(n, visited)
 			}
+			return dest, n, nil
 		}
-		for p, cnt := range freq {
-			if cnt == 0 {
-				errs = append(errs, fmt.Errorf("no provider for stack %q parameter %q", s.Name, p))
+		if _, ok := dest.Providers[n]; ok {
+			return dest, n, nil
+		}
+	}
+
+	return Stack{}, "", fmt.Errorf("no stack required by %q provides parameter %q", s.Name, name)
+}
+
+func validateProviders(stacks []Stack) error {
+	var errs []error
+	for _, s := range stacks {
+		g := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		names := make([]string, 0, len(s.Providers))
+		for k := range s.Providers {
+			names = append(names, k)
+			_ = g.AddVertex(k)
+		}
+		sort.Strings(names)
+
+		for _, k := range names {
+			d, ok := s.Providers[k].(Dependent)
+			if !ok {
+				continue
 			}
-			if cnt > 1 {
-				errs = append(errs, fmt.Errorf("every consumed parameter must have exactly one provider. %d provider(s) for stack %q parameter %q", cnt, s.Name, p))
+			for _, dep := range d.DependsOn() {
+				if _, ok := s.Parameters[dep]; ok {
+					continue
+				}
+				if _, ok := s.Providers[dep]; !ok {
+					errs = append(errs, fmt.Errorf("invalid provider for stack %q parameter %q: depends on unknown parameter %q", s.Name, k, dep))
+					continue
+				}
+				err := g.AddEdge(dep, k)
+				if errors.Is(err, graph.ErrEdgeCreatesCycle) || dep == k {
+					errs = append(errs, fmt.Errorf("invalid provider for stack %q parameter %q: dependency on %q creates cycle", s.Name, k, dep))
+					continue
+				}
+				if err != nil && !errors.Is(err, graph.ErrEdgeAlreadyExists) {
+					errs = append(errs, fmt.Errorf("failed adding edge %q -> %q: %v", dep, k, err))
+				}
 			}
 		}
 	}
@@ -119,34 +447,207 @@ func validateConsumedParams(stacks []Stack) error {
 	return errors.Join(errs...)
 }
 
+// validateNoCycles ensures stacks do not require each other. Every cycle is reported.
 func validateNoCycles(stacks []Stack) error {
-	g := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	var errs []error
+	for _, path := range cycles(requirements(stacks)) {
+		errs = append(errs, &CycleError{Path: path})
+	}
+	return errors.Join(errs...)
+}
+
+// requirements returns the names of the required stacks keyed by stack name. The requirements of
+// all versions of a stack are combined. Given stacks take precedence over required stacks of the
+// same name.
+func requirements(stacks []Stack) map[string][]string {
+	result := make(map[string][]string)
+	add := func(s Stack) {
+		names := result[s.Name]
+		if names == nil {
+			names = make([]string, 0, len(s.Requires))
+		}
+		for _, dest := range s.Requires {
+			names = append(names, dest.Name)
+		}
+		result[s.Name] = names
+	}
 	for _, s := range stacks {
-		err := g.AddVertex(s.Name)
-		if err != nil {
-			return fmt.Errorf("failed adding vertex %q: %v", s.Name, err)
+		add(s)
+	}
+	var walk func(s Stack)
+	walk = func(s Stack) {
+		for _, dest := range s.Requires {
+			if _, ok := result[dest.Name]; !ok {
+				add(dest)
+				walk(dest)
+			}
 		}
 	}
-	for _, src := range stacks {
-		for _, dest := range src.Requires {
-			err := g.AddEdge(dest.Name, src.Name)
-			if err != nil {
-				if errors.Is(err, graph.ErrEdgeCreatesCycle) {
-					return fmt.Errorf("edge %q -> %q creates cycle", dest.Name, src.Name)
+	for _, s := range stacks {
+		walk(s)
+	}
+	return result
+}
+
+// cycles returns every cycle in given requirements as a path of stack names in which each stack
+// requires the next one. Paths start and end with the same stack so a stack requiring itself
+// is reported as a path of two. Each path starts with its smallest stack name and paths are
+// sorted.
+func cycles(requires map[string][]string) [][]string {
+	names := make([]string, 0, len(requires))
+	for name := range requires {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result [][]string
+	for _, start := range names {
+		// only visit stacks ordered after start so every cycle is found once starting at its
+		// smallest stack
+		onPath := map[string]bool{start: true}
+		path := []string{start}
+		var visit func(name string)
+		visit = func(name string) {
+			seen := make(map[string]struct{}, len(requires[name]))
+			dests := append([]string(nil), requires[name]...)
+			sort.Strings(dests)
+			for _, dest := range dests {
+				if _, ok := seen[dest]; ok {
+					continue
+				}
+				seen[dest] = struct{}{}
+
+				if dest == start {
+					cycle := make([]string, len(path), len(path)+1)
+					copy(cycle, path)
+					result = append(result, append(cycle, start))
+					continue
 				}
-				return fmt.Errorf("failed adding edge %q -> %q: %v", dest.Name, src.Name, err)
+				if dest < start || onPath[dest] {
+					continue
+				}
+				onPath[dest] = true
+				path = append(path, dest)
+				visit(dest)
+				path = path[:len(path)-1]
+				onPath[dest] = false
 			}
 		}
+		visit(start)
 	}
+	return result
+}
 
-	return nil
+// validateUnique ensures stack IDs are unique. A stack without version must be the only stack of
+// its name.
+func validateUnique(stacks []Stack) error {
+	var errs []error
+	seen := make(map[string]struct{}, len(stacks))
+	unversioned := make(map[string]int, len(stacks))
+	versioned := make(map[string]int, len(stacks))
+	for _, s := range stacks {
+		if s.Version == "" {
+			unversioned[s.Name]++
+		} else {
+			versioned[s.Name]++
+		}
+		if _, ok := seen[s.ID()]; ok {
+			errs = append(errs, &DuplicateStackError{Stack: s.Name, Version: s.Version})
+			continue
+		}
+		seen[s.ID()] = struct{}{}
+	}
+	for _, s := range stacks {
+		if s.Version == "" && unversioned[s.Name] == 1 && versioned[s.Name] > 0 {
+			errs = append(errs, &DuplicateStackError{Stack: s.Name})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateVersions ensures stack versions and the constraints on the versions of required stacks
+// are valid.
+func validateVersions(stacks []Stack) error {
+	var errs []error
+	for _, s := range stacks {
+		if s.Version != "" {
+			if _, err := ParseVersion(s.Version); err != nil {
+				errs = append(errs, fmt.Errorf("invalid stack %q: %v", s.Name, err))
+			}
+		}
+		names := make([]string, 0, len(s.Constraints))
+		for k := range s.Constraints {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !requires(s, name) {
+				errs = append(errs, fmt.Errorf("invalid constraint for stack %q: does not require stack %q", s.Name, name))
+			}
+			if _, err := ParseConstraint(s.Constraints[name]); err != nil {
+				errs = append(errs, fmt.Errorf("invalid constraint for stack %q on stack %q: %v", s.Name, name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func requires(s Stack, name string) bool {
+	for _, dest := range s.Requires {
+		if dest.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRequiredStacks ensures required stacks are part of the stacks in a version meeting the
+// constraint on them.
+func validateRequiredStacks(stacks []Stack) error {
+	versions := make(map[string][]string, len(stacks))
+	for _, s := range stacks {
+		versions[s.Name] = append(versions[s.Name], s.Version)
+	}
+
+	var errs []error
+	for _, s := range stacks {
+		for _, dest := range s.Requires {
+			available, ok := versions[dest.Name]
+			if !ok {
+				errs = append(errs, &MissingRequiredStackError{Stack: s.Name, Required: dest.Name})
+				continue
+			}
+			text, ok := s.Constraints[dest.Name]
+			if !ok {
+				continue
+			}
+			c, err := ParseConstraint(text)
+			if err != nil {
+				continue // reported by validateVersions
+			}
+			if len(matchingVersions(c, available)) == 0 {
+				errs = append(errs, &UnsatisfiableConstraintError{
+					Stack:       dest.Name,
+					Constraints: map[string]string{s.Name: text},
+					Versions:    sortedVersions(available),
+				})
+			}
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 // NewChain creates a stack chain of the given stacks. All stacks and their required stacks will be
 // added to the chain in topological order. Any duplicate stacks will be ignored. Returns an error
 // if given stacks contain a cycle.
-// TODO some validation of stacks: cycles
 func NewChain(stacks ...Stack) (*Chain, error) {
+	if err := validateNoCycles(stacks); err != nil {
+		return nil, err
+	}
+
 	c := Chain{
 		visited: make(map[string]struct{}, len(stacks)),
 		stacks:  stacks,
@@ -175,24 +676,57 @@ func (c *Chain) dfs(stack Stack) {
 	c.Chain = append(c.Chain, stack)
 }
 
+// Names returns the names of the stacks in the chain in deployment order.
+func (c *Chain) Names() []string {
+	result := make([]string, 0, len(c.Chain))
+	for _, s := range c.Chain {
+		result = append(result, s.Name)
+	}
+	return result
+}
+
+// IDs returns the IDs of the stacks in the chain in deployment order. Unlike names IDs include the
+// versions picked for versioned stacks.
+func (c *Chain) IDs() []string {
+	result := make([]string, 0, len(c.Chain))
+	for _, s := range c.Chain {
+		result = append(result, s.ID())
+	}
+	return result
+}
+
 // Add stack to the chain. Stack will be ignored if its already part of the chain. The chain is
 // kept in topological order. Returns an error if adding the stack would cause a cycle.
 func (c *Chain) Add(stack Stack) (*Chain, error) {
 	return c, nil
 }
 
+// Default creates the stacks we currently have in the instance manager.
+func Default() (Stacks, error) {
+	return New(
+		DHIS2Core,
+		DHIS2DB,
+		PgAdmin,
+		DHIS2,
+		WhoamiGo,
+	)
+}
+
 // Stack representing https://github.com/dhis2-sre/im-manager/blob/df95b498828ec7e2bb85245bf0e6a051f14f61fd/stacks/dhis2-db/helmfile.yaml
 // Note: parameters are incomplete and might differ.
 var DHIS2DB = Stack{
 	Name: "dhis2-db",
 	Parameters: map[string]Parameter{
-		"DATABASE_ID":       {},
+		"DATABASE_ID":       {Type: Int},
 		"DATABASE_USERNAME": {},
-		"DATABASE_PASSWORD": {},
+		"DATABASE_PASSWORD": {Sensitive: true},
 		"DATABASE_NAME":     {},
+		"DATABASE_SIZE":     {Value: "20Gi"},
 	},
 	Providers: map[string]Provider{
 		"DATABASE_HOSTNAME": postgresHostNameProvider,
+		// derived from another provider and a parameter of this stack
+		"DATABASE_JDBC_URL": MustTemplateProvider("jdbc:postgresql://{{.Parameters.DATABASE_HOSTNAME}}/{{.Parameters.DATABASE_NAME}}"),
 		"DATABASE_GREETING": ProviderFunc(func(instance Instance) (string, error) {
 			return fmt.Sprintf("hello from stack %q instance %q", instance.Stack.Name, instance.Name), nil
 		}),
@@ -211,7 +745,8 @@ var DHIS2Core = Stack{
 			Consumed: true,
 		},
 		"DATABASE_PASSWORD": {
-			Consumed: true,
+			Consumed:  true,
+			Sensitive: true,
 		},
 		"DATABASE_NAME": {
 			Consumed: true,
@@ -237,7 +772,7 @@ var DHIS2 = Stack{
 			Value: "/opt/dhis2",
 		},
 		"DATABASE_USERNAME": {},
-		"DATABASE_PASSWORD": {},
+		"DATABASE_PASSWORD": {Sensitive: true},
 		"DATABASE_NAME":     {},
 	},
 	Providers: map[string]Provider{
@@ -251,12 +786,13 @@ var PgAdmin = Stack{
 	Name: "pgadmin",
 	Parameters: map[string]Parameter{
 		"PGADMIN_USERNAME": {},
-		"PGADMIN_PASSWORD": {},
+		"PGADMIN_PASSWORD": {Sensitive: true},
 		"DATABASE_USERNAME": {
 			Consumed: true,
 		},
 		"DATABASE_PASSWORD": {
-			Consumed: true,
+			Consumed:  true,
+			Sensitive: true,
 		},
 		"DATABASE_NAME": {
 			Consumed: true,
@@ -278,6 +814,10 @@ var WhoamiGo = Stack{
 		"REPLICA_COUNT": {
 			Value: "1",
 		},
+		// seconds after which the instance is destroyed. 0 means it is never destroyed.
+		"INSTANCE_TTL": {
+			Value: "0",
+		},
 	},
 }
 
@@ -285,10 +825,8 @@ var WhoamiGo = Stack{
 // https://github.com/dhis2-sre/im-manager/blob/df95b498828ec7e2bb85245bf0e6a051f14f61fd/stacks/im-job-runner/helmfile.yaml
 
 // Provides the PostgreSQL hostname as previously done by the hostname pattern.
-// Leveraging code as data and the Provider interface we can create reusable providers using any
-// data an instance or its stack has. A Provider could in theory also reach out over the network to
-// fetch some information. In this case I would suggest we add https://pkg.go.dev/context to the
-// signature to enable timing out.
-var postgresHostNameProvider = ProviderFunc(func(instance Instance) (string, error) {
-	return fmt.Sprintf("%s-database-postgresql.%s.svc", instance.Name, instance.Group), nil
-})
+// The pattern is data instead of code using a TemplateProvider. Leveraging the Provider interface
+// we can still create reusable providers in code using any data an instance or its stack has. A
+// Provider could in theory also reach out over the network to fetch some information. In this case
+// I would suggest we add https://pkg.go.dev/context to the signature to enable timing out.
+var postgresHostNameProvider = MustTemplateProvider("{{.Name}}-database-postgresql.{{.Group}}.svc")
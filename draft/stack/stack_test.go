@@ -1,8 +1,18 @@
 package stack_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/teleivo/providers/stack"
@@ -76,6 +86,13 @@ func TestNew(t *testing.T) {
 		if want := `stack "b" parameter "a_param"`; !strings.Contains(err.Error(), want) {
 			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
 		}
+		var unmet *stack.UnmetParameterError
+		if !errors.As(err, &unmet) {
+			t.Fatalf("want error of type %T, instead got %v", unmet, err)
+		}
+		if diff := cmp.Diff(&stack.UnmetParameterError{Stack: "b", Parameter: "a_param", Requires: []string{"a"}}, unmet); diff != "" {
+			t.Errorf("error mismatch (-want +got):\n%s", diff)
+		}
 	})
 
 	t.Run("FailGivenStackWithUnmetConsumedParameterDueToMissingProvider", func(t *testing.T) {
@@ -137,10 +154,92 @@ func TestNew(t *testing.T) {
 		if want := `stack "c" parameter "a_param"`; !strings.Contains(err.Error(), want) {
 			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
 		}
+		var ambiguous *stack.AmbiguousProviderError
+		if !errors.As(err, &ambiguous) {
+			t.Fatalf("want error of type %T, instead got %v", ambiguous, err)
+		}
+		want := &stack.AmbiguousProviderError{Stack: "c", Parameter: "a_param", Providers: []string{"a", "b"}}
+		if diff := cmp.Diff(want, ambiguous); diff != "" {
+			t.Errorf("error mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenStackWithParameterAndProviderOfSameName", func(t *testing.T) {
+		a := stack.Stack{
+			Name: "a",
+			Parameters: map[string]stack.Parameter{
+				"a_param": {},
+			},
+			Providers: map[string]stack.Provider{
+				"a_param": provider,
+			},
+		}
+
+		_, err := stack.New(a)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `stack "a" declares "a_param" as both parameter and provider`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("FailGivenStackWithConsumedParameterButNoRequiredStack", func(t *testing.T) {
+		a := stack.Stack{
+			Name: "a",
+			Parameters: map[string]stack.Parameter{
+				"a_param": {
+					Consumed: true,
+				},
+			},
+		}
+
+		_, err := stack.New(a)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `stack "a" consumes parameter "a_param" but does not require any stack`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("FailReportingAllIssues", func(t *testing.T) {
+		a := stack.Stack{
+			Name: "a",
+			Parameters: map[string]stack.Parameter{
+				"a_param": {},
+			},
+			Providers: map[string]stack.Provider{
+				"a_param": provider,
+			},
+		}
+		b := stack.Stack{
+			Name: "b",
+			Parameters: map[string]stack.Parameter{
+				"b_param": {
+					Consumed: true,
+				},
+			},
+			Requires: []stack.Stack{a},
+		}
+		a.Requires = []stack.Stack{b}
+
+		_, err := stack.New(a, b)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		for _, want := range []string{
+			`stack "a" declares "a_param" as both parameter and provider`,
+			`no provider for stack "b" parameter "b_param"`,
+			`cycle of required stacks "a" -> "b" -> "a"`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
 	})
 
 	t.Run("FailGivenStackWithMissingRequiredStack", func(t *testing.T) {
-		t.Skip("TODO this is possible. Not sure if we could prevent this using a different API.")
 		a := stack.Stack{
 			Name: "a",
 			Parameters: map[string]stack.Parameter{
@@ -161,8 +260,28 @@ func TestNew(t *testing.T) {
 		if err == nil {
 			t.Fatalf("expected error got none")
 		}
-		if want := `TODO`; !strings.Contains(err.Error(), want) {
-			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		var missing *stack.MissingRequiredStackError
+		if !errors.As(err, &missing) {
+			t.Fatalf("want error of type %T, instead got %v", missing, err)
+		}
+		if diff := cmp.Diff(&stack.MissingRequiredStackError{Stack: "b", Required: "a"}, missing); diff != "" {
+			t.Errorf("error mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenDuplicateStacks", func(t *testing.T) {
+		a := stack.Stack{Name: "a"}
+
+		_, err := stack.New(a, a)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		var duplicate *stack.DuplicateStackError
+		if !errors.As(err, &duplicate) {
+			t.Fatalf("want error of type %T, instead got %v", duplicate, err)
+		}
+		if duplicate.Stack != "a" {
+			t.Errorf("want duplicate stack %q, instead got %q", "a", duplicate.Stack)
 		}
 	})
 
@@ -188,12 +307,67 @@ func TestNew(t *testing.T) {
 		if err == nil {
 			t.Fatalf("expected error got none")
 		}
-		if want := `edge "a" -> "b" creates cycle`; !strings.Contains(err.Error(), want) {
+		if want := `cycle of required stacks "a" -> "b" -> "a"`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+		var cycle *stack.CycleError
+		if !errors.As(err, &cycle) {
+			t.Fatalf("want error of type %T, instead got %v", cycle, err)
+		}
+	})
+
+	t.Run("FailGivenStackRequiringItself", func(t *testing.T) {
+		a := stack.Stack{Name: "a"}
+		a.Requires = []stack.Stack{a}
+
+		_, err := stack.New(a)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `stack "a" requires itself`; !strings.Contains(err.Error(), want) {
 			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
 		}
+		if diff := cmp.Diff([][]string{{"a", "a"}}, cyclePaths(err)); diff != "" {
+			t.Errorf("cycles mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailReportingEveryCycle", func(t *testing.T) {
+		a := stack.Stack{Name: "a"}
+		b := stack.Stack{Name: "b"}
+		c := stack.Stack{Name: "c"}
+		d := stack.Stack{Name: "d"}
+		a.Requires = []stack.Stack{b}
+		b.Requires = []stack.Stack{c, {Name: "a"}}
+		c.Requires = []stack.Stack{{Name: "a"}}
+		d.Requires = []stack.Stack{{Name: "d"}}
+
+		_, err := stack.New(a, b, c, d)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+
+		want := [][]string{
+			{"a", "b", "a"},
+			{"a", "b", "c", "a"},
+			{"d", "d"},
+		}
+		if diff := cmp.Diff(want, cyclePaths(err)); diff != "" {
+			t.Errorf("cycles mismatch (-want +got):\n%s", diff)
+		}
 	})
 }
 
+func cyclePaths(err error) [][]string {
+	var result [][]string
+	for _, issue := range stack.Issues(err) {
+		if cycle, ok := issue.Details.(*stack.CycleError); ok {
+			result = append(result, cycle.Path)
+		}
+	}
+	return result
+}
+
 func TestNewChain(t *testing.T) {
 	// TODO turn into table driven test with more elaborate examples
 	t.Run("Success", func(t *testing.T) {
@@ -211,4 +385,1526 @@ func TestNewChain(t *testing.T) {
 			t.Errorf("NewChain() mismatch (-want +got):\n%s", diff)
 		}
 	})
+
+	t.Run("FailGivenCycle", func(t *testing.T) {
+		a := stack.Stack{Name: "a"}
+		b := stack.Stack{Name: "b", Requires: []stack.Stack{a}}
+		c := stack.Stack{Name: "c", Requires: []stack.Stack{b}}
+		a.Requires = []stack.Stack{c}
+
+		_, err := stack.NewChain(c, a)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `cycle of required stacks "a" -> "c" -> "b" -> "a"`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+}
+
+func TestStacksChain(t *testing.T) {
+	stacks, err := stack.New(stack.DHIS2Core, stack.DHIS2DB, stack.PgAdmin, stack.DHIS2, stack.WhoamiGo)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		c, err := stacks.Chain("dhis2-core", "pgadmin")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := []string{"dhis2-db", "dhis2-core", "pgadmin"}
+		if diff := cmp.Diff(want, c.Names()); diff != "" {
+			t.Errorf("Chain() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("IgnoreEmptyNames", func(t *testing.T) {
+		c, err := stacks.Chain(strings.Split(" dhis2-core,,pgadmin,", ",")...)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := []string{"dhis2-db", "dhis2-core", "pgadmin"}
+		if diff := cmp.Diff(want, c.Names()); diff != "" {
+			t.Errorf("Chain() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenUnknownStacks", func(t *testing.T) {
+		_, err := stacks.Chain("dhis2core", "pgadmin", "nope")
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `unknown stack "dhis2core", did you mean "dhis2-core"`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+		if want := `unknown stack "nope"`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+}
+
+func TestResolve(t *testing.T) {
+	db := stack.Instance{
+		Name:  "mydb",
+		Group: "whoami",
+		Stack: stack.DHIS2DB,
+		Parameters: map[string]stack.Parameter{
+			"DATABASE_ID":       {Value: "1"},
+			"DATABASE_USERNAME": {Value: "foo"},
+			"DATABASE_PASSWORD": {Value: "faa"},
+			"DATABASE_NAME":     {Value: "mono"},
+		},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		core := stack.Instance{
+			Name:  "core",
+			Group: "whoami",
+			Stack: stack.DHIS2Core,
+			Parameters: map[string]stack.Parameter{
+				"DHIS2_HOME": {Value: "/home/dhis2"},
+			},
+			Requires: []stack.Instance{db},
+		}
+
+		got, err := stack.Resolve(core)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		origin := &stack.Origin{Instance: "mydb", Group: "whoami", Stack: "dhis2-db"}
+		want := map[string]stack.Parameter{
+			"DHIS2_HOME":        {Value: "/home/dhis2"},
+			"DATABASE_USERNAME": {Value: "foo", Consumed: true, Origin: origin},
+			"DATABASE_PASSWORD": {Value: "faa", Consumed: true, Origin: origin, Sensitive: true},
+			"DATABASE_NAME":     {Value: "mono", Consumed: true, Origin: origin},
+			"DATABASE_HOSTNAME": {Value: "mydb-database-postgresql.whoami.svc", Consumed: true, Origin: origin},
+			"DATABASE_GREETING": {Value: `hello from stack "dhis2-db" instance "mydb"`, Consumed: true, Origin: origin},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Resolve() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenMissingRequiredInstance", func(t *testing.T) {
+		core := stack.Instance{Name: "core", Group: "whoami", Stack: stack.DHIS2Core}
+
+		_, err := stack.Resolve(core)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `must be linked to an instance of stack "dhis2-db"`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("FailGivenConsumedOrUnknownParameter", func(t *testing.T) {
+		core := stack.Instance{
+			Name:  "core",
+			Group: "whoami",
+			Stack: stack.DHIS2Core,
+			Parameters: map[string]stack.Parameter{
+				"DATABASE_NAME": {Value: "other"},
+				"UNKNOWN":       {Value: "1"},
+			},
+			Requires: []stack.Instance{db},
+		}
+
+		_, err := stack.Resolve(core)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `stack "dhis2-core" parameter "DATABASE_NAME" is consumed and cannot be set`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+		if want := `stack "dhis2-core" has no parameter "UNKNOWN"`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("KeepTypes", func(t *testing.T) {
+		consumer := stack.Stack{
+			Name:       "consumer",
+			Parameters: map[string]stack.Parameter{"DATABASE_ID": {Consumed: true, Type: stack.Int}},
+			Requires:   []stack.Stack{stack.DHIS2DB},
+		}
+		inst := stack.Instance{Name: "consumer", Group: "whoami", Stack: consumer, Requires: []stack.Instance{db}}
+
+		got, err := stack.Resolve(inst)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		origin := &stack.Origin{Instance: "mydb", Group: "whoami", Stack: "dhis2-db"}
+		want := map[string]stack.Parameter{"DATABASE_ID": {Value: "1", Consumed: true, Origin: origin, Type: stack.Int}}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Resolve() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenValueNotMatchingType", func(t *testing.T) {
+		inst := db
+		inst.Parameters = map[string]stack.Parameter{
+			"DATABASE_ID":       {Value: "one"},
+			"DATABASE_USERNAME": {Value: "foo"},
+			"DATABASE_PASSWORD": {Value: "faa"},
+			"DATABASE_NAME":     {Value: "mono"},
+		}
+
+		_, err := stack.Resolve(inst)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `invalid stack "dhis2-db" parameter "DATABASE_ID": value "one" must be an int`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("FailCreatingStackGivenInvalidTypes", func(t *testing.T) {
+		_, err := stack.New(stack.Stack{
+			Name: "typed",
+			Parameters: map[string]stack.Parameter{
+				"PORT":    {Value: "http", Type: stack.Int},
+				"ENABLED": {Type: "boolean"},
+			},
+		})
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		for _, want := range []string{
+			`stack "typed" parameter "ENABLED" has unknown type "boolean"`,
+			`stack "typed" parameter "PORT" has invalid default: value "http" must be an int`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		catalog := `{
+			"stacks": [
+				{
+					"name": "b",
+					"parameters": {
+						"DATABASE_HOSTNAME": {"consumed": true},
+						"GREETING": {"consumed": true}
+					},
+					"requires": ["a"]
+				},
+				{
+					"name": "a",
+					"parameters": {"DATABASE_NAME": {}},
+					"providers": {
+						"DATABASE_HOSTNAME": {"type": "hostname", "args": {"service": "database-postgresql"}},
+						"GREETING": {"type": "greeting"}
+					}
+				}
+			]
+		}`
+		registry := stack.NewProviderRegistry()
+		err := registry.Register("greeting", func(args map[string]string) (stack.Provider, error) {
+			return stack.ProviderFunc(func(instance stack.Instance) (string, error) {
+				return "hello from " + instance.Name, nil
+			}), nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		stacks, err := stack.Load(strings.NewReader(catalog), registry)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		a := stack.Instance{
+			Name:       "mydb",
+			Group:      "whoami",
+			Stack:      stacks["a"],
+			Parameters: map[string]stack.Parameter{"DATABASE_NAME": {Value: "mono"}},
+		}
+		b := stack.Instance{Name: "myb", Group: "whoami", Stack: stacks["b"], Requires: []stack.Instance{a}}
+		got, err := stack.Resolve(b)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		origin := &stack.Origin{Instance: "mydb", Group: "whoami", Stack: "a"}
+		want := map[string]stack.Parameter{
+			"DATABASE_HOSTNAME": {Value: "mydb-database-postgresql.whoami.svc", Consumed: true, Origin: origin},
+			"GREETING":          {Value: "hello from mydb", Consumed: true, Origin: origin},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Resolve() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenInvalidProviders", func(t *testing.T) {
+		catalog := `{
+			"stacks": [
+				{
+					"name": "a",
+					"providers": {
+						"HOSTNAME": {"type": "hostname"},
+						"SECRET": {"type": "secret", "args": {"length": "-1"}},
+						"OTHER": {"type": "nope"}
+					}
+				}
+			]
+		}`
+
+		_, err := stack.Load(strings.NewReader(catalog), stack.NewProviderRegistry())
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		for _, want := range []string{
+			`stack "a" provider "HOSTNAME": failed to create provider "hostname": argument "service" is required`,
+			`stack "a" provider "SECRET": failed to create provider "secret": argument "length" must be a number between 1 and 1024`,
+			`stack "a" provider "OTHER": unknown provider "nope"`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+
+	t.Run("Hooks", func(t *testing.T) {
+		catalog := `{
+			"stacks": [
+				{
+					"name": "a",
+					"hooks": [{"phase": "post-deploy", "command": ["./seed.sh", "--small"]}]
+				}
+			]
+		}`
+
+		stacks, err := stack.Load(strings.NewReader(catalog), stack.NewProviderRegistry())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := []stack.Hook{{Phase: stack.PostDeploy, Command: []string{"./seed.sh", "--small"}}}
+		if diff := cmp.Diff(want, stacks["a"].Hooks); diff != "" {
+			t.Errorf("Hooks mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenInvalidHooks", func(t *testing.T) {
+		catalog := `{
+			"stacks": [
+				{
+					"name": "a",
+					"hooks": [{"phase": "post-seed", "command": ["./seed.sh"]}, {"phase": "pre-destroy"}]
+				}
+			]
+		}`
+
+		_, err := stack.Load(strings.NewReader(catalog), stack.NewProviderRegistry())
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		for _, want := range []string{
+			`stack "a" hook 0 has unknown phase "post-seed"`,
+			`stack "a" hook 1 must have a command`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+
+	t.Run("FailGivenInvalidReadiness", func(t *testing.T) {
+		catalog := `{
+			"stacks": [
+				{"name": "a", "readiness": {"command": ["pg_isready"], "timeout": "soon"}},
+				{"name": "b", "readiness": {"command": [], "timeout": "-1m"}}
+			]
+		}`
+
+		_, err := stack.Load(strings.NewReader(catalog), stack.NewProviderRegistry())
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		for _, want := range []string{
+			`stack "a" readiness check: timeout "soon" must be a positive duration like 5m`,
+			`stack "b" readiness check must have a command`,
+			`stack "b" readiness check: timeout "-1m" must be a positive duration like 5m`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+
+	t.Run("RetryProviders", func(t *testing.T) {
+		catalog := `{
+			"stacks": [
+				{
+					"name": "a",
+					"providers": {
+						"TOKEN": {"type": "flaky", "retry": {"maxAttempts": 3, "backoff": "1ms", "retryOn": ["unavailable"]}}
+					}
+				},
+				{
+					"name": "b",
+					"parameters": {"TOKEN": {"consumed": true}},
+					"requires": ["a"]
+				}
+			]
+		}`
+		var calls int
+		registry := stack.NewProviderRegistry()
+		err := registry.Register("flaky", func(map[string]string) (stack.Provider, error) {
+			return stack.ProviderFunc(func(stack.Instance) (string, error) {
+				calls++
+				if calls < 3 {
+					return "", errors.New("vault unavailable")
+				}
+				return "t0k3n", nil
+			}), nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		stacks, err := stack.Load(strings.NewReader(catalog), registry)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		a := stack.Instance{Name: "mya", Group: "whoami", Stack: stacks["a"]}
+		b := stack.Instance{Name: "myb", Group: "whoami", Stack: stacks["b"], Requires: []stack.Instance{a}}
+		got, err := stack.ResolveContext(context.Background(), b)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if got["TOKEN"].Value != "t0k3n" || calls != 3 {
+			t.Errorf("want token after 3 calls, instead got %q after %d calls", got["TOKEN"].Value, calls)
+		}
+	})
+
+	t.Run("FailGivenInvalidRetryPolicies", func(t *testing.T) {
+		catalog := `{
+			"stacks": [
+				{
+					"name": "a",
+					"providers": {
+						"HOSTNAME": {"type": "hostname", "args": {"service": "db"}, "retry": {"maxAttempts": 2, "jitter": 1.5}}
+					}
+				}
+			]
+		}`
+
+		_, err := stack.Load(strings.NewReader(catalog), stack.NewProviderRegistry())
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `stack "a" provider "HOSTNAME" has invalid retry policy: jitter must be between 0 and 1, instead got 1.5`; !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+
+		_, err = stack.New(stack.Stack{Name: "a", Retry: &stack.Retry{MaxAttempts: -1, Backoff: "soon"}})
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		for _, want := range []string{
+			`stack "a" has invalid retry policy: backoff "soon" must be a positive duration like 2s`,
+			"max attempts must not be negative, instead got -1",
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+
+	t.Run("FailGivenUnknownRequiredStack", func(t *testing.T) {
+		catalog := `{"stacks": [{"name": "a", "requires": ["b"]}]}`
+
+		_, err := stack.Load(strings.NewReader(catalog), stack.NewProviderRegistry())
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		var missing *stack.MissingRequiredStackError
+		if !errors.As(err, &missing) {
+			t.Fatalf("want error of type %T, instead got %v", missing, err)
+		}
+		if diff := cmp.Diff(&stack.MissingRequiredStackError{Stack: "a", Required: "b"}, missing); diff != "" {
+			t.Errorf("error mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenCycle", func(t *testing.T) {
+		catalog := `{"stacks": [
+			{"name": "a", "requires": ["b"]},
+			{"name": "b", "requires": ["a"]},
+			{"name": "c", "requires": ["c"]}
+		]}`
+
+		_, err := stack.Load(strings.NewReader(catalog), stack.NewProviderRegistry())
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+
+		want := [][]string{{"a", "b", "a"}, {"c", "c"}}
+		if diff := cmp.Diff(want, cyclePaths(err)); diff != "" {
+			t.Errorf("cycles mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestProviderRegistry(t *testing.T) {
+	registry := stack.NewProviderRegistry()
+	instance := stack.Instance{
+		Name:       "mydb",
+		Group:      "whoami",
+		Parameters: map[string]stack.Parameter{"DATABASE_NAME": {Value: "mono"}},
+	}
+
+	tests := map[string]struct {
+		provider string
+		args     map[string]string
+		want     string
+	}{
+		"Hostname":  {provider: "hostname", args: map[string]string{"service": "database-postgresql"}, want: "mydb-database-postgresql.whoami.svc"},
+		"Constant":  {provider: "constant", args: map[string]string{"value": "42"}, want: "42"},
+		"Parameter": {provider: "parameter", args: map[string]string{"name": "DATABASE_NAME"}, want: "mono"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := registry.New(tc.provider, tc.args)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			got, err := p.Provide(instance)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("want %q, instead got %q", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("SecretIsDerivedPerInstance", func(t *testing.T) {
+		secret := func(t *testing.T, key string, args map[string]string, instance stack.Instance) string {
+			t.Helper()
+
+			registry := stack.NewProviderRegistry()
+			if err := registry.SetSecretKey([]byte(key)); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			p, err := registry.New("secret", args)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			v, err := p.Provide(instance)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return v
+		}
+
+		first := secret(t, "key", map[string]string{"length": "16"}, instance)
+		if first == "" || first != secret(t, "key", map[string]string{"length": "16"}, instance) {
+			t.Errorf("want the same secret for the same key and instance across registries, instead got %q", first)
+		}
+		for name, other := range map[string]string{
+			"OtherInstance": secret(t, "key", map[string]string{"length": "16"}, stack.Instance{Name: "other", Group: "whoami"}),
+			"OtherKey":      secret(t, "other", map[string]string{"length": "16"}, instance),
+			"OtherName":     secret(t, "key", map[string]string{"length": "16", "name": "admin"}, instance),
+		} {
+			if first == other {
+				t.Errorf("%s: want a different secret, instead got %q", name, other)
+			}
+		}
+	})
+
+	t.Run("FailProvidingSecretWithoutKey", func(t *testing.T) {
+		p, err := stack.NewProviderRegistry().New("secret", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		_, err = p.Provide(instance)
+
+		if want := "no secret key"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain '%s', instead got %v", want, err)
+		}
+	})
+
+	t.Run("ProvideSecretToProvidingInstance", func(t *testing.T) {
+		catalog := `{"stacks": [
+			{"name": "db", "providers": {"DATABASE_PASSWORD": {"type": "secret"}}},
+			{"name": "app", "parameters": {"DATABASE_PASSWORD": {"consumed": true}}, "requires": ["db"]}
+		]}`
+		registry := stack.NewProviderRegistry()
+		if err := registry.SetSecretKey([]byte("key")); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		stacks, err := stack.Load(strings.NewReader(catalog), registry)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		db := stack.Instance{Name: "mydb", Group: "whoami", Stack: stacks["db"]}
+		dbParams, err := stack.Resolve(db)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		db.Parameters = dbParams
+		appParams, err := stack.Resolve(stack.Instance{Name: "myapp", Group: "whoami", Stack: stacks["app"], Requires: []stack.Instance{db}})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		got := dbParams["DATABASE_PASSWORD"]
+		if got.Value == "" || !got.Sensitive {
+			t.Errorf("want providing instance to receive the secret as sensitive parameter, instead got %+v", got)
+		}
+		if appParams["DATABASE_PASSWORD"].Value != got.Value {
+			t.Errorf("want consumer to receive the secret %q, instead got %q", got.Value, appParams["DATABASE_PASSWORD"].Value)
+		}
+	})
+
+	t.Run("DeriveSecretPerProvider", func(t *testing.T) {
+		catalog := `{"stacks": [{"name": "db", "providers": {
+			"ADMIN_PASSWORD": {"type": "secret", "args": {"length": "16"}},
+			"DATABASE_PASSWORD": {"type": "secret", "args": {"length": "32"}}
+		}}]}`
+		registry := stack.NewProviderRegistry()
+		if err := registry.SetSecretKey([]byte("key")); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		stacks, err := stack.Load(strings.NewReader(catalog), registry)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		got, err := stack.Resolve(stack.Instance{Name: "mydb", Group: "whoami", Stack: stacks["db"]})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		admin, err := base64.RawURLEncoding.DecodeString(got["ADMIN_PASSWORD"].Value)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		db, err := base64.RawURLEncoding.DecodeString(got["DATABASE_PASSWORD"].Value)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(admin) != 16 || bytes.HasPrefix(db, admin) {
+			t.Errorf("want unrelated secrets per provider, instead got %x and %x", admin, db)
+		}
+	})
+
+	t.Run("FailRegisteringTakenName", func(t *testing.T) {
+		err := registry.Register("hostname", func(map[string]string) (stack.Provider, error) { return nil, nil })
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	catalogA := `{"stacks": [{"name": "a"}]}`
+	catalogAB := `{"stacks": [{"name": "a"}, {"name": "b", "requires": ["a"]}]}`
+	invalid := `{"stacks": [{"name": "b", "requires": ["a"]}]}`
+	load := func(t *testing.T, catalog string) (*stack.Registry, string) {
+		t.Helper()
+
+		file := filepath.Join(t.TempDir(), "stacks.json")
+		write(t, file, catalog)
+		r, err := stack.LoadRegistry(file, stack.NewProviderRegistry())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return r, file
+	}
+
+	t.Run("ReloadGivenChangedCatalog", func(t *testing.T) {
+		r, file := load(t, catalogA)
+		snapshot := r.Stacks()
+
+		changed, err := r.Reload()
+		if err != nil || changed {
+			t.Fatalf("want unchanged catalog not to be reloaded, instead got %t and %v", changed, err)
+		}
+		write(t, file, catalogAB)
+		changed, err = r.Reload()
+
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !changed {
+			t.Error("want changed catalog to be reloaded")
+		}
+		if _, err := r.Stacks().Get("b"); err != nil {
+			t.Errorf("want new stack to be registered: %v", err)
+		}
+		if len(snapshot) != 1 {
+			t.Errorf("want snapshot taken before reloading to keep 1 stack, instead got %d", len(snapshot))
+		}
+	})
+
+	t.Run("KeepStacksGivenInvalidCatalog", func(t *testing.T) {
+		r, file := load(t, catalogA)
+		write(t, file, invalid)
+
+		changed, err := r.Reload()
+
+		if err == nil {
+			t.Fatal("expected error got none")
+		}
+		if want := "invalid catalog"; !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+		if changed {
+			t.Error("want invalid catalog not to be swapped in")
+		}
+		if _, err := r.Stacks().Get("a"); err != nil {
+			t.Errorf("want current stacks to be kept: %v", err)
+		}
+	})
+
+	t.Run("Poll", func(t *testing.T) {
+		r, file := load(t, catalogA)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		reports := make(chan error)
+		go r.Poll(ctx, time.Millisecond, func(err error) {
+			select {
+			case reports <- err:
+			case <-ctx.Done():
+			}
+		})
+
+		write(t, file, invalid)
+		if err := <-reports; err == nil {
+			t.Error("want invalid catalog to be reported")
+		}
+		write(t, file, catalogAB)
+		if err := <-reports; err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := r.Stacks().Get("b"); err != nil {
+			t.Errorf("want new stack to be registered: %v", err)
+		}
+	})
+
+	t.Run("ConcurrentUse", func(t *testing.T) {
+		r, file := load(t, catalogA)
+		write(t, file, catalogAB)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_, _ = r.Reload()
+			}()
+			go func() {
+				defer wg.Done()
+				if _, err := r.Stacks().Get("a"); err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(r.Stacks()) != 2 {
+			t.Errorf("want 2 stacks, instead got %d", len(r.Stacks()))
+		}
+	})
+
+	t.Run("FixedStacks", func(t *testing.T) {
+		stacks, err := stack.New(stack.Stack{Name: "a"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		r := stack.NewRegistry(stacks)
+
+		changed, err := r.Reload()
+
+		if err != nil || changed {
+			t.Errorf("want fixed stacks not to be reloaded, instead got %t and %v", changed, err)
+		}
+	})
+}
+
+func write(t *testing.T, file, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestTemplateProvider(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		p, err := stack.NewTemplateProvider(`jdbc:postgresql://{{.Name}}.{{.Group}}/{{.Parameters.DATABASE_NAME}}?app={{index .Parameters "APP"}}&stack={{.Stack}}`)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		got, err := p.Provide(stack.Instance{
+			Name:  "mydb",
+			Group: "whoami",
+			Stack: stack.Stack{Name: "dhis2-db"},
+			Parameters: map[string]stack.Parameter{
+				"DATABASE_NAME": {Value: "mono"},
+				"APP":           {Value: "dhis2"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if want := "jdbc:postgresql://mydb.whoami/mono?app=dhis2&stack=dhis2-db"; got != want {
+			t.Errorf("want %q, instead got %q", want, got)
+		}
+	})
+
+	t.Run("FailGivenUnknownField", func(t *testing.T) {
+		_, err := stack.NewTemplateProvider("{{.Name}}.{{.Namespace}}")
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `unknown field ".Namespace"`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("FailCreatingStackGivenUnknownParameter", func(t *testing.T) {
+		a := stack.Stack{
+			Name: "a",
+			Parameters: map[string]stack.Parameter{
+				"DATABASE_NAME": {},
+			},
+			Providers: map[string]stack.Provider{
+				"URL": stack.MustTemplateProvider(`{{.Parameters.DATABASE_NAME}}/{{index .Parameters "DATABASE_PORT"}}/{{.Parameters.DATABASE_USER}}`),
+			},
+		}
+
+		_, err := stack.New(a)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		for _, want := range []string{
+			`invalid provider for stack "a" parameter "URL"`,
+			`unknown parameter "DATABASE_PORT"`,
+			`unknown parameter "DATABASE_USER"`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+}
+
+func TestDerivedProviders(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		a := stack.Stack{
+			Name: "a",
+			Parameters: map[string]stack.Parameter{
+				"DATABASE_NAME": {},
+			},
+			Providers: map[string]stack.Provider{
+				"DATABASE_JDBC_URL": stack.MustTemplateProvider("jdbc:postgresql://{{.Parameters.DATABASE_HOSTNAME}}/{{.Parameters.DATABASE_NAME}}"),
+				"DATABASE_HOSTNAME": stack.WithDependencies(stack.ProviderFunc(func(instance stack.Instance) (string, error) {
+					return instance.Parameters["DATABASE_HOST"].Value + ".svc", nil
+				}), "DATABASE_HOST"),
+				"DATABASE_HOST": stack.MustTemplateProvider("{{.Name}}-database-postgresql.{{.Group}}"),
+			},
+		}
+		b := stack.Stack{
+			Name: "b",
+			Parameters: map[string]stack.Parameter{
+				"DATABASE_JDBC_URL": {Consumed: true},
+			},
+			Requires: []stack.Stack{a},
+		}
+		_, err := stack.New(a, b)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		got, err := stack.Resolve(stack.Instance{
+			Name:  "myb",
+			Group: "whoami",
+			Stack: b,
+			Requires: []stack.Instance{{
+				Name:       "mydb",
+				Group:      "whoami",
+				Stack:      a,
+				Parameters: map[string]stack.Parameter{"DATABASE_NAME": {Value: "mono"}},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := map[string]stack.Parameter{
+			"DATABASE_JDBC_URL": {
+				Value:    "jdbc:postgresql://mydb-database-postgresql.whoami.svc/mono",
+				Consumed: true,
+				Origin:   &stack.Origin{Instance: "mydb", Group: "whoami", Stack: "a"},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Resolve() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenCycle", func(t *testing.T) {
+		a := stack.Stack{
+			Name: "a",
+			Providers: map[string]stack.Provider{
+				"A": stack.MustTemplateProvider("{{.Parameters.B}}"),
+				"B": stack.MustTemplateProvider("{{.Parameters.C}}"),
+				"C": stack.MustTemplateProvider("{{.Parameters.A}}"),
+			},
+		}
+
+		_, err := stack.New(a)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `creates cycle`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("FailGivenSelfDependency", func(t *testing.T) {
+		a := stack.Stack{
+			Name: "a",
+			Providers: map[string]stack.Provider{
+				"A": stack.MustTemplateProvider("{{.Parameters.A}}"),
+			},
+		}
+
+		_, err := stack.New(a)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `invalid provider for stack "a" parameter "A": dependency on "A" creates cycle`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+}
+
+func TestTransitiveConsumption(t *testing.T) {
+	a := stack.Stack{
+		Name: "a",
+		Parameters: map[string]stack.Parameter{
+			"DATABASE_NAME": {},
+		},
+		Providers: map[string]stack.Provider{
+			"DATABASE_HOSTNAME": stack.MustTemplateProvider("{{.Name}}.{{.Group}}.svc"),
+		},
+	}
+	b := stack.Stack{
+		Name: "b",
+		Parameters: map[string]stack.Parameter{
+			"DATABASE_HOSTNAME": {Consumed: true},
+		},
+		Requires: []stack.Stack{a},
+	}
+	c := stack.Stack{
+		Name: "c",
+		Parameters: map[string]stack.Parameter{
+			"DATABASE_HOSTNAME": {Consumed: true},
+		},
+		Requires: []stack.Stack{b},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		_, err := stack.New(a, b, c)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		origin, _, err := c.Origin("DATABASE_HOSTNAME")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if origin.Name != "a" {
+			t.Errorf("want origin %q, instead got %q", "a", origin.Name)
+		}
+
+		aInstance := stack.Instance{Name: "mya", Group: "whoami", Stack: a, Parameters: map[string]stack.Parameter{"DATABASE_NAME": {Value: "mono"}}}
+		// b is not resolved so the parameter needs to be followed through b to a
+		bInstance := stack.Instance{Name: "myb", Group: "whoami", Stack: b, Requires: []stack.Instance{aInstance}}
+		cInstance := stack.Instance{Name: "myc", Group: "whoami", Stack: c, Requires: []stack.Instance{bInstance}}
+
+		got, err := stack.Resolve(cInstance)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := map[string]stack.Parameter{
+			"DATABASE_HOSTNAME": {
+				Value:    "mya.whoami.svc",
+				Consumed: true,
+				Origin:   &stack.Origin{Instance: "mya", Group: "whoami", Stack: "a"},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Resolve() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenNoOrigin", func(t *testing.T) {
+		// b consumes from a stack that does not provide it and is not validated itself
+		b := stack.Stack{
+			Name: "b",
+			Parameters: map[string]stack.Parameter{
+				"DATABASE_HOSTNAME": {Consumed: true},
+			},
+			Requires: []stack.Stack{{Name: "x"}},
+		}
+		c := stack.Stack{
+			Name: "c",
+			Parameters: map[string]stack.Parameter{
+				"DATABASE_HOSTNAME": {Consumed: true},
+			},
+			Requires: []stack.Stack{b},
+		}
+
+		_, err := stack.New(c)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `no origin for stack "c" parameter "DATABASE_HOSTNAME": no stack required by "b" provides parameter "DATABASE_HOSTNAME"`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+}
+
+func TestMappings(t *testing.T) {
+	db := stack.Stack{
+		Name: "db",
+		Parameters: map[string]stack.Parameter{
+			"DATABASE_NAME": {},
+		},
+		Providers: map[string]stack.Provider{
+			"DATABASE_HOSTNAME": stack.MustTemplateProvider("{{.Name}}.{{.Group}}.svc"),
+		},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		pgadmin := stack.Stack{
+			Name: "pgadmin",
+			Parameters: map[string]stack.Parameter{
+				"PGADMIN_DB_HOST": {Consumed: true},
+				"DATABASE_NAME":   {Consumed: true},
+			},
+			Requires: []stack.Stack{db},
+			Mappings: map[string]stack.Mapping{
+				"db": {"PGADMIN_DB_HOST": "DATABASE_HOSTNAME"},
+			},
+		}
+		_, err := stack.New(db, pgadmin)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		got, err := stack.Resolve(stack.Instance{
+			Name:  "admin",
+			Group: "whoami",
+			Stack: pgadmin,
+			Requires: []stack.Instance{{
+				Name:       "mydb",
+				Group:      "whoami",
+				Stack:      db,
+				Parameters: map[string]stack.Parameter{"DATABASE_NAME": {Value: "mono"}},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		origin := &stack.Origin{Instance: "mydb", Group: "whoami", Stack: "db"}
+		want := map[string]stack.Parameter{
+			"PGADMIN_DB_HOST": {Value: "mydb.whoami.svc", Consumed: true, Origin: origin},
+			"DATABASE_NAME":   {Value: "mono", Consumed: true, Origin: origin},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Resolve() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenInvalidMappings", func(t *testing.T) {
+		pgadmin := stack.Stack{
+			Name: "pgadmin",
+			Parameters: map[string]stack.Parameter{
+				"PGADMIN_DB_HOST": {Consumed: true},
+				"PGADMIN_USER":    {},
+			},
+			Requires: []stack.Stack{db},
+			Mappings: map[string]stack.Mapping{
+				"db":    {"PGADMIN_DB_HOST": "DATABASE_HOST", "PGADMIN_USER": "DATABASE_NAME"},
+				"other": {"PGADMIN_DB_HOST": "DATABASE_HOSTNAME"},
+			},
+		}
+
+		_, err := stack.New(db, pgadmin)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		for _, want := range []string{
+			`no provider for stack "pgadmin" parameter "PGADMIN_DB_HOST"`,
+			`stack "pgadmin" maps parameter "PGADMIN_DB_HOST" to "DATABASE_HOST" which stack "db" does not provide`,
+			`stack "pgadmin" maps parameter "PGADMIN_USER" which it does not consume`,
+			`stack "pgadmin" maps parameters of stack "other" which it does not require`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+}
+
+func TestIssues(t *testing.T) {
+	a := stack.Stack{Name: "a"}
+	b := stack.Stack{
+		Name: "b",
+		Parameters: map[string]stack.Parameter{
+			"b_param": {Consumed: true},
+		},
+		Requires: []stack.Stack{a},
+	}
+
+	_, err := stack.New(b, b)
+	if err == nil {
+		t.Fatalf("expected error got none")
+	}
+
+	got := stack.Issues(fmt.Errorf("invalid catalog: %w", err))
+
+	want := []stack.Issue{
+		{
+			Type:    "duplicate_stack",
+			Message: `stack "b" is defined more than once`,
+			Details: &stack.DuplicateStackError{Stack: "b"},
+		},
+		{
+			Type:    "missing_required_stack",
+			Message: `stack "b" requires stack "a" which is missing`,
+			Details: &stack.MissingRequiredStackError{Stack: "b", Required: "a"},
+		},
+		{
+			Type:    "missing_required_stack",
+			Message: `stack "b" requires stack "a" which is missing`,
+			Details: &stack.MissingRequiredStackError{Stack: "b", Required: "a"},
+		},
+		{
+			Type:    "unmet_parameter",
+			Message: `no provider for stack "b" parameter "b_param"`,
+			Details: &stack.UnmetParameterError{Stack: "b", Parameter: "b_param", Requires: []string{"a"}},
+		},
+		{
+			Type:    "unmet_parameter",
+			Message: `no provider for stack "b" parameter "b_param"`,
+			Details: &stack.UnmetParameterError{Stack: "b", Parameter: "b_param", Requires: []string{"a"}},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Issues() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"", "1.2.3", true},
+		{"1.2.3", "1.2.3", true},
+		{"=1.2.3", "1.2.4", false},
+		{"1.2", "1.2.9", true},
+		{"1.2", "1.3.0", false},
+		{"!=1.2.3", "1.2.3", false},
+		{">=1.2.0, <2", "1.9.9", true},
+		{">= 1.2.0 < 2", "2.0.0", false},
+		{">1.2.3", "1.2.3", false},
+		{"<=1.2.3", "1.2.3", true},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"~1", "1.9.0", true},
+		{"^1.2.3", "1.9.0", true},
+		{"^1.2.3", "2.0.0", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^16", "16.4.1", true},
+		{">=2.40.0-rc.1", "2.40.0-rc.2", true},
+		{">=2.40.0", "2.40.0-rc.2", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.constraint+" "+tc.version, func(t *testing.T) {
+			c, err := stack.ParseConstraint(tc.constraint)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			v, err := stack.ParseVersion(tc.version)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if got := c.Check(v); got != tc.want {
+				t.Errorf("Check(%q) = %t, want %t", tc.version, got, tc.want)
+			}
+		})
+	}
+
+	t.Run("FailGivenInvalidConstraint", func(t *testing.T) {
+		for _, constraint := range []string{">=", "*1.2.3", "1.2.3.4", "1.x"} {
+			if _, err := stack.ParseConstraint(constraint); err == nil {
+				t.Errorf("expected error for constraint %q got none", constraint)
+			}
+		}
+	})
+}
+
+func TestVersions(t *testing.T) {
+	db15 := stack.Stack{Name: "db", Version: "15.0.0", Parameters: map[string]stack.Parameter{"HOST": {Value: "db15"}}}
+	db16 := stack.Stack{Name: "db", Version: "16.2.0", Parameters: map[string]stack.Parameter{"HOST": {Value: "db16"}}}
+	app := stack.Stack{
+		Name:        "app",
+		Version:     "1.0.0",
+		Parameters:  map[string]stack.Parameter{"HOST": {Consumed: true}},
+		Requires:    []stack.Stack{db16},
+		Constraints: map[string]string{"db": "^16"},
+	}
+	legacy := stack.Stack{
+		Name:        "legacy",
+		Parameters:  map[string]stack.Parameter{"HOST": {Consumed: true}},
+		Requires:    []stack.Stack{db15},
+		Constraints: map[string]string{"db": "<16"},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		stacks, err := stack.New(db15, db16, app, legacy)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want := []string{"app@1.0.0", "db@15.0.0", "db@16.2.0", "legacy"}
+		got := make([]string, 0, len(stacks))
+		for k := range stacks {
+			got = append(got, k)
+		}
+		sort.Strings(got)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("New() mismatch (-want +got):\n%s", diff)
+		}
+
+		latest, err := stacks.Get("db")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if latest.Version != "16.2.0" {
+			t.Errorf("want latest version %q, instead got %q", "16.2.0", latest.Version)
+		}
+	})
+
+	t.Run("ChainPicksVersionsMeetingConstraints", func(t *testing.T) {
+		stacks, err := stack.New(db15, db16, app, legacy)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		c, err := stacks.Chain("legacy")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if diff := cmp.Diff([]string{"db@15.0.0", "legacy"}, c.IDs()); diff != "" {
+			t.Errorf("Chain() mismatch (-want +got):\n%s", diff)
+		}
+
+		c, err = stacks.Chain("app", "db@>=15")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if diff := cmp.Diff([]string{"db@16.2.0", "app@1.0.0"}, c.IDs()); diff != "" {
+			t.Errorf("Chain() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenIncompatibleConstraintsInChain", func(t *testing.T) {
+		stacks, err := stack.New(db15, db16, app, legacy)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		_, err = stacks.Chain("app", "legacy")
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		var unsatisfiable *stack.UnsatisfiableConstraintError
+		if !errors.As(err, &unsatisfiable) {
+			t.Fatalf("want error of type %T, instead got %v", unsatisfiable, err)
+		}
+		want := &stack.UnsatisfiableConstraintError{
+			Stack:       "db",
+			Constraints: map[string]string{"app": "^16", "legacy": "<16"},
+			Versions:    []string{"16.2.0", "15.0.0"},
+		}
+		if diff := cmp.Diff(want, unsatisfiable); diff != "" {
+			t.Errorf("error mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FailGivenUnsatisfiableConstraint", func(t *testing.T) {
+		a := app
+		a.Constraints = map[string]string{"db": "^17"}
+
+		_, err := stack.New(db15, db16, a)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		if want := `no version of stack "db" meets constraints "^17" of stack "app": available versions are 16.2.0, 15.0.0`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("want error to contain '%s', instead got '%s'", want, err.Error())
+		}
+	})
+
+	t.Run("FailGivenInvalidVersions", func(t *testing.T) {
+		a := app
+		a.Version = "1.0"
+		a.Constraints = map[string]string{"db": "~>16", "nope": "1"}
+
+		_, err := stack.New(db16, a, db16)
+		if err == nil {
+			t.Fatalf("expected error got none")
+		}
+		for _, want := range []string{
+			`stack "db" version "16.2.0" is defined more than once`,
+			`invalid stack "app": invalid version "1.0"`,
+			`invalid constraint for stack "app" on stack "db"`,
+			`invalid constraint for stack "app": does not require stack "nope"`,
+		} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want error to contain '%s', instead got '%s'", want, err.Error())
+			}
+		}
+	})
+
+	t.Run("LoadPicksLatestVersionMeetingConstraint", func(t *testing.T) {
+		catalog := `{"stacks": [
+			{"name": "db", "version": "15.0.0", "parameters": {"HOST": {"value": "db15"}}},
+			{"name": "db", "version": "16.2.0", "parameters": {"HOST": {"value": "db16"}}},
+			{"name": "legacy", "parameters": {"HOST": {"consumed": true}}, "requires": ["db"], "constraints": {"db": "15"}}
+		]}`
+
+		stacks, err := stack.Load(strings.NewReader(catalog), stack.NewProviderRegistry())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		legacy, err := stacks.Get("legacy")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if got := legacy.Requires[0].ID(); got != "db@15.0.0" {
+			t.Errorf("want legacy to require %q, instead got %q", "db@15.0.0", got)
+		}
+	})
+
+	t.Run("LoadKeepsBuildMetadata", func(t *testing.T) {
+		catalog := `{"stacks": [
+			{"name": "db", "version": "1.0.0+abc", "parameters": {"HOST": {"value": "db"}}},
+			{"name": "app", "parameters": {"HOST": {"consumed": true}}, "requires": ["db"]},
+			{"name": "legacy", "parameters": {"HOST": {"consumed": true}}, "requires": ["db"], "constraints": {"db": "1"}}
+		]}`
+
+		stacks, err := stack.Load(strings.NewReader(catalog), stack.NewProviderRegistry())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		for _, name := range []string{"app", "legacy"} {
+			st, err := stacks.Get(name)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(st.Requires) != 1 || st.Requires[0].ID() != "db@1.0.0+abc" {
+				t.Fatalf("want %s to require %q, instead got %v", name, "db@1.0.0+abc", st.Requires)
+			}
+			if got := st.Requires[0].Parameters["HOST"].Value; got != "db" {
+				t.Errorf("want %s to require the defined stack, instead got HOST %q", name, got)
+			}
+		}
+	})
+}
+
+func TestDiff(t *testing.T) {
+	db := stack.Stack{
+		Name: "db",
+		Parameters: map[string]stack.Parameter{
+			"DB_NAME": {},
+			"DB_PORT": {Value: "5432"},
+			"DB_SIZE": {Value: "20Gi"},
+		},
+		Providers: map[string]stack.Provider{
+			"DB_HOST":  stack.MustTemplateProvider("{{.Name}}.svc"),
+			"DB_DEBUG": stack.MustTemplateProvider("debug"),
+		},
+	}
+	app := stack.Stack{
+		Name: "app",
+		Parameters: map[string]stack.Parameter{
+			"HOST": {Consumed: true},
+		},
+		Requires: []stack.Stack{db},
+		Mappings: map[string]stack.Mapping{"db": {"HOST": "DB_HOST"}},
+	}
+	old, err := stack.New(db, app, stack.Stack{Name: "gone"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	t.Run("NoChanges", func(t *testing.T) {
+		if got := stack.Diff(old, old); len(got) != 0 {
+			t.Errorf("want no changes, instead got %v", got)
+		}
+	})
+
+	t.Run("Changes", func(t *testing.T) {
+		newDB := stack.Stack{
+			Name: "db",
+			Parameters: map[string]stack.Parameter{
+				"DB_NAME": {Type: stack.Int},
+				"DB_PORT": {},
+				"DB_SIZE": {Value: "30Gi"},
+				"DB_USER": {},
+				"DB_HOST": {Value: "localhost"},
+			},
+			Providers: map[string]stack.Provider{
+				"DB_HOSTNAME": stack.MustTemplateProvider("{{.Name}}.svc"),
+			},
+		}
+		newApp := stack.Stack{
+			Name: "app",
+			Parameters: map[string]stack.Parameter{
+				"HOST": {Consumed: true},
+			},
+			Requires: []stack.Stack{newDB},
+			Mappings: map[string]stack.Mapping{"db": {"HOST": "DB_HOSTNAME"}},
+		}
+		next, err := stack.New(newDB, newApp, stack.Stack{Name: "added"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		got := stack.Diff(old, next)
+
+		want := []stack.Change{
+			{Kind: stack.StackAdded, Stack: "added"},
+			{Kind: stack.MappingChanged, Stack: "app", Name: "db", Breaking: true, Old: "HOST=DB_HOST", New: "HOST=DB_HOSTNAME"},
+			{Kind: stack.DefaultChanged, Stack: "db", Name: "DB_SIZE", Old: "20Gi", New: "30Gi"},
+			{Kind: stack.ParameterAdded, Stack: "db", Name: "DB_HOST", New: "localhost"},
+			{Kind: stack.ParameterRequired, Stack: "db", Name: "DB_PORT", Breaking: true, Old: "5432"},
+			{Kind: stack.ParameterRequired, Stack: "db", Name: "DB_USER", Breaking: true},
+			{Kind: stack.ProviderAdded, Stack: "db", Name: "DB_HOSTNAME"},
+			{Kind: stack.ProviderRemoved, Stack: "db", Name: "DB_DEBUG"},
+			{Kind: stack.ProviderRemoved, Stack: "db", Name: "DB_HOST", Breaking: true, Consumers: []string{"app"}},
+			{Kind: stack.TypeChanged, Stack: "db", Name: "DB_NAME", Breaking: true, Old: "string", New: "int"},
+			{Kind: stack.StackRemoved, Stack: "gone", Breaking: true},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Diff() mismatch (-want +got):\n%s", diff)
+		}
+		if !stack.Breaking(got) {
+			t.Error("want breaking changes")
+		}
+	})
+
+	t.Run("RemovedParameters", func(t *testing.T) {
+		db := stack.Stack{
+			Name: "db",
+			Parameters: map[string]stack.Parameter{
+				"DB_NAME": {Value: "mono"},
+				"DB_HOST": {Value: "localhost"},
+			},
+		}
+		mid := stack.Stack{
+			Name:       "mid",
+			Parameters: map[string]stack.Parameter{"DB_HOST": {Consumed: true}},
+			Requires:   []stack.Stack{db},
+		}
+		app := stack.Stack{
+			Name:       "app",
+			Parameters: map[string]stack.Parameter{"DB_HOST": {Consumed: true}},
+			Requires:   []stack.Stack{mid},
+		}
+		old, err := stack.New(db, mid, app)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		newDB := stack.Stack{
+			Name:      "db",
+			Providers: map[string]stack.Provider{"DB_HOST": stack.MustTemplateProvider("{{.Name}}.svc")},
+		}
+		newMid := stack.Stack{
+			Name:       "mid",
+			Parameters: map[string]stack.Parameter{"DB_HOST": {Consumed: true}},
+			Requires:   []stack.Stack{newDB},
+		}
+		newApp := stack.Stack{
+			Name:     "app",
+			Requires: []stack.Stack{newMid},
+		}
+		next, err := stack.New(newDB, newMid, newApp)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		got := stack.Diff(old, next)
+
+		want := []stack.Change{
+			{Kind: stack.ParameterRemoved, Stack: "app", Name: "DB_HOST"},
+			{Kind: stack.ParameterRemoved, Stack: "db", Name: "DB_HOST", Breaking: true, Consumers: []string{"app", "mid"}},
+			{Kind: stack.ParameterRemoved, Stack: "db", Name: "DB_NAME", Breaking: true},
+			{Kind: stack.ProviderAdded, Stack: "db", Name: "DB_HOST"},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Diff() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("RemovedRequirements", func(t *testing.T) {
+		db := stack.Stack{Name: "db", Parameters: map[string]stack.Parameter{"DB_HOST": {Value: "localhost"}}}
+		cache := stack.Stack{Name: "cache"}
+		app := stack.Stack{
+			Name:       "app",
+			Parameters: map[string]stack.Parameter{"HOST": {Consumed: true}},
+			Requires:   []stack.Stack{db, cache},
+			Mappings:   map[string]stack.Mapping{"db": {"HOST": "DB_HOST"}},
+		}
+		old, err := stack.New(db, cache, app)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		next, err := stack.New(db, cache, stack.Stack{Name: "app"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		got := stack.Diff(old, next)
+
+		want := []stack.Change{
+			{Kind: stack.ParameterRemoved, Stack: "app", Name: "HOST"},
+			{Kind: stack.RequirementRemoved, Stack: "app", Name: "cache"},
+			{Kind: stack.RequirementRemoved, Stack: "app", Name: "db", Breaking: true},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Diff() mismatch (-want +got):\n%s", diff)
+		}
+	})
 }
@@ -0,0 +1,188 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// TemplateProvider provides a value by executing a https://pkg.go.dev/text/template on the
+// instance. The template has access to
+//
+//   - .Name the instance name
+//   - .Group the instance group
+//   - .Stack the stack name
+//   - .Parameters the instance parameters and the values of the stacks providers the template
+//     depends on by name
+//
+// For example the PostgreSQL hostname is provided by
+//
+//	{{.Name}}-database-postgresql.{{.Group}}.svc
+type TemplateProvider struct {
+	text string
+	tmpl *template.Template
+}
+
+// templateData is what a TemplateProvider template is executed on.
+type templateData struct {
+	Name       string
+	Group      string
+	Stack      string
+	Parameters map[string]string
+}
+
+var templateFields = map[string]struct{}{
+	"Name":       {},
+	"Group":      {},
+	"Stack":      {},
+	"Parameters": {},
+}
+
+// NewTemplateProvider parses the template text. Returns an error if the template cannot be parsed
+// or references unknown fields.
+func NewTemplateProvider(text string) (*TemplateProvider, error) {
+	tmpl, err := template.New("provider").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %q: %v", text, err)
+	}
+	p := &TemplateProvider{text: text, tmpl: tmpl}
+
+	for _, f := range p.fields() {
+		if _, ok := templateFields[f[0]]; !ok {
+			return nil, fmt.Errorf("template %q references unknown field %q", text, "."+strings.Join(f, "."))
+		}
+	}
+	return p, nil
+}
+
+// MustTemplateProvider is like NewTemplateProvider but panics if the template is invalid. Use it
+// to declare stacks in Go.
+func MustTemplateProvider(text string) *TemplateProvider {
+	p, err := NewTemplateProvider(text)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func newTemplateProviderFromArgs(args map[string]string) (Provider, error) {
+	err := checkArgs(args, []string{"template"})
+	if err != nil {
+		return nil, err
+	}
+	return NewTemplateProvider(args["template"])
+}
+
+// String returns the template text.
+func (p *TemplateProvider) String() string {
+	return p.text
+}
+
+func (p *TemplateProvider) Provide(instance Instance) (string, error) {
+	data := templateData{
+		Name:       instance.Name,
+		Group:      instance.Group,
+		Stack:      instance.Stack.Name,
+		Parameters: make(map[string]string, len(instance.Parameters)),
+	}
+	for k, v := range instance.Parameters {
+		data.Parameters[k] = v.Value
+	}
+
+	var b strings.Builder
+	err := p.tmpl.Execute(&b, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute template %q: %v", p.text, err)
+	}
+	return b.String(), nil
+}
+
+// DependsOn returns the parameters or providers referenced by the template. New ensures they are
+// declared on the stack.
+func (p *TemplateProvider) DependsOn() []string {
+	return p.parameters()
+}
+
+// fields returns the fields referenced on the templates root data. Fields referenced within range
+// and with actions are relative to a different dot and are thus ignored.
+func (p *TemplateProvider) fields() [][]string {
+	var result [][]string
+	walkTemplate(p.tmpl.Tree.Root, func(n parse.Node) {
+		if f, ok := n.(*parse.FieldNode); ok {
+			result = append(result, f.Ident)
+		}
+	})
+	return result
+}
+
+// parameters returns the names of the parameters referenced by the template either as
+// .Parameters.NAME or as index .Parameters "NAME".
+func (p *TemplateProvider) parameters() []string {
+	var result []string
+	walkTemplate(p.tmpl.Tree.Root, func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.FieldNode:
+			if len(n.Ident) > 1 && n.Ident[0] == "Parameters" {
+				result = append(result, n.Ident[1])
+			}
+		case *parse.CommandNode:
+			if len(n.Args) < 3 {
+				return
+			}
+			if id, ok := n.Args[0].(*parse.IdentifierNode); !ok || id.Ident != "index" {
+				return
+			}
+			if f, ok := n.Args[1].(*parse.FieldNode); !ok || len(f.Ident) != 1 || f.Ident[0] != "Parameters" {
+				return
+			}
+			if s, ok := n.Args[2].(*parse.StringNode); ok {
+				result = append(result, s.Text)
+			}
+		}
+	})
+	return result
+}
+
+// walkTemplate calls visit on all nodes that operate on the templates root data.
+func walkTemplate(node parse.Node, visit func(parse.Node)) {
+	if node == nil {
+		return
+	}
+	visit(node)
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkTemplate(c, visit)
+		}
+	case *parse.ActionNode:
+		walkTemplate(n.Pipe, visit)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			walkTemplate(c, visit)
+		}
+	case *parse.CommandNode:
+		for _, c := range n.Args {
+			walkTemplate(c, visit)
+		}
+	case *parse.IfNode:
+		walkTemplate(n.Pipe, visit)
+		walkTemplate(n.List, visit)
+		walkTemplate(n.ElseList, visit)
+	case *parse.RangeNode:
+		walkTemplate(n.Pipe, visit)
+		walkTemplate(n.ElseList, visit)
+	case *parse.WithNode:
+		walkTemplate(n.Pipe, visit)
+		walkTemplate(n.ElseList, visit)
+	case *parse.TemplateNode:
+		walkTemplate(n.Pipe, visit)
+	}
+}
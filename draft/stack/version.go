@@ -0,0 +1,277 @@
+package stack
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Version is a https://semver.org version like 16.2.0 or 2.40.0-rc1.
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+}
+
+// ParseVersion parses a semantic version. Build metadata is ignored.
+func ParseVersion(s string) (Version, error) {
+	v, parts, err := parseVersion(s)
+	if err != nil {
+		return Version{}, err
+	}
+	if parts != 3 {
+		return Version{}, fmt.Errorf("invalid version %q: must have major, minor and patch", s)
+	}
+	return v, nil
+}
+
+// parseVersion parses a possibly partial version like 16 or 16.2 returning the number of parts
+// given. Missing parts are zero.
+func parseVersion(s string) (Version, int, error) {
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	var v Version
+	core := s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		core, v.Prerelease = s[:i], s[i+1:]
+		if v.Prerelease == "" {
+			return Version{}, 0, fmt.Errorf("invalid version %q: empty prerelease", s)
+		}
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return Version{}, 0, fmt.Errorf("invalid version %q: too many parts", s)
+	}
+	nums := [3]*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || (len(p) > 1 && p[0] == '0') {
+			return Version{}, 0, fmt.Errorf("invalid version %q: part %q is not a number", s, p)
+		}
+		*nums[i] = n
+	}
+	if v.Prerelease != "" && len(parts) != 3 {
+		return Version{}, 0, fmt.Errorf("invalid version %q: prerelease needs major, minor and patch", s)
+	}
+	return v, len(parts), nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	return s
+}
+
+// Compare returns -1 if v is lower than o, 0 if they are equal and 1 if v is greater than o.
+// Prereleases are lower than their release.
+func (v Version) Compare(o Version) int {
+	for _, c := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if c[0] != c[1] {
+			return compareInt(c[0], c[1])
+		}
+	}
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	}
+	a, b := strings.Split(v.Prerelease, "."), strings.Split(o.Prerelease, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		na, errA := strconv.Atoi(a[i])
+		nb, errB := strconv.Atoi(b[i])
+		switch {
+		case errA == nil && errB == nil:
+			return compareInt(na, nb)
+		case errA == nil:
+			return -1
+		case errB == nil:
+			return 1
+		}
+		return strings.Compare(a[i], b[i])
+	}
+	return compareInt(len(a), len(b))
+}
+
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Constraint on the version of a required stack. A constraint is a list of comparisons separated
+// by commas or spaces that all need to be met. Comparisons are
+//
+//   - =1.2.3 or 1.2.3 exactly the version. Partial versions like 1.2 match any 1.2.x
+//   - !=1.2.3 any but the version
+//   - >1.2.3, >=1.2.3, <1.2.3, <=1.2.3 greater or lower than the version
+//   - ~1.2.3 at least the version but lower than the next minor version 1.3.0
+//   - ^1.2.3 at least the version but lower than the next major version 2.0.0 or the next minor
+//     version for 0.x versions
+//
+// The empty constraint is met by any version.
+type Constraint struct {
+	text        string
+	comparisons []comparison
+}
+
+type comparison struct {
+	op      string
+	version Version
+}
+
+// ParseConstraint parses a version constraint like ">=16.0.0, <17" or "^2.40".
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{text: strings.TrimSpace(s)}
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		start := strings.IndexFunc(f, unicode.IsDigit)
+		if start < 0 && i+1 < len(fields) {
+			// allow a space between operator and version like ">= 1.2.3"
+			i++
+			f += fields[i]
+			start = strings.IndexFunc(f, unicode.IsDigit)
+		}
+		if start < 0 {
+			return Constraint{}, fmt.Errorf("invalid constraint %q: %q has no version", s, f)
+		}
+		op := f[:start]
+		v, parts, err := parseVersion(f[start:])
+		if err != nil {
+			return Constraint{}, fmt.Errorf("invalid constraint %q: %v", s, err)
+		}
+		switch op {
+		case "", "=":
+			if parts == 3 {
+				c.comparisons = append(c.comparisons, comparison{op: "=", version: v})
+			} else {
+				c.comparisons = append(c.comparisons, upTo(">=", v, "<", next(v, parts))...)
+			}
+		case "!=", ">", ">=", "<", "<=":
+			c.comparisons = append(c.comparisons, comparison{op: op, version: v})
+		case "~":
+			c.comparisons = append(c.comparisons, upTo(">=", v, "<", next(v, minInt(parts, 2)))...)
+		case "^":
+			c.comparisons = append(c.comparisons, upTo(">=", v, "<", nextCaret(v, parts))...)
+		default:
+			return Constraint{}, fmt.Errorf("invalid constraint %q: unknown operator %q", s, op)
+		}
+	}
+	return c, nil
+}
+
+func upTo(fromOp string, from Version, toOp string, to Version) []comparison {
+	return []comparison{{op: fromOp, version: from}, {op: toOp, version: to}}
+}
+
+// next returns the version following v in its last given part. The next version of 1.2 is 1.3.0.
+func next(v Version, parts int) Version {
+	switch parts {
+	case 1:
+		return Version{Major: v.Major + 1}
+	case 2:
+		return Version{Major: v.Major, Minor: v.Minor + 1}
+	}
+	return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+}
+
+// nextCaret returns the first version not compatible with v which is the next version in the
+// first non-zero part.
+func nextCaret(v Version, parts int) Version {
+	switch {
+	case v.Major > 0 || parts == 1:
+		return next(v, 1)
+	case v.Minor > 0 || parts == 2:
+		return next(v, 2)
+	}
+	return next(v, 3)
+}
+
+// Check reports whether v meets the constraint.
+func (c Constraint) Check(v Version) bool {
+	for _, cmp := range c.comparisons {
+		r := v.Compare(cmp.version)
+		var ok bool
+		switch cmp.op {
+		case "=":
+			ok = r == 0
+		case "!=":
+			ok = r != 0
+		case ">":
+			ok = r > 0
+		case ">=":
+			ok = r >= 0
+		case "<":
+			ok = r < 0
+		case "<=":
+			ok = r <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Constraint) String() string {
+	return c.text
+}
+
+// matchingVersions returns the versions meeting the constraint ordered from latest to oldest.
+// Empty versions never meet a constraint.
+func matchingVersions(c Constraint, versions []string) []string {
+	var result []string
+	for _, v := range sortedVersions(versions) {
+		parsed, err := ParseVersion(v)
+		if err == nil && c.Check(parsed) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// sortedVersions returns the valid versions ordered from latest to oldest. Versions are returned
+// as given so versions with build metadata like 1.0.0+abc keep it. Versions of equal precedence are
+// ordered by their text.
+func sortedVersions(versions []string) []string {
+	type version struct {
+		text   string
+		parsed Version
+	}
+	valid := make([]version, 0, len(versions))
+	for _, v := range versions {
+		p, err := ParseVersion(v)
+		if err == nil {
+			valid = append(valid, version{text: v, parsed: p})
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		if c := valid[i].parsed.Compare(valid[j].parsed); c != 0 {
+			return c > 0
+		}
+		return valid[i].text > valid[j].text
+	})
+	result := make([]string, len(valid))
+	for i, v := range valid {
+		result[i] = v.text
+	}
+	return result
+}